@@ -2,56 +2,231 @@
 package address
 
 import (
+	"bytes"
 	"errors"
 	"strings"
 
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcutil/base58"
+	"golang.org/x/net/idna"
 )
 
-// Encode a moonbeam address for the given bitcoin address and domain.
-func Encode(bitcoinAddr, domain string) (string, error) {
-	if _, _, err := base58.CheckDecode(bitcoinAddr); err != nil {
-		return "", err
+var (
+	ErrInvalidFormat         = errors.New("address: invalid format")
+	ErrBadChecksum           = errors.New("address: bad checksum")
+	ErrBadDomain             = errors.New("address: invalid domain")
+	ErrInvalidBitcoinAddress = errors.New("address: invalid bitcoin address")
+	ErrWrongNet              = errors.New("address: bitcoin address is for a different network")
+	ErrUnsupportedVersion    = errors.New("address: unsupported version")
+)
+
+// version is the base58 version byte of moonbeam addresses.
+const version = 0x01
+
+// networks are the networks recognised by Network, in order of preference.
+var networks = []*chaincfg.Params{
+	&chaincfg.MainNetParams,
+	&chaincfg.TestNet3Params,
+	&chaincfg.RegressionNetParams,
+}
+
+// segwitHRPs are the human-readable parts of segwit addresses on the
+// supported networks.
+var segwitHRPs = map[string]bool{"bc": true, "tb": true, "bcrt": true}
+
+// isSegWit reports whether bitcoinAddr is a valid segwit address.
+func isSegWit(bitcoinAddr string) bool {
+	hrp, _, _, err := DecodeSegWit(bitcoinAddr)
+	return err == nil && segwitHRPs[hrp]
+}
+
+// segwitChecksum returns the checksum of a moonbeam address with a segwit
+// bitcoin address: the first 30 bits of the double SHA-256 hash of
+// "<bitcoinAddr>+mb@<domain>", in lowercase, encoded with the bech32
+// character set. Unlike the base58 checksum it is case-insensitive like the
+// bitcoin address itself.
+func segwitChecksum(bitcoinAddr, domain string) string {
+	s := strings.ToLower(bitcoinAddr + "+mb@" + domain)
+	hash := chainhash.DoubleHashB([]byte(s))
+	data, _ := convertBits(hash[:4], 8, 5, true)
+	var b bytes.Buffer
+	for _, d := range data[:6] {
+		b.WriteByte(charset[d])
+	}
+	return b.String()
+}
+
+// NormalizeDomain returns the canonical form of domain: lower case, with
+// internationalized labels converted to punycode.
+func NormalizeDomain(domain string) (string, error) {
+	if domain == "" {
+		return "", ErrBadDomain
 	}
-	if strings.Contains(domain, "@") {
-		return "", errors.New("invalid domain")
+	d, err := idna.Lookup.ToASCII(domain)
+	if err != nil || d == "" || strings.ContainsAny(d, "@+/:") {
+		return "", ErrBadDomain
 	}
+	return d, nil
+}
 
-	s := bitcoinAddr + "+mb@" + domain
+// onNet reports whether bitcoinAddr is an address on net.
+func onNet(bitcoinAddr string, net *chaincfg.Params) bool {
+	if hrp, _, _, err := DecodeSegWit(bitcoinAddr); err == nil {
+		return hrp == net.Bech32HRPSegwit
+	}
+	_, v, err := base58.CheckDecode(bitcoinAddr)
+	return err == nil && (v == net.PubKeyHashAddrID || v == net.ScriptHashAddrID)
+}
 
-	encoded := base58.CheckEncode([]byte(s), 1)
+// Address is a parsed moonbeam address.
+type Address struct {
+	// BitcoinAddr is the embedded bitcoin address. Segwit addresses are in
+	// lower case.
+	BitcoinAddr string
 
-	version := string(encoded[0])
-	checksum := string(encoded[len(encoded)-4:])
+	// Domain is the normalized domain of the receiver.
+	Domain string
 
-	return bitcoinAddr + "+mb" + version + checksum + "@" + domain, nil
+	net *chaincfg.Params
 }
 
-// Decode a moonbeam address into its constituent bitcoin address and domain.
-func Decode(addr string) (bitcoinAddr, domain string, valid bool) {
-	i := strings.Index(addr, "@")
+// Parse a moonbeam address. If net is not nil, the bitcoin address must be
+// on that network.
+func Parse(s string, net *chaincfg.Params) (*Address, error) {
+	i := strings.Index(s, "@")
 	if i < 0 {
-		return "", "", false
+		return nil, ErrInvalidFormat
 	}
+	before, rawDomain := s[:i], s[i+1:]
 
-	before := addr[:i]
-	domain = addr[i+1:]
+	domain, err := NormalizeDomain(rawDomain)
+	if err != nil {
+		return nil, err
+	}
 
 	i = strings.Index(before, "+")
 	if i < 0 {
-		return "", "", false
+		return nil, ErrInvalidFormat
+	}
+	bitcoinAddr, tag := before[:i], before[i+1:]
+
+	if isSegWit(bitcoinAddr) {
+		// The bitcoin address is case-insensitive so the moonbeam part
+		// is too, but mixed case is invalid.
+		if strings.ToUpper(tag) == tag {
+			tag = strings.ToLower(tag)
+		}
+		bitcoinAddr = strings.ToLower(bitcoinAddr)
+	} else if _, _, err := base58.CheckDecode(bitcoinAddr); err != nil {
+		return nil, ErrInvalidBitcoinAddress
+	}
+
+	if !strings.HasPrefix(tag, "mb") {
+		return nil, ErrInvalidFormat
+	}
+
+	a := &Address{BitcoinAddr: bitcoinAddr, Domain: domain, net: net}
+	if net == nil {
+		a.net = a.detectNet()
+	} else if !onNet(bitcoinAddr, net) {
+		return nil, ErrWrongNet
+	}
+	if a.net == nil {
+		return nil, ErrWrongNet
+	}
+
+	if tag[2:] == a.checksum() {
+		return a, nil
+	}
+	// Addresses encoded before domains were normalized have the checksum
+	// of the domain as written.
+	if !isSegWit(bitcoinAddr) && rawDomain != domain &&
+		tag[2:] == base58Checksum(bitcoinAddr, rawDomain) {
+		return a, nil
+	}
+	if !isSegWit(bitcoinAddr) && otherVersion(bitcoinAddr, domain, tag[2:]) {
+		return nil, ErrUnsupportedVersion
+	}
+	return nil, ErrBadChecksum
+}
+
+// otherVersion reports whether sum is a valid base58 version and checksum
+// for a version other than the one supported.
+func otherVersion(bitcoinAddr, domain, sum string) bool {
+	if len(sum) != 5 {
+		return false
+	}
+	s := []byte(bitcoinAddr + "+mb@" + domain)
+	for v := 0; v < 256; v++ {
+		if v == version {
+			continue
+		}
+		encoded := base58.CheckEncode(s, byte(v))
+		if encoded[:1]+encoded[len(encoded)-4:] == sum {
+			return true
+		}
+	}
+	return false
+}
+
+// checksum returns the part of the address following "+mb".
+func (a *Address) checksum() string {
+	if isSegWit(a.BitcoinAddr) {
+		return segwitChecksum(a.BitcoinAddr, a.Domain)
 	}
+	return base58Checksum(a.BitcoinAddr, a.Domain)
+}
+
+func base58Checksum(bitcoinAddr, domain string) string {
+	encoded := base58.CheckEncode([]byte(bitcoinAddr+"+mb@"+domain), version)
+	return encoded[:1] + encoded[len(encoded)-4:]
+}
 
-	bitcoinAddr = before[:i]
+func (a *Address) detectNet() *chaincfg.Params {
+	for _, net := range networks {
+		if onNet(a.BitcoinAddr, net) {
+			return net
+		}
+	}
+	return nil
+}
 
-	expected, err := Encode(bitcoinAddr, domain)
+// String returns the canonical encoding of the address.
+func (a *Address) String() string {
+	return a.BitcoinAddr + "+mb" + a.checksum() + "@" + a.Domain
+}
+
+// Network returns the network of the bitcoin address. It is the network
+// passed to Parse, if any. Otherwise base58 addresses shared by testnet and
+// regtest are reported as testnet.
+func (a *Address) Network() *chaincfg.Params {
+	return a.net
+}
+
+// Encode a moonbeam address for the given bitcoin address and domain.
+func Encode(bitcoinAddr, domain string) (string, error) {
+	d, err := NormalizeDomain(domain)
 	if err != nil {
-		return "", "", false
+		return "", err
 	}
 
-	if addr != expected {
-		return "", "", false
+	if isSegWit(bitcoinAddr) {
+		bitcoinAddr = strings.ToLower(bitcoinAddr)
+	} else if _, _, err := base58.CheckDecode(bitcoinAddr); err != nil {
+		return "", ErrInvalidBitcoinAddress
 	}
 
-	return bitcoinAddr, domain, true
+	a := &Address{BitcoinAddr: bitcoinAddr, Domain: d}
+	return a.String(), nil
+}
+
+// Decode a moonbeam address into its constituent bitcoin address and domain.
+// Use Parse to find out why an address is invalid.
+func Decode(addr string) (bitcoinAddr, domain string, valid bool) {
+	a, err := Parse(addr, nil)
+	if err != nil {
+		return "", "", false
+	}
+	return a.BitcoinAddr, a.Domain, true
 }
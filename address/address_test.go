@@ -1,7 +1,15 @@
 package address
 
 import (
+	"bytes"
+	"encoding/hex"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/base58"
 )
 
 const (
@@ -68,3 +76,312 @@ func TestDecodeInvalidBitcoinAddress(t *testing.T) {
 		t.Errorf("Expected empty components")
 	}
 }
+
+func TestParse(t *testing.T) {
+	a, err := Parse("mgzdqkEjYEjR5QNdJxYFnCKZHuNYa5bUZ2+mb7vCiK@Example.COM", &chaincfg.TestNet3Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.BitcoinAddr != testBitcoinAddr || a.Domain != testDomain {
+		t.Errorf("Unexpected components: %s %s", a.BitcoinAddr, a.Domain)
+	}
+	if a.String() != testAddr {
+		t.Errorf("Unexpected string: %s", a.String())
+	}
+	if a.Network() != &chaincfg.TestNet3Params {
+		t.Errorf("Unexpected network: %s", a.Network().Name)
+	}
+
+	a, err = Parse(testAddr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Network() != &chaincfg.TestNet3Params {
+		t.Errorf("Unexpected network: %s", a.Network().Name)
+	}
+
+	encoded := base58.CheckEncode([]byte(testBitcoinAddr+"+mb@"+testDomain), 2)
+	v2 := testBitcoinAddr + "+mb" + encoded[:1] + encoded[len(encoded)-4:] + "@" + testDomain
+
+	invalid := []struct {
+		addr string
+		net  *chaincfg.Params
+		err  error
+	}{
+		{"mgzdqkEjYEjR5QNdJxYFnCKZHuNYa5bUZ2", nil, ErrInvalidFormat},
+		{"mgzdqkEjYEjR5QNdJxYFnCKZHuNYa5bUZ2@example.com", nil, ErrInvalidFormat},
+		{"mgzdqkEjYEjR5QNdJxYFnCKZHuNYa5bUZ2+xx7vCiK@example.com", nil, ErrInvalidFormat},
+		{"mgzdqkEjYEjR5QNdJxYFnCKZHuNYa5bUZ2+mb7vCiK@", nil, ErrBadDomain},
+		{"mgzdqkEjYEjR5QNdJxYFnCKZHuNYa5bUZ2+mb7vCiK@ex mple.com", nil, ErrBadDomain},
+		{"mgzdqkEjYEjR5QNdJxYFnCKZHuNYa5bUZ3+mb7Jyf9@example.com", nil, ErrInvalidBitcoinAddress},
+		{testAddr, &chaincfg.MainNetParams, ErrWrongNet},
+		{"mgzdqkEjYEjR5QNdJxYFnCKZHuNYa5bUZ2+mb7vCiK@examp1e.com", nil, ErrBadChecksum},
+		{v2, nil, ErrUnsupportedVersion},
+	}
+	for _, test := range invalid {
+		if _, err := Parse(test.addr, test.net); err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.addr, test.err, err)
+		}
+	}
+}
+
+func TestParseLegacyDomain(t *testing.T) {
+	// Addresses encoded before domains were normalized have the checksum of
+	// the domain as written.
+	idna := testBitcoinAddr + "+mb" + base58Checksum(testBitcoinAddr, "Bücher.example") + "@Bücher.example"
+	for _, addr := range []string{
+		"mgzdqkEjYEjR5QNdJxYFnCKZHuNYa5bUZ2+mb7ivf5@Example.com",
+		idna,
+	} {
+		if _, _, valid := Decode(addr); !valid {
+			t.Errorf("%s: expected valid address", addr)
+		}
+	}
+
+	a, err := Parse("mgzdqkEjYEjR5QNdJxYFnCKZHuNYa5bUZ2+mb7ivf5@Example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.String() != testAddr {
+		t.Errorf("Expected canonical string, got %s", a.String())
+	}
+
+	// The legacy checksum is only valid with the domain as written.
+	if _, err := Parse("mgzdqkEjYEjR5QNdJxYFnCKZHuNYa5bUZ2+mb7ivf5@example.com", nil); err != ErrBadChecksum {
+		t.Errorf("Expected ErrBadChecksum, got %v", err)
+	}
+}
+
+func TestEncodeIDNA(t *testing.T) {
+	addr, err := Encode(testBitcoinAddr, "Bücher.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := Parse(addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Domain != "xn--bcher-kva.example" {
+		t.Errorf("Unexpected domain: %s", a.Domain)
+	}
+
+	// The unicode form parses to the same address.
+	b, err := Parse(strings.Replace(addr, a.Domain, "bücher.example", 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != addr {
+		t.Errorf("Unexpected string: %s", b.String())
+	}
+}
+
+func TestDecodeSegWit(t *testing.T) {
+	valid := []struct {
+		addr    string
+		hrp     string
+		version byte
+		program string
+	}{
+		{"BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4", "bc", 0,
+			"751e76e8199196d454941c45d1b3a323f1433bd6"},
+		{"tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k7", "tb", 0,
+			"1863143c14c5166804bd19203356da136c985678cd4d27a1b8c6329604903262"},
+		{"tb1pqqqqp399et2xygdj5xreqhjjvcmzhxw4aywxecjdzew6hylgvsesf3hn0c", "tb", 1,
+			"000000c4a5cad46221b2a187905e5266362b99d5e91c6ce24d165dab93e86433"},
+	}
+	for _, test := range valid {
+		hrp, version, program, err := DecodeSegWit(test.addr)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.addr, err)
+			continue
+		}
+		if hrp != test.hrp || version != test.version ||
+			hex.EncodeToString(program) != test.program {
+			t.Errorf("%s: unexpected result %s %d %x", test.addr, hrp, version, program)
+		}
+
+		addr, err := EncodeSegWit(hrp, version, program)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr != strings.ToLower(test.addr) {
+			t.Errorf("%s: unexpected encoding %s", test.addr, addr)
+		}
+	}
+
+	program := bytes.Repeat([]byte{1}, 32)
+	data, _ := convertBits(program, 8, 5, true)
+	invalid := []string{
+		// Mixed case
+		"tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5K7",
+		// Bad checksum
+		"tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k8",
+		// Version 1 with a bech32 checksum
+		bech32Encode("tb", append([]byte{1}, data...), bech32Const),
+		// Version 0 with a bech32m checksum
+		bech32Encode("tb", append([]byte{0}, data...), bech32mConst),
+	}
+	for _, addr := range invalid {
+		if _, _, _, err := DecodeSegWit(addr); err != ErrInvalidSegWit {
+			t.Errorf("%s: expected ErrInvalidSegWit, got %v", addr, err)
+		}
+	}
+}
+
+func TestEncodeDecodeSegWit(t *testing.T) {
+	const bitcoinAddr = "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"
+
+	addr, err := Encode(strings.ToUpper(bitcoinAddr), testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != bitcoinAddr+"+mbsxku6l@"+testDomain {
+		t.Errorf("Unexpected result: %s", addr)
+	}
+
+	for _, a := range []string{addr, strings.ToUpper(addr[:strings.Index(addr, "@")]) + "@" + testDomain} {
+		b, domain, valid := Decode(a)
+		if !valid {
+			t.Errorf("%s: expected valid", a)
+		}
+		if b != bitcoinAddr || domain != testDomain {
+			t.Errorf("%s: unexpected components %s %s", a, b, domain)
+		}
+	}
+
+	// Typo in domain (=> incorrect checksum)
+	typo := strings.Replace(addr, "example.com", "examp1e.com", 1)
+	if _, _, valid := Decode(typo); valid {
+		t.Errorf("Expected invalid")
+	}
+}
+
+func TestURI(t *testing.T) {
+	a, err := Parse(testAddr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := URI{
+		Address: a,
+		Amount:  123450000,
+		Memo:    "Order #12 & more",
+		Invoice: "inv-1",
+		Expires: time.Unix(1500000000, 0),
+	}
+	s := u.String()
+	expected := "moonbeam:" + testAddr +
+		"?amount=1.2345&expires=1500000000&invoice=inv-1&memo=Order+%2312+%26+more"
+	if s != expected {
+		t.Errorf("Unexpected URI: %s", s)
+	}
+
+	parsed, err := ParseURI(strings.Replace(s, "moonbeam:", "MOONBEAM:", 1), &chaincfg.TestNet3Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Address.String() != testAddr || parsed.Amount != u.Amount ||
+		parsed.Memo != u.Memo || parsed.Invoice != u.Invoice ||
+		!parsed.Expires.Equal(u.Expires) {
+		t.Errorf("Unexpected result: %+v", parsed)
+	}
+	if !parsed.Expired(u.Expires) || parsed.Expired(u.Expires.Add(-time.Second)) {
+		t.Errorf("Unexpected expiry")
+	}
+
+	bare, err := ParseURI("moonbeam:"+testAddr+"?label=ignored", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bare.Amount != 0 || bare.Expired(time.Now()) {
+		t.Errorf("Unexpected result: %+v", bare)
+	}
+
+	invalid := []string{
+		testAddr,
+		"bitcoin:" + testAddr,
+		"moonbeam:" + testAddr + "?amount=1.123456789",
+		"moonbeam:" + testAddr + "?amount=-1",
+		"moonbeam:" + testAddr + "?amount=0",
+		"moonbeam:" + testAddr + "?amount=1e3",
+		"moonbeam:" + testAddr + "?amount=1&amount=2",
+		"moonbeam:" + testAddr + "?expires=soon",
+		"moonbeam:" + testAddr + "?req-something=1",
+		"moonbeam:mgzdqkEjYEjR5QNdJxYFnCKZHuNYa5bUZ2+mb7vCiK@examp1e.com",
+	}
+	for _, s := range invalid {
+		if _, err := ParseURI(s, nil); err == nil {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+}
+
+func TestAmount(t *testing.T) {
+	for _, test := range []struct {
+		s      string
+		amount int64
+	}{
+		{"1", 100000000},
+		{"0.00000001", 1},
+		{".5", 50000000},
+		{"21000000", 2100000000000000},
+		{"0.1", 10000000},
+	} {
+		amount, err := parseAmount(test.s)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.s, err)
+		}
+		if amount != test.amount {
+			t.Errorf("%s: unexpected amount %d", test.s, amount)
+		}
+		if s := formatAmount(amount); strings.TrimPrefix(test.s, "0") != strings.TrimPrefix(s, "0") {
+			t.Errorf("%d: unexpected format %s", amount, s)
+		}
+	}
+}
+
+func TestVerifyTarget(t *testing.T) {
+	wif, err := btcutil.DecodeWIF("cRTgZtoTP8ueH4w7nob5reYTKpFLHvDV9UfUfa67f3SMCaZkGB6L")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkh, err := btcutil.NewAddressPubKeyHash(
+		btcutil.Hash160(wif.SerializePubKey()), &chaincfg.TestNet3Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := Encode(pkh.EncodeAddress(), testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := TargetMessage("abc", 1, []byte(`{"amount":1000}`))
+	sig, err := SignTarget(wif.PrivKey, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyTarget(target, msg, sig); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	other := TargetMessage("abc", 2, []byte(`{"amount":1000}`))
+	if err := VerifyTarget(target, other, sig); err != ErrInvalidProof {
+		t.Errorf("Expected ErrInvalidProof, got %v", err)
+	}
+	if err := VerifyTarget(testAddr, msg, sig); err != ErrInvalidProof {
+		t.Errorf("Expected ErrInvalidProof, got %v", err)
+	}
+
+	// A P2SH address with the same hash isn't controlled by the key.
+	p2sh, err := btcutil.NewAddressScriptHashFromHash(pkh.ScriptAddress(), &chaincfg.TestNet3Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err = Encode(p2sh.EncodeAddress(), testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyTarget(target, msg, sig); err == nil {
+		t.Errorf("Expected error for P2SH target")
+	}
+}
@@ -0,0 +1,84 @@
+package address
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/base58"
+)
+
+var ErrInvalidProof = errors.New("address: invalid target signature")
+
+// TargetMessage returns the message the owner of a target's bitcoin address
+// signs to prove that a payment on the channel reaches them.
+func TargetMessage(txid string, vout uint32, payment []byte) []byte {
+	hash := sha256.Sum256(payment)
+	return []byte(fmt.Sprintf("moonbeam target\n%s-%d\n%s",
+		txid, vout, hex.EncodeToString(hash[:])))
+}
+
+// signedMessageHash returns the hash used by Bitcoin Core's signmessage so
+// that the proof can also be made with a wallet.
+func signedMessageHash(msg []byte) []byte {
+	var b bytes.Buffer
+	wire.WriteVarString(&b, 0, "Bitcoin Signed Message:\n")
+	wire.WriteVarString(&b, 0, string(msg))
+	return chainhash.DoubleHashB(b.Bytes())
+}
+
+// SignTarget signs msg with the key of a P2PKH or P2WPKH address, returning
+// a compact signature.
+func SignTarget(key *btcec.PrivateKey, msg []byte) ([]byte, error) {
+	return btcec.SignCompact(btcec.S256(), key, signedMessageHash(msg), true)
+}
+
+// VerifyTarget checks that sig is a signature of msg made with the key of the
+// bitcoin address embedded in the moonbeam address target.
+func VerifyTarget(target string, msg, sig []byte) error {
+	a, err := Parse(target, nil)
+	if err != nil {
+		return err
+	}
+	bitcoinAddr := a.BitcoinAddr
+	var pkHash []byte
+	if isSegWit(bitcoinAddr) {
+		_, version, program, err := DecodeSegWit(bitcoinAddr)
+		if err != nil {
+			return err
+		}
+		if version != 0 || len(program) != 20 {
+			return errors.New("address: only P2PKH and P2WPKH targets can be proven")
+		}
+		pkHash = program
+	} else {
+		h, version, err := base58.CheckDecode(bitcoinAddr)
+		if err != nil {
+			return err
+		}
+		if version != a.Network().PubKeyHashAddrID {
+			return errors.New("address: only P2PKH and P2WPKH targets can be proven")
+		}
+		pkHash = h
+	}
+
+	pubKey, compressed, err := btcec.RecoverCompact(btcec.S256(), sig, signedMessageHash(msg))
+	if err != nil {
+		return ErrInvalidProof
+	}
+	serialized := pubKey.SerializeUncompressed()
+	if compressed {
+		serialized = pubKey.SerializeCompressed()
+	}
+
+	if !bytes.Equal(btcutil.Hash160(serialized), pkHash) {
+		return ErrInvalidProof
+	}
+	return nil
+}
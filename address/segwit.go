@@ -0,0 +1,172 @@
+package address
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+// This file implements segwit addresses as specified in BIP 173 (bech32,
+// witness version 0) and BIP 350 (bech32m, witness versions 1 to 16).
+
+const charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+const (
+	bech32Const  = 1
+	bech32mConst = 0x2bc830a3
+)
+
+var ErrInvalidSegWit = errors.New("address: invalid segwit address")
+
+func polymod(values []byte) uint32 {
+	gen := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		b := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (b>>uint(i))&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+func hrpExpand(hrp string) []byte {
+	res := make([]byte, 0, 2*len(hrp)+1)
+	for i := 0; i < len(hrp); i++ {
+		res = append(res, hrp[i]>>5)
+	}
+	res = append(res, 0)
+	for i := 0; i < len(hrp); i++ {
+		res = append(res, hrp[i]&31)
+	}
+	return res
+}
+
+func checksum(hrp string, data []byte, c uint32) []byte {
+	values := append(hrpExpand(hrp), data...)
+	values = append(values, 0, 0, 0, 0, 0, 0)
+	mod := polymod(values) ^ c
+	res := make([]byte, 6)
+	for i := range res {
+		res[i] = byte((mod >> uint(5*(5-i))) & 31)
+	}
+	return res
+}
+
+// bech32Decode returns the human-readable part, the data and the checksum
+// constant of a bech32 or bech32m string.
+func bech32Decode(s string) (string, []byte, uint32, error) {
+	if len(s) > 90 {
+		return "", nil, 0, ErrInvalidSegWit
+	}
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, 0, ErrInvalidSegWit
+	}
+	s = strings.ToLower(s)
+
+	pos := strings.LastIndex(s, "1")
+	if pos < 1 || pos+7 > len(s) {
+		return "", nil, 0, ErrInvalidSegWit
+	}
+	hrp := s[:pos]
+	for i := 0; i < len(hrp); i++ {
+		if hrp[i] < 33 || hrp[i] > 126 {
+			return "", nil, 0, ErrInvalidSegWit
+		}
+	}
+
+	var data []byte
+	for i := pos + 1; i < len(s); i++ {
+		d := strings.IndexByte(charset, s[i])
+		if d < 0 {
+			return "", nil, 0, ErrInvalidSegWit
+		}
+		data = append(data, byte(d))
+	}
+
+	c := polymod(append(hrpExpand(hrp), data...))
+	if c != bech32Const && c != bech32mConst {
+		return "", nil, 0, ErrInvalidSegWit
+	}
+	return hrp, data[:len(data)-6], c, nil
+}
+
+func bech32Encode(hrp string, data []byte, c uint32) string {
+	combined := append(data, checksum(hrp, data, c)...)
+	var b bytes.Buffer
+	b.WriteString(hrp)
+	b.WriteByte('1')
+	for _, d := range combined {
+		b.WriteByte(charset[d])
+	}
+	return b.String()
+}
+
+func convertBits(data []byte, from, to uint, pad bool) ([]byte, bool) {
+	var acc uint32
+	var bits uint
+	maxv := uint32(1)<<to - 1
+	var res []byte
+	for _, v := range data {
+		if uint32(v)>>from != 0 {
+			return nil, false
+		}
+		acc = acc<<from | uint32(v)
+		bits += from
+		for bits >= to {
+			bits -= to
+			res = append(res, byte((acc>>bits)&maxv))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			res = append(res, byte((acc<<(to-bits))&maxv))
+		}
+	} else if bits >= from || (acc<<(to-bits))&maxv != 0 {
+		return nil, false
+	}
+	return res, true
+}
+
+// DecodeSegWit decodes a segwit address, returning its human-readable part,
+// witness version and witness program.
+func DecodeSegWit(addr string) (hrp string, version byte, program []byte, err error) {
+	hrp, data, c, err := bech32Decode(addr)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if len(data) < 1 || data[0] > 16 {
+		return "", 0, nil, ErrInvalidSegWit
+	}
+	version = data[0]
+
+	program, ok := convertBits(data[1:], 5, 8, false)
+	if !ok || len(program) < 2 || len(program) > 40 {
+		return "", 0, nil, ErrInvalidSegWit
+	}
+	if version == 0 && len(program) != 20 && len(program) != 32 {
+		return "", 0, nil, ErrInvalidSegWit
+	}
+	if (version == 0) != (c == bech32Const) {
+		return "", 0, nil, ErrInvalidSegWit
+	}
+	return hrp, version, program, nil
+}
+
+// EncodeSegWit encodes a witness program as a segwit address.
+func EncodeSegWit(hrp string, version byte, program []byte) (string, error) {
+	data, _ := convertBits(program, 8, 5, true)
+	c := uint32(bech32Const)
+	if version > 0 {
+		c = bech32mConst
+	}
+	addr := bech32Encode(hrp, append([]byte{version}, data...), c)
+
+	if _, _, _, err := DecodeSegWit(addr); err != nil {
+		return "", err
+	}
+	return addr, nil
+}
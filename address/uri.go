@@ -0,0 +1,166 @@
+package address
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// URIScheme is the scheme of moonbeam payment request URIs.
+const URIScheme = "moonbeam"
+
+var (
+	ErrInvalidURI    = errors.New("address: invalid moonbeam URI")
+	ErrInvalidAmount = errors.New("address: invalid amount")
+)
+
+// URI is a payment request for a moonbeam address. It is formatted like a
+// BIP 21 URI:
+//
+//	moonbeam:<address>?amount=<btc>&memo=<memo>&invoice=<id>&expires=<unix>
+//
+// All the parameters are optional. Unknown parameters are ignored, unless
+// they start with "req-".
+type URI struct {
+	Address *Address
+
+	// Amount in Satoshi. Zero means that the sender chooses the amount.
+	Amount int64
+
+	// Memo describes the payment to the sender.
+	Memo string
+
+	// Invoice identifies the payment to the receiver.
+	Invoice string
+
+	// Expires is the time from which the request should no longer be paid. Zero
+	// means that the request doesn't expire.
+	Expires time.Time
+}
+
+// IsURI reports whether s looks like a moonbeam URI rather than an address.
+func IsURI(s string) bool {
+	return len(s) > len(URIScheme) &&
+		strings.EqualFold(s[:len(URIScheme)+1], URIScheme+":")
+}
+
+// ParseURI parses a moonbeam URI. If net is not nil, the address must be on
+// that network.
+func ParseURI(s string, net *chaincfg.Params) (*URI, error) {
+	if !IsURI(s) {
+		return nil, ErrInvalidURI
+	}
+	s = s[len(URIScheme)+1:]
+
+	rawQuery := ""
+	if i := strings.Index(s, "?"); i >= 0 {
+		s, rawQuery = s[:i], s[i+1:]
+	}
+
+	addr, err := url.PathUnescape(s)
+	if err != nil {
+		return nil, ErrInvalidURI
+	}
+	a, err := Parse(addr, net)
+	if err != nil {
+		return nil, err
+	}
+
+	q, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, ErrInvalidURI
+	}
+
+	u := &URI{Address: a}
+	for k, v := range q {
+		if len(v) != 1 {
+			return nil, ErrInvalidURI
+		}
+		switch k {
+		case "amount":
+			if u.Amount, err = parseAmount(v[0]); err != nil {
+				return nil, err
+			}
+		case "memo":
+			u.Memo = v[0]
+		case "invoice":
+			u.Invoice = v[0]
+		case "expires":
+			t, err := strconv.ParseInt(v[0], 10, 64)
+			if err != nil || t <= 0 {
+				return nil, ErrInvalidURI
+			}
+			u.Expires = time.Unix(t, 0)
+		default:
+			if strings.HasPrefix(k, "req-") {
+				return nil, fmt.Errorf("address: unsupported required parameter %s", k)
+			}
+		}
+	}
+
+	return u, nil
+}
+
+// String returns the URI with the address in canonical form.
+func (u *URI) String() string {
+	q := make(url.Values)
+	if u.Amount > 0 {
+		q.Set("amount", formatAmount(u.Amount))
+	}
+	if u.Memo != "" {
+		q.Set("memo", u.Memo)
+	}
+	if u.Invoice != "" {
+		q.Set("invoice", u.Invoice)
+	}
+	if !u.Expires.IsZero() {
+		q.Set("expires", strconv.FormatInt(u.Expires.Unix(), 10))
+	}
+
+	s := URIScheme + ":" + u.Address.String()
+	if len(q) > 0 {
+		s += "?" + q.Encode()
+	}
+	return s
+}
+
+// Expired reports whether the request has expired at now.
+func (u *URI) Expired(now time.Time) bool {
+	return !u.Expires.IsZero() && !now.Before(u.Expires)
+}
+
+// parseAmount parses a decimal amount of bitcoin into Satoshi without
+// rounding.
+func parseAmount(s string) (int64, error) {
+	whole, frac := s, ""
+	if i := strings.Index(s, "."); i >= 0 {
+		whole, frac = s[:i], s[i+1:]
+	}
+	if whole+frac == "" || len(frac) > 8 {
+		return 0, ErrInvalidAmount
+	}
+	for _, c := range whole + frac {
+		if c < '0' || c > '9' {
+			return 0, ErrInvalidAmount
+		}
+	}
+
+	frac += strings.Repeat("0", 8-len(frac))
+	n, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, ErrInvalidAmount
+	}
+	return n, nil
+}
+
+// formatAmount formats an amount in Satoshi as a decimal amount of bitcoin.
+func formatAmount(amount int64) string {
+	s := fmt.Sprintf("%d.%08d", amount/1e8, amount%1e8)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
@@ -0,0 +1,113 @@
+package channels
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec"
+
+	"github.com/luno/moonbeam/models"
+)
+
+// CertificateMessage returns the message signed by the keys in a channel
+// certificate.
+func CertificateMessage(c *models.ChannelCertificate) []byte {
+	return []byte(fmt.Sprintf("moonbeam channel\n%s\n%s-%d\n%s\n%d\n%d\n%d\n%s\n%s\n%s\n%s",
+		c.Domain, c.TxID, c.Vout, c.Net, c.Capacity, c.Timeout, c.Fee,
+		hex.EncodeToString(c.SenderPubKey), hex.EncodeToString(c.ReceiverPubKey),
+		c.SenderOutput, c.ReceiverOutput))
+}
+
+// verifyMessage checks that sigBytes is a DER signature of the SHA-256 hash
+// of msg by the serialized public key.
+func verifyMessage(pubKeyBytes, msg, sigBytes []byte) error {
+	pubKey, err := btcec.ParsePubKey(pubKeyBytes, btcec.S256())
+	if err != nil {
+		return err
+	}
+	sig, err := btcec.ParseDERSignature(sigBytes, btcec.S256())
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	hash := sha256.Sum256(msg)
+	if !sig.Verify(hash[:], pubKey) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Certificate returns a statement that the receiver accepted the open
+// channel for domain, signed with the receiver's channel key.
+func (r *Receiver) Certificate(domain string) (*models.ChannelCertificate, error) {
+	if r.State.Status != StatusOpen && r.State.Status != StatusClosing {
+		return nil, ErrNotStatusOpen
+	}
+
+	s := r.State
+	c := &models.ChannelCertificate{
+		Domain:         domain,
+		TxID:           s.FundingTxID,
+		Vout:           s.FundingVout,
+		Net:            s.Net,
+		Capacity:       s.Capacity,
+		Timeout:        s.Timeout,
+		Fee:            s.Fee,
+		SenderPubKey:   s.SenderPubKey,
+		ReceiverPubKey: s.ReceiverPubKey,
+		SenderOutput:   s.SenderOutput,
+		ReceiverOutput: s.ReceiverOutput,
+	}
+
+	hash := sha256.Sum256(CertificateMessage(c))
+	sig, err := r.privKey.Sign(hash[:])
+	if err != nil {
+		return nil, err
+	}
+	c.ReceiverSig = sig.Serialize()
+	return c, nil
+}
+
+// SignCertificateDomain adds a signature with the domain's long-term key to
+// the certificate.
+func SignCertificateDomain(c *models.ChannelCertificate, key *btcec.PrivateKey) error {
+	hash := sha256.Sum256(CertificateMessage(c))
+	sig, err := key.Sign(hash[:])
+	if err != nil {
+		return err
+	}
+	c.DomainPubKey = key.PubKey().SerializeCompressed()
+	c.DomainSig = sig.Serialize()
+	return nil
+}
+
+// VerifyCertificate checks the receiver's signature and the domain signature,
+// if present. It doesn't check that DomainPubKey belongs to the domain.
+func VerifyCertificate(c *models.ChannelCertificate) error {
+	msg := CertificateMessage(c)
+	if err := verifyMessage(c.ReceiverPubKey, msg, c.ReceiverSig); err != nil {
+		return err
+	}
+	if c.DomainSig == nil {
+		return nil
+	}
+	return verifyMessage(c.DomainPubKey, msg, c.DomainSig)
+}
+
+// checkCertificate verifies that the certificate is valid and describes the
+// channel.
+func (s *Sender) checkCertificate(c *models.ChannelCertificate) error {
+	ss := s.State
+	if c.TxID != ss.FundingTxID || c.Vout != ss.FundingVout ||
+		c.Net != ss.Net || c.Capacity != ss.Capacity ||
+		c.Timeout != ss.Timeout || c.Fee != ss.Fee ||
+		!bytes.Equal(c.SenderPubKey, ss.SenderPubKey) ||
+		!bytes.Equal(c.ReceiverPubKey, ss.ReceiverPubKey) ||
+		c.SenderOutput != ss.SenderOutput ||
+		c.ReceiverOutput != ss.ReceiverOutput {
+		return errors.New("certificate does not match channel")
+	}
+	return VerifyCertificate(c)
+}
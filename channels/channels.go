@@ -38,6 +38,7 @@ const (
 
 var ErrAmountTooSmall = errors.New("amount is too small")
 var ErrInsufficientCapacity = errors.New("amount exceeds channel capacity")
+var ErrInvalidPaymentSize = errors.New("invalid payment size")
 
 func (ss *SharedState) validateAmount(amount int64) (int64, error) {
 	if amount <= 0 {
@@ -49,7 +50,8 @@ func (ss *SharedState) validateAmount(amount int64) (int64, error) {
 
 	newBalance := ss.Balance + amount
 
-	if newBalance < dustThreshold {
+	// Only look up the output's threshold if it could matter.
+	if newBalance < dustThreshold && newBalance < ss.receiverDust() {
 		return ss.Balance, ErrAmountTooSmall
 	}
 
@@ -60,26 +62,25 @@ func (ss *SharedState) validateAmount(amount int64) (int64, error) {
 	return newBalance, nil
 }
 
-var ErrInvalidAddress = errors.New("invalid address")
-
-func checkSupportedAddress(net *chaincfg.Params, addr string) error {
-	a, err := btcutil.DecodeAddress(addr, net)
+// receiverDust returns the smallest balance that can be paid to the
+// receiver's output.
+func (ss *SharedState) receiverDust() int64 {
+	net, err := ss.GetNet()
 	if err != nil {
-		return ErrInvalidAddress
+		return dustThreshold
 	}
-
-	if !a.IsForNet(net) {
-		return ErrInvalidAddress
+	dust, err := outputDust(net, ss.ReceiverOutput)
+	if err != nil {
+		return dustThreshold
 	}
+	return dust
+}
 
-	if _, ok := a.(*btcutil.AddressPubKeyHash); ok {
-		return nil
-	}
-	if _, ok := a.(*btcutil.AddressScriptHash); ok {
-		return nil
-	}
+var ErrInvalidAddress = errors.New("invalid address")
 
-	return ErrInvalidAddress
+func checkSupportedAddress(net *chaincfg.Params, addr string) error {
+	_, err := outputScript(net, addr)
+	return err
 }
 
 func derivePubKey(privKey *btcec.PrivateKey, net *chaincfg.Params) (*btcutil.AddressPubKey, error) {
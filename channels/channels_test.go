@@ -1,13 +1,16 @@
 package channels
 
 import (
+	"bytes"
 	"encoding/hex"
 	"testing"
 
+	"github.com/btcsuite/btcd/btcec"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcutil"
 
+	"github.com/luno/moonbeam/address"
 	"github.com/luno/moonbeam/models"
 )
 
@@ -36,18 +39,22 @@ func setUp(t *testing.T) (*chaincfg.Params, *btcutil.WIF, *btcutil.WIF) {
 }
 
 func setUpChannel(t *testing.T, capacity int64) (*Sender, *Receiver) {
+	return setUpChannelWithOutputs(t, capacity, addr1, addr2)
+}
+
+func setUpChannelWithOutputs(t *testing.T, capacity int64, senderOutput, receiverOutput string) (*Sender, *Receiver) {
 	_, senderWIF, receiverWIF := setUp(t)
 
 	s, err := NewSender(DefaultSenderConfig, senderWIF.PrivKey)
 	if err != nil {
 		t.Fatal(err)
 	}
-	createReq, err := s.GetCreateRequest(addr1)
+	createReq, err := s.GetCreateRequest(senderOutput)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	r, err := NewReceiver(DefaultReceiverConfig, addr2, receiverWIF.PrivKey)
+	r, err := NewReceiver(DefaultReceiverConfig, receiverOutput, receiverWIF.PrivKey)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -190,6 +197,79 @@ func TestSend(t *testing.T) {
 	closeChannels(t, s, r)
 }
 
+func TestCertificate(t *testing.T) {
+	s, r := setUpChannel(t, testCapacity)
+
+	cert, err := r.Certificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	domainKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SignCertificateDomain(cert, domainKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.checkCertificate(cert); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	forged := *cert
+	forged.Domain = "evil.com"
+	if err := VerifyCertificate(&forged); err != ErrInvalidSignature {
+		t.Errorf("Expected ErrInvalidSignature, got %v", err)
+	}
+
+	other := *cert
+	other.Capacity++
+	if err := s.checkCertificate(&other); err == nil {
+		t.Errorf("Expected error for mismatched certificate")
+	}
+}
+
+func TestReceipt(t *testing.T) {
+	s, r := setUpChannel(t, testCapacity)
+
+	const amount = 1000
+
+	sendReq, err := s.GetSendRequest(amount, testPayment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendResp, err := r.Send(amount, sendReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc := sendResp.Receipt
+	if rc == nil {
+		t.Fatal("Expected a receipt")
+	}
+	if rc.Count != 1 || rc.Balance != amount {
+		t.Errorf("Unexpected receipt: %+v", rc)
+	}
+	if err := VerifyReceipt(s.State.ReceiverPubKey, rc); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// The sender rejects receipts for a different amount.
+	if err := s.GotSendResponse(2*amount, testPayment, sendResp); err == nil {
+		t.Errorf("Expected error for mismatched receipt")
+	}
+
+	forged := *rc
+	forged.Balance = 2 * amount
+	if err := VerifyReceipt(s.State.ReceiverPubKey, &forged); err != ErrInvalidSignature {
+		t.Errorf("Expected ErrInvalidSignature, got %v", err)
+	}
+
+	if err := s.GotSendResponse(amount, testPayment, sendResp); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestInvalidSendSig(t *testing.T) {
 	s, r := setUpChannel(t, testCapacity)
 
@@ -234,6 +314,73 @@ func TestSendDust(t *testing.T) {
 	}
 }
 
+func TestSegWitOutputs(t *testing.T) {
+	// P2WPKH for the sender and P2TR for the receiver.
+	const senderOutput = "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"
+	receiverOutput, err := address.EncodeSegWit("tb", 1, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, r := setUpChannelWithOutputs(t, testCapacity, senderOutput, receiverOutput)
+
+	// The receiver's dust threshold is lower than for P2PKH outputs.
+	if _, err := s.GetSendRequest(329, testPayment); err != ErrAmountTooSmall {
+		t.Errorf("Expected ErrAmountTooSmall, got %v", err)
+	}
+	sendReq, err := s.GetSendRequest(330, testPayment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendResp, err := r.Send(330, sendReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.GotSendResponse(330, testPayment, sendResp); err != nil {
+		t.Fatal(err)
+	}
+
+	closeChannels(t, s, r)
+}
+
+func TestCheckSupportedAddress(t *testing.T) {
+	net := &chaincfg.TestNet3Params
+	valid := []string{
+		addr1,
+		"2MzQwSSnBHWHqSAqtTVQ6v47XtaisrJa1Vc",
+		"tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		"tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k7",
+		"tb1pqqqqp399et2xygdj5xreqhjjvcmzhxw4aywxecjdzew6hylgvsesf3hn0c",
+	}
+	for _, a := range valid {
+		if err := checkSupportedAddress(net, a); err != nil {
+			t.Errorf("%s: unexpected error %v", a, err)
+		}
+	}
+
+	invalid := []string{
+		// Mainnet
+		"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4",
+		// Bad checksum
+		"tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsy",
+		// Witness version 2 isn't standard
+		mustEncodeSegWit(t, "tb", 2, bytes.Repeat([]byte{1}, 32)),
+	}
+	for _, a := range invalid {
+		if err := checkSupportedAddress(net, a); err != ErrInvalidAddress {
+			t.Errorf("%s: expected ErrInvalidAddress, got %v", a, err)
+		}
+	}
+}
+
+func mustEncodeSegWit(t *testing.T, hrp string, version byte, program []byte) string {
+	a, err := address.EncodeSegWit(hrp, version, program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
 // If the channel was funded with an amount too small for any payments, we can
 // at least still allow the sender to attempt to close it cleanly.
 func TestLowCapacity(t *testing.T) {
@@ -276,3 +423,22 @@ func TestValidateAmount(t *testing.T) {
 		t.Errorf("Expected ErrInsufficientCapacity, got: %v", err)
 	}
 }
+
+func TestSignMessage(t *testing.T) {
+	s, r := setUpChannel(t, testCapacity)
+
+	msg := RefreshMessage(s.State.FundingTxID, s.State.FundingVout, 1500000000)
+	sig, err := s.SignMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.State.VerifySenderMessage(msg, sig); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	other := RefreshMessage(s.State.FundingTxID, s.State.FundingVout, 1500000001)
+	if err := r.State.VerifySenderMessage(other, sig); err != ErrInvalidSignature {
+		t.Errorf("Expected ErrInvalidSignature, got: %v", err)
+	}
+}
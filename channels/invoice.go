@@ -0,0 +1,35 @@
+package channels
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec"
+
+	"github.com/luno/moonbeam/models"
+)
+
+// InvoiceMessage returns the message signed by the receiver's domain key to
+// issue an invoice.
+func InvoiceMessage(inv *models.Invoice) []byte {
+	return []byte(fmt.Sprintf("moonbeam invoice\n%s\n%s\n%d\n%d\n%s",
+		inv.ID, inv.Target, inv.Amount, inv.Expires, inv.Memo))
+}
+
+// SignInvoice signs the invoice with the domain's long-term key.
+func SignInvoice(inv *models.Invoice, key *btcec.PrivateKey) error {
+	hash := sha256.Sum256(InvoiceMessage(inv))
+	sig, err := key.Sign(hash[:])
+	if err != nil {
+		return err
+	}
+	inv.DomainPubKey = key.PubKey().SerializeCompressed()
+	inv.DomainSig = sig.Serialize()
+	return nil
+}
+
+// VerifyInvoice checks the invoice's signature. The caller must check that
+// DomainPubKey is the key of the receiver's domain.
+func VerifyInvoice(inv *models.Invoice) error {
+	return verifyMessage(inv.DomainPubKey, InvoiceMessage(inv), inv.DomainSig)
+}
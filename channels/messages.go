@@ -0,0 +1,83 @@
+package channels
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/luno/moonbeam/models"
+)
+
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// SignMessage signs the SHA-256 hash of msg with the sender's channel key.
+// It is used to authenticate RPCs with the channel key.
+func (s *Sender) SignMessage(msg []byte) ([]byte, error) {
+	hash := sha256.Sum256(msg)
+	sig, err := s.privKey.Sign(hash[:])
+	if err != nil {
+		return nil, err
+	}
+	return sig.Serialize(), nil
+}
+
+// VerifySenderMessage checks that sig is a signature for msg made by the
+// sender's channel key.
+func (ss *SharedState) VerifySenderMessage(msg, sig []byte) error {
+	return verifyMessage(ss.SenderPubKey, msg, sig)
+}
+
+// RefreshMessage returns the message the sender signs to request a new auth
+// token for the channel.
+func RefreshMessage(txid string, vout uint32, timestamp int64) []byte {
+	return []byte(fmt.Sprintf("moonbeam refresh\n%s-%d\n%d", txid, vout, timestamp))
+}
+
+// RequestMessage returns the message the sender signs to authenticate an RPC
+// with its channel key instead of an auth token. route is the path relative
+// to the endpoint URL, e.g. /send/<txid>-<vout>.
+func RequestMessage(method, route string, timestamp int64, nonce string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	return []byte(fmt.Sprintf("moonbeam request\n%s\n%s\n%d\n%s\n%s",
+		method, route, timestamp, nonce, hex.EncodeToString(bodyHash[:])))
+}
+
+// ReceiptMessage returns the message the receiver signs with its channel key
+// to acknowledge a payment. count, balance and paymentsHash are the channel
+// state after the payment.
+func ReceiptMessage(txid string, vout uint32, count int, balance int64, paymentsHash []byte, payment []byte) []byte {
+	h := sha256.Sum256(payment)
+	return []byte(fmt.Sprintf("moonbeam receipt\n%s-%d\n%d\n%d\n%s\n%s",
+		txid, vout, count, balance,
+		hex.EncodeToString(paymentsHash), hex.EncodeToString(h[:])))
+}
+
+func (r *Receiver) signReceipt(payment []byte) (*models.Receipt, error) {
+	s := r.State
+	rc := &models.Receipt{
+		TxID:         s.FundingTxID,
+		Vout:         s.FundingVout,
+		Count:        s.Count,
+		Balance:      s.Balance,
+		PaymentsHash: s.PaymentsHash[:],
+		Payment:      payment,
+	}
+
+	msg := ReceiptMessage(rc.TxID, rc.Vout, rc.Count, rc.Balance, rc.PaymentsHash, rc.Payment)
+	hash := sha256.Sum256(msg)
+	sig, err := r.privKey.Sign(hash[:])
+	if err != nil {
+		return nil, err
+	}
+	rc.ReceiverSig = sig.Serialize()
+	return rc, nil
+}
+
+// VerifyReceipt checks that the receipt was signed by the receiver's channel
+// key. It only needs the receiver's public key from the channel state, so it
+// can be done offline.
+func VerifyReceipt(receiverPubKey []byte, rc *models.Receipt) error {
+	msg := ReceiptMessage(rc.TxID, rc.Vout, rc.Count, rc.Balance, rc.PaymentsHash, rc.Payment)
+	return verifyMessage(receiverPubKey, msg, rc.ReceiverSig)
+}
@@ -0,0 +1,98 @@
+package channels
+
+import (
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcutil"
+
+	"github.com/luno/moonbeam/address"
+)
+
+type outputType int
+
+const (
+	outputUnknown outputType = iota
+	outputP2PKH
+	outputP2SH
+	outputP2WPKH
+	outputP2WSH
+	outputP2TR
+	outputNullData
+)
+
+// dustThresholds are the smallest output values relayed by bitcoind with the
+// default dust relay fee. P2SH is kept at the P2PKH threshold so that the
+// closure transactions of existing channels don't change.
+var dustThresholds = map[outputType]int64{
+	outputP2PKH:  dustThreshold,
+	outputP2SH:   dustThreshold,
+	outputP2WPKH: 294,
+	outputP2WSH:  330,
+	outputP2TR:   330,
+}
+
+// classifyOutput returns the type of a standard public key script.
+func classifyOutput(pkScript []byte) outputType {
+	n := len(pkScript)
+	switch {
+	case n == 25 && pkScript[0] == txscript.OP_DUP &&
+		pkScript[1] == txscript.OP_HASH160 && pkScript[2] == txscript.OP_DATA_20 &&
+		pkScript[23] == txscript.OP_EQUALVERIFY && pkScript[24] == txscript.OP_CHECKSIG:
+		return outputP2PKH
+	case n == 23 && pkScript[0] == txscript.OP_HASH160 &&
+		pkScript[1] == txscript.OP_DATA_20 && pkScript[22] == txscript.OP_EQUAL:
+		return outputP2SH
+	case n == 22 && pkScript[0] == txscript.OP_0 && pkScript[1] == txscript.OP_DATA_20:
+		return outputP2WPKH
+	case n == 34 && pkScript[0] == txscript.OP_0 && pkScript[1] == txscript.OP_DATA_32:
+		return outputP2WSH
+	case n == 34 && pkScript[0] == txscript.OP_1 && pkScript[1] == txscript.OP_DATA_32:
+		return outputP2TR
+	case txscript.GetScriptClass(pkScript) == txscript.NullDataTy:
+		return outputNullData
+	}
+	return outputUnknown
+}
+
+// outputScript returns the public key script paying to addr. Only P2PKH,
+// P2SH, P2WPKH, P2WSH and P2TR addresses are supported.
+func outputScript(net *chaincfg.Params, addr string) ([]byte, error) {
+	var pkScript []byte
+
+	if hrp, version, program, err := address.DecodeSegWit(addr); err == nil {
+		if hrp != net.Bech32HRPSegwit {
+			return nil, ErrInvalidAddress
+		}
+		op := byte(txscript.OP_0)
+		if version > 0 {
+			op = txscript.OP_1 + version - 1
+		}
+		pkScript, err = txscript.NewScriptBuilder().AddOp(op).AddData(program).Script()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		a, err := btcutil.DecodeAddress(addr, net)
+		if err != nil || !a.IsForNet(net) {
+			return nil, ErrInvalidAddress
+		}
+		pkScript, err = txscript.PayToAddrScript(a)
+		if err != nil {
+			return nil, ErrInvalidAddress
+		}
+	}
+
+	if _, ok := dustThresholds[classifyOutput(pkScript)]; !ok {
+		return nil, ErrInvalidAddress
+	}
+	return pkScript, nil
+}
+
+// outputDust returns the smallest amount that can be paid to addr.
+func outputDust(net *chaincfg.Params, addr string) (int64, error) {
+	pkScript, err := outputScript(net, addr)
+	if err != nil {
+		return 0, err
+	}
+	return dustThresholds[classifyOutput(pkScript)], nil
+}
@@ -219,20 +219,30 @@ func (r *Receiver) Open(txout *wire.TxOut, req *models.OpenRequest) (*models.Ope
 	return &models.OpenResponse{}, nil
 }
 
-func (r *Receiver) Validate(amount int64, payment []byte) (bool, error) {
+// CheckPayment returns the reason the payment would be rejected, or nil if
+// it would be accepted.
+func (r *Receiver) CheckPayment(amount int64, payment []byte) error {
 	if r.State.Status != StatusOpen {
-		return false, ErrNotStatusOpen
+		return ErrNotStatusOpen
 	}
 
 	if _, err := r.State.validateAmount(amount); err != nil {
-		return false, nil
+		return err
 	}
 
 	if !validatePaymentSize(len(payment)) {
-		return false, nil
+		return ErrInvalidPaymentSize
 	}
 
-	return true, nil
+	return nil
+}
+
+func (r *Receiver) Validate(amount int64, payment []byte) (bool, error) {
+	err := r.CheckPayment(amount, payment)
+	if err == ErrNotStatusOpen {
+		return false, err
+	}
+	return err == nil, nil
 }
 
 func (r *Receiver) Send(amount int64, req *models.SendRequest) (*models.SendResponse, error) {
@@ -255,14 +265,19 @@ func (r *Receiver) Send(amount int64, req *models.SendRequest) (*models.SendResp
 	newHash := chainHash(r.State.PaymentsHash, req.Payment)
 
 	if err := r.validateSenderSig(newBalance, newHash, req.SenderSig); err != nil {
-		return nil, err
+		return nil, ErrInvalidSignature
 	}
 
 	r.State.Count++
 	r.State.Balance = newBalance
 	r.State.PaymentsHash = newHash
 	r.State.SenderSig = req.SenderSig
-	return &models.SendResponse{}, nil
+
+	receipt, err := r.signReceipt(req.Payment)
+	if err != nil {
+		return nil, err
+	}
+	return &models.SendResponse{Receipt: receipt}, nil
 }
 
 func (r *Receiver) Close(req *models.CloseRequest) (*models.CloseResponse, error) {
@@ -13,6 +13,7 @@ import (
 	"github.com/btcsuite/btcutil"
 )
 
+// dustThreshold is the largest dust threshold of the supported outputs.
 const dustThreshold = 546
 
 const (
@@ -86,12 +87,7 @@ func (s *SharedState) spendFundingTx() (*wire.MsgTx, error) {
 }
 
 func sendToAddress(net *chaincfg.Params, amount int64, addr string) (*wire.TxOut, error) {
-	address, err := btcutil.DecodeAddress(addr, net)
-	if err != nil {
-		return nil, err
-	}
-
-	pkscript, err := txscript.PayToAddrScript(address)
+	pkscript, err := outputScript(net, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -135,7 +131,16 @@ func (s *SharedState) GetClosureTx(balance int64, hash [32]byte) (*wire.MsgTx, e
 	}
 	tx.AddTxOut(dataout)
 
-	if receiveAmount >= dustThreshold {
+	receiverDust, err := outputDust(net, s.ReceiverOutput)
+	if err != nil {
+		return nil, err
+	}
+	senderDust, err := outputDust(net, s.SenderOutput)
+	if err != nil {
+		return nil, err
+	}
+
+	if receiveAmount >= receiverDust {
 		txout, err := sendToAddress(net, receiveAmount, s.ReceiverOutput)
 		if err != nil {
 			return nil, err
@@ -143,7 +148,7 @@ func (s *SharedState) GetClosureTx(balance int64, hash [32]byte) (*wire.MsgTx, e
 		tx.AddTxOut(txout)
 	}
 
-	if senderAmount >= dustThreshold {
+	if senderAmount >= senderDust {
 		txout, err := sendToAddress(net, senderAmount, s.SenderOutput)
 		if err != nil {
 			return nil, err
@@ -306,15 +311,16 @@ func (s *SharedState) validateTx(rawTx []byte) error {
 		return errors.New("tx too big")
 	}
 	for _, txout := range tx.TxOut {
-		sc := txscript.GetScriptClass(txout.PkScript)
-		if sc != txscript.PubKeyHashTy && sc != txscript.ScriptHashTy && sc != txscript.NullDataTy {
+		t := classifyOutput(txout.PkScript)
+		if t == outputNullData {
+			continue
+		}
+		dust, ok := dustThresholds[t]
+		if !ok {
 			return errors.New("unsupported tx out script class")
 		}
-
-		if sc != txscript.NullDataTy {
-			if txout.Value < dustThreshold {
-				return errors.New("dust output")
-			}
+		if txout.Value < dust {
+			return errors.New("dust output")
 		}
 	}
 
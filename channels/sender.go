@@ -233,6 +233,11 @@ func (s *Sender) GotOpenResponse(resp *models.OpenResponse) error {
 	if s.State.FundingTxID == "" {
 		return errors.New("fundingTxID is missing")
 	}
+	if resp.Certificate != nil {
+		if err := s.checkCertificate(resp.Certificate); err != nil {
+			return err
+		}
+	}
 	s.State.Status = StatusOpen
 	return nil
 }
@@ -273,6 +278,12 @@ func (s *Sender) GotSendResponse(amount int64, payment []byte, resp *models.Send
 
 	newHash := chainHash(s.State.PaymentsHash, payment)
 
+	if resp != nil && resp.Receipt != nil {
+		if err := s.checkReceipt(resp.Receipt, amount, newHash, payment); err != nil {
+			return err
+		}
+	}
+
 	s.State.Count++
 	s.State.Balance += amount
 	s.State.PaymentsHash = newHash
@@ -280,6 +291,16 @@ func (s *Sender) GotSendResponse(amount int64, payment []byte, resp *models.Send
 	return nil
 }
 
+// checkReceipt verifies that the receipt acknowledges the payment.
+func (s *Sender) checkReceipt(rc *models.Receipt, amount int64, newHash [32]byte, payment []byte) error {
+	if rc.TxID != s.State.FundingTxID || rc.Vout != s.State.FundingVout ||
+		rc.Count != s.State.Count+1 || rc.Balance != s.State.Balance+amount ||
+		!bytes.Equal(rc.PaymentsHash, newHash[:]) || !bytes.Equal(rc.Payment, payment) {
+		return errors.New("receipt does not match payment")
+	}
+	return VerifyReceipt(s.State.ReceiverPubKey, rc)
+}
+
 func (s *Sender) GetCloseRequest() (*models.CloseRequest, error) {
 	if s.State.Status != StatusOpen && s.State.Status != StatusClosing {
 		return nil, ErrNotStatusOpen
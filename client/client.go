@@ -2,86 +2,265 @@ package client
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/luno/moonbeam/channels"
+	"github.com/luno/moonbeam/logging"
 	"github.com/luno/moonbeam/models"
 )
 
-var debugRPC = flag.Bool("debug_rpc", true, "Debug RPC")
+// Signer signs requests with the sender's channel key. channels.Sender
+// implements it.
+type Signer interface {
+	SignMessage(msg []byte) ([]byte, error)
+}
 
 type Client struct {
-	endpoint string
-	c        *http.Client
+	// Signer, if set, is used to sign requests after Open instead of
+	// sending the auth token.
+	Signer Signer
+
+	// Logger receives request and response bodies at the debug level with
+	// auth tokens and signatures redacted.
+	Logger logging.Logger
+
+	// Cooldown is how long an endpoint that failed is tried only after the
+	// others.
+	Cooldown time.Duration
+
+	mu        sync.Mutex
+	endpoints []endpoint
+	c         *http.Client
+}
+
+type endpoint struct {
+	url      string
+	failedAt time.Time
 }
 
 func NewClient(c *http.Client, endpoint string) (*Client, error) {
-	if strings.HasSuffix(endpoint, "/") {
-		return nil, errors.New("endpoint must not have a trailing slash")
+	return NewMultiClient(c, []string{endpoint})
+}
+
+// NewMultiClient returns a client for a receiver served by several
+// endpoints, in order of preference. Calls go to the first healthy endpoint.
+// Status and Validate fail over to the other endpoints if it is unavailable
+// and Send is retried once on the next endpoint.
+func NewMultiClient(c *http.Client, endpoints []string) (*Client, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("no endpoints")
+	}
+
+	var eps []endpoint
+	for _, e := range endpoints {
+		if strings.HasSuffix(e, "/") {
+			return nil, errors.New("endpoint must not have a trailing slash")
+		}
+		eps = append(eps, endpoint{url: e})
 	}
 
 	return &Client{
-		endpoint: endpoint,
-		c:        c,
+		Logger:    logging.NewStdLogger(logging.Info),
+		Cooldown:  time.Minute,
+		endpoints: eps,
+		c:         c,
 	}, nil
 }
 
-func (c *Client) do(method, path string, authToken string, req, resp interface{}) error {
-	url := c.endpoint + path
+// order returns the endpoint URLs with the ones that failed recently moved
+// to the end.
+func (c *Client) order() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var healthy, failed []string
+	for _, e := range c.endpoints {
+		if !e.failedAt.IsZero() && time.Since(e.failedAt) < c.Cooldown {
+			failed = append(failed, e.url)
+		} else {
+			healthy = append(healthy, e.url)
+		}
+	}
+	return append(healthy, failed...)
+}
+
+func (c *Client) mark(url string, failed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range c.endpoints {
+		if c.endpoints[i].url != url {
+			continue
+		}
+		if failed {
+			c.endpoints[i].failedAt = time.Now()
+		} else {
+			c.endpoints[i].failedAt = time.Time{}
+		}
+	}
+}
+
+func newNonce() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// authorize authenticates a request for a channel, either by signing it or
+// with the auth token.
+func (c *Client) authorize(hreq *http.Request, path string, body []byte, authToken string) error {
+	if c.Signer == nil {
+		hreq.Header.Add("Authorization", "Bearer "+authToken)
+		return nil
+	}
+
+	ts := time.Now().Unix()
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	msg := channels.RequestMessage(hreq.Method, path, ts, nonce, body)
+	sig, err := c.Signer.SignMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	hreq.Header.Add("Authorization",
+		models.SigAuthScheme+" "+base64.StdEncoding.EncodeToString(sig))
+	hreq.Header.Add(models.TimestampHeader, strconv.FormatInt(ts, 10))
+	hreq.Header.Add(models.NonceHeader, nonce)
+	return nil
+}
+
+// unavailable reports whether a response status means that the endpoint
+// rather than the request failed.
+func unavailable(status int) bool {
+	return status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable ||
+		status == http.StatusGatewayTimeout
+}
 
+// do performs the RPC. Requests for existing channels are authenticated if
+// auth is set. The request is sent to up to attempts endpoints until one of
+// them is available.
+func (c *Client) do(method, path string, auth bool, authToken string, req, resp interface{}, attempts int) error {
 	buf, err := json.Marshal(req)
 	if err != nil {
 		return err
 	}
 
-	if *debugRPC {
-		log.Printf("moonchan/client: %s %s\n%s\n", method, url, string(buf))
+	urls := c.order()
+	if attempts > len(urls) {
+		attempts = len(urls)
 	}
 
-	hreq, err := http.NewRequest(method, url, bytes.NewReader(buf))
+	for i := 0; ; i++ {
+		failed, err := c.doOnce(urls[i], method, path, auth, authToken, buf, resp)
+		c.mark(urls[i], failed)
+		if !failed || i+1 >= attempts {
+			return err
+		}
+
+		c.Logger.Log(logging.Warn, "endpoint unavailable, failing over", logging.Fields{
+			"endpoint": urls[i],
+			"next":     urls[i+1],
+			"route":    path,
+			"error":    err,
+		})
+	}
+}
+
+// doOnce performs the RPC on the endpoint. It reports whether the endpoint
+// couldn't be reached or reported that it is unavailable.
+func (c *Client) doOnce(endpoint, method, path string, auth bool, authToken string, buf []byte, resp interface{}) (bool, error) {
+	c.Logger.Log(logging.Debug, "rpc request", logging.Fields{
+		"endpoint": endpoint,
+		"method":   method,
+		"route":    path,
+		"body":     logging.RedactJSON(buf),
+	})
+
+	hreq, err := http.NewRequest(method, endpoint+path, bytes.NewReader(buf))
 	if err != nil {
-		return err
+		return false, err
 	}
-	if authToken != "" {
-		hreq.Header.Add("Authorization", "Bearer "+authToken)
+	if auth {
+		if err := c.authorize(hreq, path, buf, authToken); err != nil {
+			return false, err
+		}
 	}
 
 	hresp, err := c.c.Do(hreq)
 	if err != nil {
-		return err
+		return true, err
 	}
 	defer hresp.Body.Close()
 
 	respBuf, err := ioutil.ReadAll(hresp.Body)
 	if err != nil {
-		return err
+		return true, err
 	}
 
-	if *debugRPC {
-		log.Printf("moonchan/client: %s %s\n%s\n%s\n",
-			method, url, hresp.Status, string(respBuf))
-	}
+	c.Logger.Log(logging.Debug, "rpc response", logging.Fields{
+		"endpoint": endpoint,
+		"method":   method,
+		"route":    path,
+		"status":   hresp.StatusCode,
+		"body":     logging.RedactJSON(respBuf),
+	})
 
 	if hresp.StatusCode != http.StatusOK {
+		var me models.Error
+		if err := json.Unmarshal(respBuf, &me); err == nil && me.Code != "" {
+			return unavailable(hresp.StatusCode), &me
+		}
+
 		if len(respBuf) > 256 {
 			respBuf = respBuf[:256]
 		}
-		return fmt.Errorf("moonchan/client: http error code %d: %s",
+		return unavailable(hresp.StatusCode), fmt.Errorf("moonchan/client: http error code %d: %s",
 			hresp.StatusCode, string(respBuf))
 	}
 
-	return json.Unmarshal(respBuf, resp)
+	return false, json.Unmarshal(respBuf, resp)
+}
+
+// ErrorCode returns the code of an error returned by the server, or an empty
+// code if err didn't come from the server.
+func ErrorCode(err error) models.ErrorCode {
+	if me, ok := err.(*models.Error); ok {
+		return me.Code
+	}
+	return ""
 }
 
 func (c *Client) Create(req models.CreateRequest) (*models.CreateResponse, error) {
 	var resp models.CreateResponse
-	if err := c.do(http.MethodPost, "/create", "", req, &resp); err != nil {
+	if err := c.do(http.MethodPost, "/create", false, "", req, &resp, 1); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Invoice fetches a signed invoice issued by the receiver.
+func (c *Client) Invoice(req models.InvoiceRequest) (*models.Invoice, error) {
+	path := "/invoice/" + url.PathEscape(req.ID)
+	var resp models.Invoice
+	if err := c.do(http.MethodGet, path, false, "", req, &resp, len(c.endpoints)); err != nil {
 		return nil, err
 	}
 	return &resp, nil
@@ -94,7 +273,7 @@ func getChannelID(txid string, vout uint32) string {
 func (c *Client) Open(req models.OpenRequest) (*models.OpenResponse, error) {
 	path := "/open/" + getChannelID(req.TxID, req.Vout)
 	var resp models.OpenResponse
-	if err := c.do(http.MethodPut, path, "", req, &resp); err != nil {
+	if err := c.do(http.MethodPut, path, false, "", req, &resp, 1); err != nil {
 		return nil, err
 	}
 	return &resp, nil
@@ -103,16 +282,23 @@ func (c *Client) Open(req models.OpenRequest) (*models.OpenResponse, error) {
 func (c *Client) Validate(req models.ValidateRequest, authToken string) (*models.ValidateResponse, error) {
 	path := "/validate/" + getChannelID(req.TxID, req.Vout)
 	var resp models.ValidateResponse
-	if err := c.do(http.MethodPut, path, authToken, req, &resp); err != nil {
+	if err := c.do(http.MethodPut, path, true, authToken, req, &resp, len(c.endpoints)); err != nil {
 		return nil, err
 	}
 	return &resp, nil
 }
 
+// sendAttempts is the number of endpoints a payment is sent to. A payment
+// can't be applied twice since the sender's signature commits to the new
+// balance, so retrying it on another endpoint is safe. If the first attempt
+// did reach the receiver, the retry fails with ErrCodeInvalidSignature and
+// the sender should check the channel status.
+const sendAttempts = 2
+
 func (c *Client) Send(req models.SendRequest, authToken string) (*models.SendResponse, error) {
 	path := "/send/" + getChannelID(req.TxID, req.Vout)
 	var resp models.SendResponse
-	if err := c.do(http.MethodPost, path, authToken, req, &resp); err != nil {
+	if err := c.do(http.MethodPost, path, true, authToken, req, &resp, sendAttempts); err != nil {
 		return nil, err
 	}
 	return &resp, nil
@@ -121,7 +307,16 @@ func (c *Client) Send(req models.SendRequest, authToken string) (*models.SendRes
 func (c *Client) Close(req models.CloseRequest, authToken string) (*models.CloseResponse, error) {
 	path := "/close/" + getChannelID(req.TxID, req.Vout)
 	var resp models.CloseResponse
-	if err := c.do(http.MethodDelete, path, authToken, req, &resp); err != nil {
+	if err := c.do(http.MethodDelete, path, true, authToken, req, &resp, 1); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) Refresh(req models.RefreshRequest) (*models.RefreshResponse, error) {
+	path := "/refresh/" + getChannelID(req.TxID, req.Vout)
+	var resp models.RefreshResponse
+	if err := c.do(http.MethodPost, path, false, "", req, &resp, 1); err != nil {
 		return nil, err
 	}
 	return &resp, nil
@@ -130,7 +325,7 @@ func (c *Client) Close(req models.CloseRequest, authToken string) (*models.Close
 func (c *Client) Status(req models.StatusRequest, authToken string) (*models.StatusResponse, error) {
 	path := "/status/" + getChannelID(req.TxID, req.Vout)
 	var resp models.StatusResponse
-	if err := c.do(http.MethodGet, path, authToken, req, &resp); err != nil {
+	if err := c.do(http.MethodGet, path, true, authToken, req, &resp, len(c.endpoints)); err != nil {
 		return nil, err
 	}
 	return &resp, nil
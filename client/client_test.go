@@ -0,0 +1,200 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/luno/moonbeam/models"
+)
+
+const testTxID = "8ac37b4fb0ddc50e3a1b3a5b8fac35c9b4f5fea4bc9ccb6b3ac1b7ae6d4c6d3b"
+
+// testEndpoint is a receiver endpoint that responds with status and counts
+// the requests it gets.
+type testEndpoint struct {
+	mu     sync.Mutex
+	status int
+	hits   int
+}
+
+func (e *testEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.hits++
+
+	switch {
+	case e.status == http.StatusOK:
+		json.NewEncoder(w).Encode(models.StatusResponse{Balance: 1000})
+	case e.status < 500:
+		w.WriteHeader(e.status)
+		json.NewEncoder(w).Encode(models.Error{
+			Code:    models.ErrCodeChannelNotFound,
+			Message: "channel not found",
+		})
+	default:
+		http.Error(w, "unavailable", e.status)
+	}
+}
+
+func (e *testEndpoint) set(status int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.status = status
+	e.hits = 0
+}
+
+func (e *testEndpoint) count() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.hits
+}
+
+func newTestClient(t *testing.T, n int) (*Client, []*testEndpoint, func()) {
+	var eps []*testEndpoint
+	var urls []string
+	var srvs []*httptest.Server
+	for i := 0; i < n; i++ {
+		e := &testEndpoint{status: http.StatusOK}
+		srv := httptest.NewServer(e)
+		eps = append(eps, e)
+		urls = append(urls, srv.URL)
+		srvs = append(srvs, srv)
+	}
+
+	c, err := NewMultiClient(http.DefaultClient, urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, eps, func() {
+		for _, srv := range srvs {
+			srv.Close()
+		}
+	}
+}
+
+func expectHits(t *testing.T, name string, eps []*testEndpoint, hits ...int) {
+	for i, e := range eps {
+		if n := e.count(); n != hits[i] {
+			t.Errorf("%s: expected %d hits on endpoint %d, got %d", name, hits[i], i, n)
+		}
+	}
+}
+
+func status(c *Client) error {
+	_, err := c.Status(models.StatusRequest{TxID: testTxID}, "token")
+	return err
+}
+
+func TestFailover(t *testing.T) {
+	for _, code := range []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout} {
+		c, eps, cleanup := newTestClient(t, 2)
+
+		eps[0].set(code)
+		if err := status(c); err != nil {
+			t.Errorf("%d: unexpected error %v", code, err)
+		}
+		expectHits(t, "failover", eps, 1, 1)
+
+		// The failed endpoint is tried last during the cooldown.
+		eps[0].set(http.StatusOK)
+		eps[1].set(http.StatusOK)
+		if err := status(c); err != nil {
+			t.Fatal(err)
+		}
+		expectHits(t, "cooldown", eps, 0, 1)
+
+		// After the cooldown the preferred endpoint is used again.
+		c.Cooldown = 0
+		eps[1].set(http.StatusOK)
+		if err := status(c); err != nil {
+			t.Fatal(err)
+		}
+		expectHits(t, "after cooldown", eps, 1, 0)
+
+		cleanup()
+	}
+}
+
+func TestFailoverTransportError(t *testing.T) {
+	c, eps, cleanup := newTestClient(t, 2)
+	defer cleanup()
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	c.endpoints[0].url = down.URL
+
+	if err := status(c); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	expectHits(t, "transport error", eps, 0, 1)
+}
+
+func TestNoFailoverOnClientError(t *testing.T) {
+	c, eps, cleanup := newTestClient(t, 2)
+	defer cleanup()
+
+	eps[0].set(http.StatusNotFound)
+	err := status(c)
+	if ErrorCode(err) != models.ErrCodeChannelNotFound {
+		t.Errorf("Expected ErrCodeChannelNotFound, got %v", err)
+	}
+	expectHits(t, "client error", eps, 1, 0)
+
+	// The endpoint isn't considered unavailable.
+	eps[0].set(http.StatusOK)
+	if err := status(c); err != nil {
+		t.Fatal(err)
+	}
+	expectHits(t, "after client error", eps, 1, 0)
+}
+
+func TestFailoverAttempts(t *testing.T) {
+	c, eps, cleanup := newTestClient(t, 3)
+	defer cleanup()
+
+	for _, e := range eps {
+		e.set(http.StatusServiceUnavailable)
+	}
+	if err := status(c); err == nil {
+		t.Errorf("Expected error when all endpoints are unavailable")
+	}
+	expectHits(t, "status", eps, 1, 1, 1)
+
+	// All endpoints failed so their order is kept.
+	for _, e := range eps {
+		e.set(http.StatusServiceUnavailable)
+	}
+	_, err := c.Send(models.SendRequest{TxID: testTxID}, "token")
+	if err == nil {
+		t.Errorf("Expected error when all endpoints are unavailable")
+	}
+	expectHits(t, "send", eps, 1, 1, 0)
+
+	for _, e := range eps {
+		e.set(http.StatusServiceUnavailable)
+	}
+	if _, err := c.Create(models.CreateRequest{}); err == nil {
+		t.Errorf("Expected error when all endpoints are unavailable")
+	}
+	expectHits(t, "create", eps, 1, 0, 0)
+}
+
+func TestNewMultiClient(t *testing.T) {
+	if _, err := NewMultiClient(http.DefaultClient, nil); err == nil {
+		t.Errorf("Expected error for no endpoints")
+	}
+	if _, err := NewMultiClient(http.DefaultClient, []string{"https://example.com/moonbeamrpc/"}); err == nil {
+		t.Errorf("Expected error for trailing slash")
+	}
+	c, err := NewMultiClient(http.DefaultClient, []string{"https://a.example.com", "https://b.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Cooldown != time.Minute {
+		t.Errorf("Unexpected default cooldown: %v", c.Cooldown)
+	}
+}
@@ -11,6 +11,8 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/btcsuite/btcd/btcec"
 	"github.com/btcsuite/btcd/chaincfg"
@@ -20,12 +22,21 @@ import (
 	"github.com/luno/moonbeam/address"
 	"github.com/luno/moonbeam/channels"
 	"github.com/luno/moonbeam/client"
+	"github.com/luno/moonbeam/logging"
 	"github.com/luno/moonbeam/models"
 	"github.com/luno/moonbeam/resolver"
 )
 
 var testnet = flag.Bool("testnet", true, "Use testnet")
 var tlsSkipVerify = flag.Bool("tls_skip_verify", false, "Whether to validate the server's TLS cert")
+var insecure = flag.Bool("insecure", false, "Allow http receiver URLs, for testing only")
+var resolverCacheDir = flag.String("resolver_cache_dir", "", "Directory to cache resolved domains in")
+var requireSignedDomains = flag.Bool("require_signed_domains", false, "Reject moonbeam.json documents without a domain key signature")
+var requireTargetSig = flag.Bool("require_target_sig", false, "Only send payments whose target ownership is proven by the receiver")
+var signRequests = flag.Bool("sign_requests", false, "Sign requests with the channel key instead of using the auth token")
+var logLevel = flag.String("log_level", "info", "Minimum level to log: debug, info, warn or error")
+
+var logger logging.Logger = logging.Discard
 
 func getNet() *chaincfg.Params {
 	if *testnet {
@@ -78,14 +89,34 @@ func getHttpClient() *http.Client {
 }
 
 func getClient(id string) (*client.Client, error) {
-	host := globalState.Channels[id].Host
-	c := getHttpClient()
-	return client.NewClient(c, host)
+	hosts := globalState.Channels[id].endpoints()
+	c, err := client.NewMultiClient(getHttpClient(), hosts)
+	if err != nil {
+		return nil, err
+	}
+	c.Logger = logger
+
+	if *signRequests {
+		_, sender, err := getChannel(id)
+		if err != nil {
+			return nil, err
+		}
+		c.Signer = sender
+	}
+
+	return c, nil
 }
 
 func getResolver() *resolver.Resolver {
 	r := resolver.NewResolver()
 	r.Client = getHttpClient()
+	r.Logger = logger
+	r.Insecure = *insecure
+	r.Keys = globalState
+	r.RequireSignature = *requireSignedDomains
+	if *resolverCacheDir != "" {
+		r.Cache = resolver.NewDirCache(*resolverCacheDir)
+	}
 
 	if *testnet {
 		r.DefaultPort = 3211
@@ -94,16 +125,36 @@ func getResolver() *resolver.Resolver {
 	return r
 }
 
+// receiverDomain returns the domain of the receiver given to create. It may
+// also be an endpoint URL, which is used as is.
+func receiverDomain(arg string) (string, error) {
+	if strings.Contains(arg, "://") {
+		return arg, nil
+	}
+	return address.NormalizeDomain(arg)
+}
+
 func create(args []string) error {
-	domain := args[0]
+	domain, err := receiverDomain(args[0])
+	if err != nil {
+		return err
+	}
 	outputAddr := args[1]
 
 	r := getResolver()
-	hostURL, err := r.Resolve(domain)
-	if err != nil {
+	hostURLs, err := r.ResolveAll(domain)
+	if err == resolver.ErrKeyChanged || err == resolver.ErrUnsigned {
+		return fmt.Errorf("%v: the domain may have been hijacked, "+
+			"run unpin %s only if you trust its new key", err, domain)
+	} else if err == resolver.ErrReplayed {
+		return fmt.Errorf("%v: the domain may have been hijacked", err)
+	} else if err != nil {
 		return err
 	}
-	host := hostURL.String()
+	var hosts []string
+	for _, u := range hostURLs {
+		hosts = append(hosts, u.String())
+	}
 
 	n := globalState.NextKey()
 	privkey, _, err := loadkey(globalState, n)
@@ -122,10 +173,11 @@ func create(args []string) error {
 	}
 
 	httpClient := getHttpClient()
-	c, err := client.NewClient(httpClient, host)
+	c, err := client.NewMultiClient(httpClient, hosts)
 	if err != nil {
 		return err
 	}
+	c.Logger = logger
 	resp, err := c.Create(*req)
 	if err != nil {
 		return err
@@ -153,7 +205,8 @@ func create(args []string) error {
 	id := strconv.Itoa(n)
 	globalState.Channels[id] = Channel{
 		Domain:       domain,
-		Host:         host,
+		Host:         hosts[0],
+		Hosts:        hosts,
 		State:        s.State,
 		KeyPath:      n,
 		ReceiverData: resp.ReceiverData,
@@ -199,6 +252,14 @@ func fund(args []string) error {
 	if err := sender.GotOpenResponse(resp); err != nil {
 		return err
 	}
+	if resp.Certificate != nil {
+		if err := checkCertificateDomain(ch.Domain, resp.Certificate); err != nil {
+			return err
+		}
+		if err := storeCertificate(id, resp.Certificate); err != nil {
+			return err
+		}
+	}
 
 	if err := storeAuthToken(id, resp.AuthToken); err != nil {
 		return err
@@ -206,23 +267,114 @@ func fund(args []string) error {
 	return storeChannel(id, sender.State)
 }
 
+// checkCertificateDomain checks that the channel certificate was issued for
+// the domain and, if it is signed with a domain key, that the key is the one
+// pinned for the domain. GotOpenResponse has already verified the signatures.
+func checkCertificateDomain(domain string, cert *models.ChannelCertificate) error {
+	if strings.Contains(domain, "://") {
+		// The channel was created with an endpoint URL rather than a
+		// domain.
+		return nil
+	}
+	domain = strings.ToLower(domain)
+	if cert.Domain != domain {
+		return errors.New("certificate is for a different domain")
+	}
+	if cert.DomainSig == nil {
+		return nil
+	}
+	if pinned, ok := globalState.PinnedKey(domain); ok && !bytes.Equal(pinned, cert.DomainPubKey) {
+		return errors.New("certificate is not signed by the pinned domain key")
+	}
+	return nil
+}
+
+// checkInvoice checks that the invoice requested by the URI was signed by
+// the receiver's domain and matches the payment.
+func checkInvoice(u *address.URI, inv *models.Invoice) error {
+	if err := channels.VerifyInvoice(inv); err != nil {
+		return err
+	}
+	pinned, ok := globalState.PinnedKey(u.Address.Domain)
+	if ok && !bytes.Equal(pinned, inv.DomainPubKey) {
+		return errors.New("invoice is not signed by the pinned domain key")
+	}
+	if !ok && *requireSignedDomains {
+		return errors.New("no domain key pinned to check the invoice")
+	}
+
+	if inv.ID != u.Invoice || inv.Target != u.Address.String() {
+		return errors.New("invoice doesn't match the payment request")
+	}
+	if inv.Amount != u.Amount {
+		return errors.New("amount doesn't match invoice")
+	}
+	if time.Now().Unix() >= inv.Expires {
+		return errors.New("invoice has expired")
+	}
+	return nil
+}
+
+// parseTarget parses the target of send, which is either an address
+// followed by an amount or a moonbeam URI, optionally followed by an amount if
+// the URI doesn't specify one. It returns the remaining arguments.
+func parseTarget(args []string) (*address.URI, []string, error) {
+	if len(args) == 0 {
+		return nil, nil, errors.New("missing address")
+	}
+
+	var u *address.URI
+	if address.IsURI(args[0]) {
+		var err error
+		u, err = address.ParseURI(args[0], getNet())
+		if err != nil {
+			return nil, nil, err
+		}
+		if u.Expired(time.Now()) {
+			return nil, nil, errors.New("payment request has expired")
+		}
+	} else {
+		a, err := address.Parse(args[0], getNet())
+		if err != nil {
+			return nil, nil, err
+		}
+		u = &address.URI{Address: a}
+	}
+	args = args[1:]
+
+	if u.Amount == 0 {
+		if len(args) == 0 {
+			return nil, nil, errors.New("missing amount")
+		}
+		amount, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil || amount <= 0 {
+			return nil, nil, errors.New("invalid amount")
+		}
+		u.Amount = amount
+		args = args[1:]
+	}
+
+	return u, args, nil
+}
+
 func send(args []string) error {
-	target := args[0]
-	amount, err := strconv.ParseInt(args[1], 10, 64)
+	u, args, err := parseTarget(args)
 	if err != nil {
-		return errors.New("invalid amount")
+		return err
 	}
+	a := u.Address
+	target := a.String()
+	amount := u.Amount
 	id := ""
-	if len(args) > 2 {
-		id = args[2]
+	if len(args) > 0 {
+		id = args[0]
+	}
+	if u.Memo != "" {
+		fmt.Printf("Paying %d Satoshi to %s for %s\n", amount, target, u.Memo)
 	}
 
 	if id == "" {
-		_, domain, valid := address.Decode(target)
-		if !valid {
-			return errors.New("invalid address")
-		}
-		ids := findForDomain(domain)
+		ids := findForDomain(a.Domain)
 		if len(ids) == 0 {
 			return errors.New("no open channels to domain")
 		}
@@ -230,8 +382,9 @@ func send(args []string) error {
 	}
 
 	p := models.Payment{
-		Amount: amount,
-		Target: target,
+		Amount:  amount,
+		Target:  target,
+		Invoice: u.Invoice,
 	}
 	payment, err := json.Marshal(p)
 	if err != nil {
@@ -255,6 +408,15 @@ func send(args []string) error {
 	if err != nil {
 		return err
 	}
+	if u.Invoice != "" {
+		inv, err := c.Invoice(models.InvoiceRequest{ID: u.Invoice})
+		if err != nil {
+			return err
+		}
+		if err := checkInvoice(u, inv); err != nil {
+			return err
+		}
+	}
 	req := models.ValidateRequest{
 		TxID:    ch.State.FundingTxID,
 		Vout:    ch.State.FundingVout,
@@ -265,8 +427,19 @@ func send(args []string) error {
 		return err
 	}
 	if !resp.Valid {
+		if resp.Reason != "" {
+			return errors.New("payment rejected by server: " + resp.Reason)
+		}
 		return errors.New("payment rejected by server")
 	}
+	if resp.TargetSig != nil {
+		msg := address.TargetMessage(req.TxID, req.Vout, payment)
+		if err := address.VerifyTarget(target, msg, resp.TargetSig); err != nil {
+			return err
+		}
+	} else if *requireTargetSig {
+		return errors.New("server did not prove ownership of the target")
+	}
 
 	if err := storePendingPayment(id, sender.State, payment); err != nil {
 		return err
@@ -320,14 +493,28 @@ func flush(id string) error {
 	if serverBal == sender.State.Balance {
 		// Pending payment doesn't reflect yet. We have to retry.
 
-		if _, err := c.Send(*sendReq, ch.AuthToken); err != nil {
+		sendResp, err := c.Send(*sendReq, ch.AuthToken)
+		if err != nil {
+			switch client.ErrorCode(err) {
+			case models.ErrCodeChannelBusy, models.ErrCodeConcurrentUpdate:
+				return errors.New("channel is busy, run flush again to retry")
+			case models.ErrCodeInvalidSignature:
+				// The send may have been retried on another endpoint
+				// after the first one received it.
+				return errors.New("payment rejected, run flush again to check whether it was received")
+			}
 			return err
 		}
 
-		if err := sender.GotSendResponse(p.Amount, payment, nil); err != nil {
+		if err := sender.GotSendResponse(p.Amount, payment, sendResp); err != nil {
 			return err
 		}
 
+		if sendResp.Receipt != nil {
+			if err := storeReceipt(id, *sendResp.Receipt); err != nil {
+				return err
+			}
+		}
 		return storePendingPayment(id, sender.State, nil)
 
 	} else if serverBal == sender.State.Balance+p.Amount {
@@ -379,6 +566,59 @@ func closeAction(args []string) error {
 	return storeChannel(id, sender.State)
 }
 
+func refresh(args []string) error {
+	id := args[0]
+
+	ch, sender, err := getChannel(id)
+	if err != nil {
+		return err
+	}
+
+	ts := time.Now().Unix()
+	msg := channels.RefreshMessage(ch.State.FundingTxID, ch.State.FundingVout, ts)
+	sig, err := sender.SignMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	c, err := getClient(id)
+	if err != nil {
+		return err
+	}
+	req := models.RefreshRequest{
+		TxID:      ch.State.FundingTxID,
+		Vout:      ch.State.FundingVout,
+		Timestamp: ts,
+		SenderSig: sig,
+	}
+	resp, err := c.Refresh(req)
+	if err != nil {
+		return err
+	}
+
+	return storeAuthToken(id, resp.AuthToken)
+}
+
+// verifyReceipts checks the stored receipts of a channel against the
+// receiver's channel key without contacting the server.
+func verifyReceipts(args []string) error {
+	id := args[0]
+
+	ch, ok := globalState.Channels[id]
+	if !ok {
+		return errors.New("unknown id")
+	}
+
+	for i, rc := range ch.Receipts {
+		status := "ok"
+		if err := channels.VerifyReceipt(ch.State.ReceiverPubKey, &rc); err != nil {
+			status = err.Error()
+		}
+		fmt.Printf("%d\t%d\t%d\t%s\t%s\n", i, rc.Count, rc.Balance, string(rc.Payment), status)
+	}
+	return nil
+}
+
 func isClosing(s channels.Status) bool {
 	return s == channels.StatusClosing || s == channels.StatusClosed
 }
@@ -496,6 +736,16 @@ func show(args []string) error {
 	return nil
 }
 
+func unpin(args []string) error {
+	domain := strings.ToLower(args[0])
+	if _, ok := globalState.DomainKeys[domain]; !ok {
+		return errors.New("no key pinned for domain")
+	}
+	delete(globalState.DomainKeys, domain)
+	delete(globalState.DomainExpires, domain)
+	return nil
+}
+
 func help(args []string) error {
 	fmt.Printf("Available commands:\n")
 	for action, _ := range commands {
@@ -511,33 +761,46 @@ func outputError(err string) {
 }
 
 var commands = map[string]func(args []string) error{
-	"create": create,
-	"fund":   fund,
-	"send":   send,
-	"close":  closeAction,
-	"refund": refund,
-	"list":   list,
-	"show":   show,
-	"status": status,
-	"flush":  flushAction,
+	"create":   create,
+	"fund":     fund,
+	"send":     send,
+	"close":    closeAction,
+	"refund":   refund,
+	"list":     list,
+	"show":     show,
+	"status":   status,
+	"flush":    flushAction,
+	"refresh":  refresh,
+	"unpin":    unpin,
+	"receipts": verifyReceipts,
 }
 
 var helps = map[string]string{
-	"create": "Create a channel to a remote server",
-	"fund":   "Open a created channel after funding transaction is confirmed",
-	"send":   "Send a payment",
-	"close":  "Close a channel",
-	"refund": "Show the refund transaction for a channel",
-	"list":   "List channels",
-	"show":   "Show info about a channel",
-	"status": "Get status from server",
-	"flush":  "Flush any pending payment",
-	"help":   "Show help",
+	"create":   "Create a channel to a remote server",
+	"fund":     "Open a created channel after funding transaction is confirmed",
+	"send":     "Send a payment to an address or moonbeam: URI",
+	"close":    "Close a channel",
+	"refund":   "Show the refund transaction for a channel",
+	"list":     "List channels",
+	"show":     "Show info about a channel",
+	"status":   "Get status from server",
+	"flush":    "Flush any pending payment",
+	"refresh":  "Get a new auth token for a channel",
+	"unpin":    "Forget the pinned moonbeam.json key of a domain",
+	"receipts": "Verify the stored payment receipts of a channel",
+	"help":     "Show help",
 }
 
 func main() {
 	flag.Parse()
 
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		outputError(err.Error())
+		return
+	}
+	logger = logging.NewStdLogger(level)
+
 	args := flag.Args()
 
 	action := ""
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestReceiverDomain(t *testing.T) {
+	tests := []struct {
+		arg    string
+		domain string
+		ok     bool
+	}{
+		{"Example.com", "example.com", true},
+		{"bücher.example", "xn--bcher-kva.example", true},
+		{"https://127.0.0.1:3211/moonbeamrpc", "https://127.0.0.1:3211/moonbeamrpc", true},
+		{"example.com:3211", "", false},
+		{"example.com/moonbeamrpc", "", false},
+	}
+	for _, test := range tests {
+		domain, err := receiverDomain(test.arg)
+		if test.ok != (err == nil) {
+			t.Errorf("%s: unexpected error %v", test.arg, err)
+			continue
+		}
+		if domain != test.domain {
+			t.Errorf("%s: expected %s, got %s", test.arg, test.domain, domain)
+		}
+	}
+}
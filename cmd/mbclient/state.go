@@ -12,11 +12,13 @@ import (
 	"github.com/btcsuite/btcutil/hdkeychain"
 
 	"github.com/luno/moonbeam/channels"
+	"github.com/luno/moonbeam/models"
 )
 
 type Channel struct {
 	Domain       string
 	Host         string
+	Hosts        []string
 	KeyPath      int
 	ReceiverData []byte
 	AuthToken    string
@@ -26,6 +28,12 @@ type Channel struct {
 	State channels.SharedState
 
 	Payments [][]byte
+
+	// Certificate is the receiver's statement that it accepted the channel.
+	Certificate *models.ChannelCertificate
+
+	// Receipts are the receiver's signed acknowledgements of payments.
+	Receipts []models.Receipt
 }
 
 type State struct {
@@ -33,6 +41,13 @@ type State struct {
 	XPrivKey       string
 	KeyPathCounter int
 	Channels       map[string]Channel
+
+	// DomainKeys are the pinned moonbeam.json signing keys by domain.
+	DomainKeys map[string][]byte
+
+	// DomainExpires is the latest expiry of the signed moonbeam.json
+	// documents accepted by domain.
+	DomainExpires map[string]int64
 }
 
 func (s *State) NextKey() int {
@@ -167,6 +182,26 @@ func storePendingPayment(id string, state channels.SharedState, p []byte) error
 	return nil
 }
 
+func storeCertificate(id string, cert *models.ChannelCertificate) error {
+	c, ok := globalState.Channels[id]
+	if !ok {
+		return errors.New("channel does not exist")
+	}
+	c.Certificate = cert
+	globalState.Channels[id] = c
+	return nil
+}
+
+func storeReceipt(id string, rc models.Receipt) error {
+	c, ok := globalState.Channels[id]
+	if !ok {
+		return errors.New("channel does not exist")
+	}
+	c.Receipts = append(c.Receipts, rc)
+	globalState.Channels[id] = c
+	return nil
+}
+
 func storeAuthToken(id string, authToken string) error {
 	c, ok := globalState.Channels[id]
 	if !ok {
@@ -177,6 +212,40 @@ func storeAuthToken(id string, authToken string) error {
 	return nil
 }
 
+// endpoints returns the receiver's endpoints in order of preference. Channels
+// created before Hosts was added only have Host.
+func (c Channel) endpoints() []string {
+	if len(c.Hosts) > 0 {
+		return c.Hosts
+	}
+	return []string{c.Host}
+}
+
+func (s *State) PinnedKey(domain string) ([]byte, bool) {
+	k, ok := s.DomainKeys[domain]
+	return k, ok
+}
+
+func (s *State) PinKey(domain string, pubKey []byte) error {
+	if s.DomainKeys == nil {
+		s.DomainKeys = make(map[string][]byte)
+	}
+	s.DomainKeys[domain] = pubKey
+	return nil
+}
+
+func (s *State) PinnedExpires(domain string) int64 {
+	return s.DomainExpires[domain]
+}
+
+func (s *State) PinExpires(domain string, expires int64) error {
+	if s.DomainExpires == nil {
+		s.DomainExpires = make(map[string]int64)
+	}
+	s.DomainExpires[domain] = expires
+	return nil
+}
+
 func findForDomain(domain string) []string {
 	var ids []string
 	for id, c := range globalState.Channels {
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/luno/moonbeam/channels"
+	"github.com/luno/moonbeam/logging"
+	"github.com/luno/moonbeam/models"
+	"github.com/luno/moonbeam/receiver"
+	"github.com/luno/moonbeam/storage"
+)
+
+var adminListenAddr = flag.String("admin_listen", "", "Address to serve the admin API and dashboard on, disabled if empty")
+var adminToken = flag.String("admin_token", "", "Bearer token accepted by the admin listener")
+var adminUsername = flag.String("admin_username", "", "Basic auth username accepted by the admin listener")
+var adminPassword = flag.String("admin_password", "", "Basic auth password accepted by the admin listener")
+var adminClientCA = flag.String("admin_client_ca", "", "PEM file of CAs; if set, the admin listener requires client certificates signed by them")
+var publicDashboard = flag.Bool("public_dashboard", false, "Also serve the dashboard without authentication on the public listener")
+
+const adminPath = "/admin"
+
+// AdminChannel is a channel as returned by the admin API.
+type AdminChannel struct {
+	ID       string               `json:"id"`
+	Domain   string               `json:"domain"`
+	Frozen   bool                 `json:"frozen"`
+	State    channels.SharedState `json:"state"`
+	Payments []json.RawMessage    `json:"payments,omitempty"`
+}
+
+func newAdminChannel(d *DomainState, rec storage.Record) AdminChannel {
+	return AdminChannel{
+		ID:     rec.ID,
+		Domain: d.Config.Domain,
+		Frozen: rec.Frozen,
+		State:  rec.SharedState,
+	}
+}
+
+func secretEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// checkAdminAuth accepts a verified client certificate, the admin token or
+// the basic auth credentials.
+func checkAdminAuth(r *http.Request) bool {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+
+	if *adminToken != "" {
+		h := r.Header.Get("Authorization")
+		const prefix = "Bearer "
+		if strings.HasPrefix(h, prefix) && secretEqual(h[len(prefix):], *adminToken) {
+			return true
+		}
+	}
+
+	if *adminUsername != "" {
+		u, p, ok := r.BasicAuth()
+		// Compare both to avoid leaking which one is wrong.
+		uok := secretEqual(u, *adminUsername)
+		pok := secretEqual(p, *adminPassword)
+		if ok && uok && pok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func requireAdmin(h func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkAdminAuth(r) {
+			if *adminUsername != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="moonbeam"`)
+			}
+			writeError(w, http.StatusUnauthorized,
+				models.ErrCodeUnauthorized, "unauthorized")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// checkAdminConfig checks that the admin listener can't be used without
+// authentication.
+func checkAdminConfig() error {
+	if *adminToken == "" && *adminUsername == "" && *adminClientCA == "" {
+		return errors.New("--admin_listen requires --admin_token, --admin_username or --admin_client_ca")
+	}
+	if (*adminUsername == "") != (*adminPassword == "") {
+		return errors.New("--admin_username and --admin_password must be set together")
+	}
+	if *adminClientCA != "" && *tlsCert == "" {
+		return errors.New("--admin_client_ca requires --tls_cert")
+	}
+	return nil
+}
+
+func adminTLSConfig() (*tls.Config, error) {
+	if *adminClientCA == "" {
+		return nil, nil
+	}
+
+	pem, err := ioutil.ReadFile(*adminClientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + *adminClientCA)
+	}
+
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+// adminError writes err in full since the admin API is only used by
+// operators.
+func adminError(w http.ResponseWriter, err error) {
+	code := receiver.ToModelError(err).Code
+	writeError(w, errorStatus(code), code, err.Error())
+}
+
+func adminRespond(w http.ResponseWriter, resp interface{}, err error) {
+	if err != nil {
+		logger.Log(logging.Error, "admin error", logging.Fields{"error": err})
+		adminError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Log(logging.Error, "json encode error",
+			logging.Fields{"error": err})
+	}
+}
+
+func parseStatus(s string) (channels.Status, bool) {
+	for st := channels.Status(channels.StatusCreated); st <= channels.StatusClosed; st++ {
+		if strings.EqualFold(st.String(), s) {
+			return st, true
+		}
+	}
+	return 0, false
+}
+
+func adminListHandler(ss *ServerState, w http.ResponseWriter, r *http.Request) {
+	var f receiver.ChannelFilter
+	if s := r.FormValue("status"); s != "" {
+		st, ok := parseStatus(s)
+		if !ok {
+			writeError(w, http.StatusBadRequest,
+				models.ErrCodeInvalidRequest, "invalid status")
+			return
+		}
+		f.Status = st
+	}
+	f.Frozen = r.FormValue("frozen") == "true"
+	domain := strings.ToLower(r.FormValue("domain"))
+
+	list := []AdminChannel{}
+	for _, d := range ss.Domains {
+		if domain != "" && d.Config.Domain != domain {
+			continue
+		}
+		recs, err := d.Receiver.ListChannels(f)
+		if err != nil {
+			adminError(w, err)
+			return
+		}
+		for _, rec := range recs {
+			list = append(list, newAdminChannel(d, rec))
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+
+	adminRespond(w, list, nil)
+}
+
+func adminChannelHandler(d *DomainState, w http.ResponseWriter, txid string, vout uint32) {
+	rc := d.Receiver
+
+	rec, err := rc.Channel(txid, vout)
+	if err != nil {
+		adminError(w, err)
+		return
+	}
+	payments, err := rc.ListPayments(txid, vout)
+	if err != nil {
+		adminError(w, err)
+		return
+	}
+
+	c := newAdminChannel(d, *rec)
+	for _, p := range payments {
+		c.Payments = append(c.Payments, json.RawMessage(p))
+	}
+	adminRespond(w, c, nil)
+}
+
+func adminActionHandler(d *DomainState, w http.ResponseWriter, action string, txid string, vout uint32) {
+	rc := d.Receiver
+
+	switch action {
+	case "close":
+		resp, err := rc.ForceClose(txid, vout)
+		adminRespond(w, resp, err)
+	case "freeze":
+		adminRespond(w, struct{}{}, rc.Freeze(txid, vout))
+	case "unfreeze":
+		adminRespond(w, struct{}{}, rc.Unfreeze(txid, vout))
+	case "rebroadcast":
+		closeTxID, err := rc.Rebroadcast(txid, vout)
+		adminRespond(w, struct {
+			CloseTxID string `json:"closeTxId"`
+		}{closeTxID}, err)
+	case "check":
+		adminRespond(w, struct{}{}, rc.Check(txid, vout))
+	default:
+		writeError(w, http.StatusNotFound,
+			models.ErrCodeInvalidRequest, "unknown action")
+	}
+}
+
+func adminCheckAllHandler(ss *ServerState, w http.ResponseWriter, r *http.Request) {
+	for _, d := range ss.Domains {
+		if err := d.Receiver.CheckAll(); err != nil {
+			adminError(w, err)
+			return
+		}
+	}
+	adminRespond(w, struct{}{}, nil)
+}
+
+// adminHandler serves the admin API:
+//
+//	GET  /admin/channels?status=open&frozen=true&domain=example.com
+//	GET  /admin/channels/<txid>-<vout>
+//	POST /admin/channels/<txid>-<vout>/close
+//	POST /admin/channels/<txid>-<vout>/freeze
+//	POST /admin/channels/<txid>-<vout>/unfreeze
+//	POST /admin/channels/<txid>-<vout>/rebroadcast
+//	POST /admin/channels/<txid>-<vout>/check
+//	POST /admin/check
+//	GET  /admin/invoices
+//	POST /admin/invoices
+//	GET  /admin/invoices/<id>
+func adminHandler(ss *ServerState, w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, adminPath+"/")
+	parts := strings.Split(path, "/")
+
+	if parts[0] == "invoices" {
+		adminInvoicesHandler(ss, w, r, parts)
+		return
+	}
+
+	if path == "check" {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed,
+				models.ErrCodeInvalidRequest, "method not allowed")
+			return
+		}
+		adminCheckAllHandler(ss, w, r)
+		return
+	}
+
+	if parts[0] != "channels" || len(parts) > 3 {
+		writeError(w, http.StatusNotFound,
+			models.ErrCodeInvalidRequest, "not found")
+		return
+	}
+
+	if len(parts) == 1 {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed,
+				models.ErrCodeInvalidRequest, "method not allowed")
+			return
+		}
+		adminListHandler(ss, w, r)
+		return
+	}
+
+	txid, vout, ok := splitTxIDVout(parts[1])
+	if !ok {
+		writeError(w, http.StatusNotFound,
+			models.ErrCodeInvalidRequest, "invalid channel ID")
+		return
+	}
+	d := ss.forChannel(txid, vout)
+	if d == nil {
+		writeError(w, http.StatusNotFound,
+			models.ErrCodeChannelNotFound, "channel not found")
+		return
+	}
+
+	if len(parts) == 2 {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed,
+				models.ErrCodeInvalidRequest, "method not allowed")
+			return
+		}
+		adminChannelHandler(d, w, txid, vout)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed,
+			models.ErrCodeInvalidRequest, "method not allowed")
+		return
+	}
+	adminActionHandler(d, w, parts[2], txid, vout)
+}
+
+// serveAdmin serves the admin API, the dashboard and the metrics. Every
+// request must be authenticated.
+func serveAdmin(ss *ServerState) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminPath+"/", requireAdmin(wrap(ss, adminHandler)))
+	mux.HandleFunc("/", requireAdmin(wrap(ss, indexHandler)))
+	mux.HandleFunc("/details", requireAdmin(wrap(ss, detailsHandler)))
+	mux.HandleFunc("/request", requireAdmin(wrap(ss, requestHandler)))
+	mux.Handle("/metrics", http.HandlerFunc(requireAdmin(promhttp.Handler().ServeHTTP)))
+	mux.HandleFunc("/healthz", wrap(ss, healthzHandler))
+	mux.HandleFunc("/readyz", wrap(ss, readyzHandler))
+
+	tlsConfig, err := adminTLSConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := newServer(*adminListenAddr, mux)
+	srv.TLSConfig = tlsConfig
+
+	logger.Log(logging.Info, "admin listening",
+		logging.Fields{"addr": *adminListenAddr})
+
+	if *tlsCert == "" {
+		log.Fatal(srv.ListenAndServe())
+	} else {
+		log.Fatal(srv.ListenAndServeTLS(*tlsCert, *tlsKey))
+	}
+}
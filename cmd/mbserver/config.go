@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var configPath = flag.String("config", "", "JSON config file, flags given on the command line override it")
+
+// Secret is a config value that can be given inline or read from a file or
+// environment variable so that it doesn't have to be stored in the config
+// file or passed as a flag. In JSON it is either a string or an object such
+// as {"file": "/run/secrets/xprivkey"} or {"env": "MOONBEAM_AUTH_TOKEN"}.
+type Secret struct {
+	Value string `json:"value"`
+	File  string `json:"file"`
+	Env   string `json:"env"`
+}
+
+func (s *Secret) UnmarshalJSON(buf []byte) error {
+	if err := json.Unmarshal(buf, &s.Value); err == nil {
+		return nil
+	}
+	type secret Secret
+	return json.Unmarshal(buf, (*secret)(s))
+}
+
+func (s Secret) Resolve() (string, error) {
+	n := 0
+	for _, v := range []string{s.Value, s.File, s.Env} {
+		if v != "" {
+			n++
+		}
+	}
+	if n > 1 {
+		return "", errors.New("only one of value, file and env may be set")
+	}
+
+	if s.File != "" {
+		buf, err := ioutil.ReadFile(s.File)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(buf)), nil
+	}
+	if s.Env != "" {
+		v, ok := os.LookupEnv(s.Env)
+		if !ok {
+			return "", errors.New("environment variable " + s.Env + " is not set")
+		}
+		return v, nil
+	}
+	return s.Value, nil
+}
+
+type BitcoindConfig struct {
+	Host     string `json:"host"`
+	Username string `json:"username"`
+	Password Secret `json:"password"`
+}
+
+type TLSConfig struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+type AdminConfig struct {
+	Listen          string `json:"listen"`
+	Token           Secret `json:"token"`
+	Username        string `json:"username"`
+	Password        Secret `json:"password"`
+	ClientCA        string `json:"clientCA"`
+	PublicDashboard *bool  `json:"publicDashboard"`
+}
+
+type AuthConfig struct {
+	Token           Secret `json:"token"`
+	TokenID         string `json:"tokenID"`
+	Previous        Secret `json:"previous"`
+	PreviousID      string `json:"previousID"`
+	PreviousExpires string `json:"previousExpires"`
+	TokenTTL        string `json:"tokenTTL"`
+	Mode            string `json:"mode"`
+}
+
+type PolicyConfig struct {
+	SoftTimeout    int `json:"softTimeout"`
+	FundingMinConf int `json:"fundingMinConf"`
+}
+
+// ChannelConfig sets the channel parameters required from senders.
+type ChannelConfig struct {
+	Timeout int64 `json:"timeout"`
+	FeeRate int64 `json:"feeRate"`
+}
+
+type StorageConfig struct {
+	Backend string `json:"backend"`
+	Dir     string `json:"dir"`
+}
+
+// LimitsConfig configures the abuse controls of the public listener. Rate
+// limits are requests per minute and zero disables them.
+type LimitsConfig struct {
+	IP           *int   `json:"ip"`
+	Channel      *int   `json:"channel"`
+	Routes       string `json:"routes"`
+	TrustProxy   *bool  `json:"trustProxy"`
+	MaxBodyBytes int64  `json:"maxBodyBytes"`
+	ReadTimeout  string `json:"readTimeout"`
+	WriteTimeout string `json:"writeTimeout"`
+	IdleTimeout  string `json:"idleTimeout"`
+}
+
+// HealthConfig sets the thresholds of the health endpoints.
+type HealthConfig struct {
+	MaxTipAge   string `json:"maxTipAge"`
+	MaxWatchAge string `json:"maxWatchAge"`
+}
+
+type WebhookConfig struct {
+	URL    string `json:"url"`
+	Secret Secret `json:"secret"`
+}
+
+// Config is the mbserver config file. Every setting corresponds to a flag.
+// Unset settings keep the flag's default.
+type Config struct {
+	// Network is mainnet or testnet3.
+	Network string `json:"network"`
+
+	Bitcoind BitcoindConfig `json:"bitcoind"`
+
+	Listen      string      `json:"listen"`
+	ExternalURL string      `json:"externalURL"`
+	TLS         TLSConfig   `json:"tls"`
+	Admin       AdminConfig `json:"admin"`
+
+	XPrivKey          Secret     `json:"xprivkey"`
+	DomainKey         Secret     `json:"domainKey"`
+	DomainKeyPrevious Secret     `json:"domainKeyPrevious"`
+	TargetKeys        string     `json:"targetKeys"`
+	Destination       string     `json:"destination"`
+	Auth              AuthConfig `json:"auth"`
+	LogLevel          string     `json:"logLevel"`
+
+	// Domain and the directory settings configure a single domain. Use
+	// Domains to serve several.
+	Domain          string         `json:"domain"`
+	DirectoryURL    string         `json:"directoryURL"`
+	DirectoryFile   string         `json:"directoryFile"`
+	Domains         []DomainConfig `json:"domains"`
+	DistributedLock *bool          `json:"distributedLock"`
+
+	Policy  PolicyConfig  `json:"policy"`
+	Channel ChannelConfig `json:"channel"`
+	Storage StorageConfig `json:"storage"`
+	Limits  LimitsConfig  `json:"limits"`
+	Health  HealthConfig  `json:"health"`
+	Webhook WebhookConfig `json:"webhook"`
+}
+
+// configDomains are the domains given in the config file, if any.
+var configDomains []DomainConfig
+
+func loadConfig(path string) (*Config, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var c Config
+	if err := json.Unmarshal(buf, &c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &c, nil
+}
+
+// applyConfig sets the flags from the config file, except those that were
+// given on the command line.
+func applyConfig(c *Config) error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	set := func(name, value string) error {
+		if value == "" || explicit[name] {
+			return nil
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("config for --%s: %v", name, err)
+		}
+		return nil
+	}
+	setSecret := func(name string, s Secret) error {
+		v, err := s.Resolve()
+		if err != nil {
+			return fmt.Errorf("config for --%s: %v", name, err)
+		}
+		return set(name, v)
+	}
+	setInt := func(name string, v int64) error {
+		if v == 0 {
+			return nil
+		}
+		return set(name, strconv.FormatInt(v, 10))
+	}
+	setBool := func(name string, v *bool) error {
+		if v == nil {
+			return nil
+		}
+		return set(name, strconv.FormatBool(*v))
+	}
+	setIntPtr := func(name string, v *int) error {
+		if v == nil {
+			return nil
+		}
+		return set(name, strconv.Itoa(*v))
+	}
+
+	switch c.Network {
+	case "":
+	case "mainnet":
+		if err := set("testnet", "false"); err != nil {
+			return err
+		}
+	case "testnet3":
+		if err := set("testnet", "true"); err != nil {
+			return err
+		}
+	default:
+		return errors.New("network must be mainnet or testnet3")
+	}
+
+	if explicit["domains_config"] && len(c.Domains) > 0 {
+		return errors.New("domains may not be set in both --domains_config and the config file")
+	}
+	configDomains = c.Domains
+
+	errs := []error{
+		set("bitcoind_host", c.Bitcoind.Host),
+		set("bitcoind_username", c.Bitcoind.Username),
+		setSecret("bitcoind_password", c.Bitcoind.Password),
+
+		set("listen", c.Listen),
+		set("external_url", c.ExternalURL),
+		set("tls_cert", c.TLS.Cert),
+		set("tls_key", c.TLS.Key),
+
+		set("admin_listen", c.Admin.Listen),
+		setSecret("admin_token", c.Admin.Token),
+		set("admin_username", c.Admin.Username),
+		setSecret("admin_password", c.Admin.Password),
+		set("admin_client_ca", c.Admin.ClientCA),
+		setBool("public_dashboard", c.Admin.PublicDashboard),
+
+		setSecret("xprivkey", c.XPrivKey),
+		setSecret("domain_key", c.DomainKey),
+		setSecret("domain_key_previous", c.DomainKeyPrevious),
+		set("target_keys", c.TargetKeys),
+		set("destination", c.Destination),
+		setSecret("auth_token", c.Auth.Token),
+		set("auth_token_id", c.Auth.TokenID),
+		setSecret("auth_token_previous", c.Auth.Previous),
+		set("auth_token_previous_id", c.Auth.PreviousID),
+		set("auth_token_previous_expires", c.Auth.PreviousExpires),
+		set("auth_token_ttl", c.Auth.TokenTTL),
+		set("auth_mode", c.Auth.Mode),
+		set("log_level", c.LogLevel),
+
+		set("domain", c.Domain),
+		set("directory_url", c.DirectoryURL),
+		set("directory_file", c.DirectoryFile),
+		setBool("distributed_lock", c.DistributedLock),
+
+		setInt("soft_timeout", int64(c.Policy.SoftTimeout)),
+		setInt("funding_min_conf", int64(c.Policy.FundingMinConf)),
+		setInt("channel_timeout", c.Channel.Timeout),
+		setInt("fee_rate", c.Channel.FeeRate),
+		set("storage", c.Storage.Backend),
+		set("storage_dir", c.Storage.Dir),
+
+		setIntPtr("rate_limit_ip", c.Limits.IP),
+		setIntPtr("rate_limit_channel", c.Limits.Channel),
+		set("rate_limit_routes", c.Limits.Routes),
+		setBool("trust_proxy", c.Limits.TrustProxy),
+		setInt("max_body_bytes", c.Limits.MaxBodyBytes),
+		set("http_read_timeout", c.Limits.ReadTimeout),
+		set("http_write_timeout", c.Limits.WriteTimeout),
+		set("http_idle_timeout", c.Limits.IdleTimeout),
+
+		set("max_tip_age", c.Health.MaxTipAge),
+		set("max_watch_age", c.Health.MaxWatchAge),
+
+		set("webhook_url", c.Webhook.URL),
+		setSecret("webhook_secret", c.Webhook.Secret),
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func checkAddr(name, addr string) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("--%s: %v", name, err)
+	}
+	return nil
+}
+
+func checkURL(name, u string) error {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return fmt.Errorf("--%s: %v", name, err)
+	}
+	if pu.Scheme != "http" && pu.Scheme != "https" {
+		return fmt.Errorf("--%s must be an http or https URL", name)
+	}
+	return nil
+}
+
+// validateConfig checks the settings that don't depend on external resources
+// so that mistakes are reported at startup.
+func validateConfig() error {
+	if *xprivkey == "" {
+		return errors.New("--xprivkey is required")
+	}
+	if *authToken == "" {
+		return errors.New("--auth_token is required")
+	}
+	if *authMode != "token" && *authMode != "signature" && *authMode != "any" {
+		return errors.New("--auth_mode must be token, signature or any")
+	}
+	for _, k := range []string{*domainKey, *domainKeyPrevious} {
+		if k == "" {
+			continue
+		}
+		if _, err := parseDomainKey(k); err != nil {
+			return fmt.Errorf("--domain_key: %v", err)
+		}
+	}
+	if *webhookURL != "" {
+		if *webhookSecret == "" {
+			return errors.New("--webhook_secret is required with --webhook_url")
+		}
+		if err := checkURL("webhook_url", *webhookURL); err != nil {
+			return err
+		}
+	}
+
+	if err := checkAddr("listen", *listenAddr); err != nil {
+		return err
+	}
+	if *adminListenAddr != "" {
+		if err := checkAddr("admin_listen", *adminListenAddr); err != nil {
+			return err
+		}
+		if err := checkAdminConfig(); err != nil {
+			return err
+		}
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return errors.New("--tls_cert and --tls_key must be set together")
+	}
+	if *externalURL != "" {
+		if err := checkURL("external_url", *externalURL); err != nil {
+			return err
+		}
+	}
+
+	if *maxBodyBytes <= 0 {
+		return errors.New("--max_body_bytes must be positive")
+	}
+	if _, err := parseRouteLimits(*rateLimitRoutes); err != nil {
+		return fmt.Errorf("--rate_limit_routes: %v", err)
+	}
+
+	if *maxTipAge < 0 {
+		return errors.New("--max_tip_age must not be negative")
+	}
+	if *maxWatchAge <= 0 {
+		return errors.New("--max_watch_age must be positive")
+	}
+
+	if *storageBackend != "filesystem" {
+		return errors.New("--storage must be filesystem")
+	}
+	if *softTimeout < 0 || *fundingMinConf < 0 || *channelTimeout < 0 || *feeRate < 0 {
+		return errors.New("policy and channel parameters must not be negative")
+	}
+
+	return nil
+}
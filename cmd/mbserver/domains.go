@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+
+	"github.com/luno/moonbeam/address"
+	"github.com/luno/moonbeam/receiver"
+	"github.com/luno/moonbeam/resolver"
+)
+
+// DomainConfig configures one of the domains served by this process.
+type DomainConfig struct {
+	Domain      string `json:"domain"`
+	ExternalURL string `json:"externalURL"`
+
+	// Destination defaults to --destination.
+	Destination string `json:"destination"`
+
+	// XPrivKey optionally gives the domain its own key chain instead of
+	// --xprivkey.
+	XPrivKey Secret `json:"xprivkey"`
+
+	DirectoryURL  string `json:"directoryURL"`
+	DirectoryFile string `json:"directoryFile"`
+
+	// DomainKey and DomainKeyPrevious default to --domain_key and
+	// --domain_key_previous.
+	DomainKey         Secret `json:"domainKey"`
+	DomainKeyPrevious Secret `json:"domainKeyPrevious"`
+
+	// Zero means the network's default policy.
+	SoftTimeout    int `json:"softTimeout"`
+	FundingMinConf int `json:"fundingMinConf"`
+}
+
+type domainsFile struct {
+	Domains []DomainConfig `json:"domains"`
+}
+
+func loadDomains(path string) ([]DomainConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var df domainsFile
+	if err := json.NewDecoder(f).Decode(&df); err != nil {
+		return nil, err
+	}
+
+	return checkDomains(df.Domains)
+}
+
+// checkDomains validates the domains, normalizes their names and resolves
+// their secrets. Each hostname may only select one domain, so no domain's
+// name or ExternalURL host may be used by another domain.
+func checkDomains(dcs []DomainConfig) ([]DomainConfig, error) {
+	if len(dcs) == 0 {
+		return nil, errors.New("no domains configured")
+	}
+
+	seen := make(map[string]bool)
+	for i, dc := range dcs {
+		if dc.Domain == "" {
+			return nil, errors.New("domain is required")
+		}
+		d, err := address.NormalizeDomain(dc.Domain)
+		if err != nil {
+			return nil, errors.New("invalid domain " + dc.Domain)
+		}
+		if seen[d] {
+			return nil, errors.New("duplicate domain " + d)
+		}
+		seen[d] = true
+		dcs[i].Domain = d
+
+		if dc.SoftTimeout < 0 || dc.FundingMinConf < 0 {
+			return nil, errors.New("policy parameters must not be negative for " + d)
+		}
+
+		for _, s := range []*Secret{&dcs[i].XPrivKey, &dcs[i].DomainKey, &dcs[i].DomainKeyPrevious} {
+			v, err := s.Resolve()
+			if err != nil {
+				return nil, fmt.Errorf("secret for %s: %v", d, err)
+			}
+			*s = Secret{Value: v}
+		}
+	}
+
+	owner := make(map[string]string)
+	for _, dc := range dcs {
+		for _, h := range domainHosts(dc) {
+			if o, ok := owner[h]; ok && o != dc.Domain {
+				return nil, errors.New("host " + h + " is used by both " +
+					o + " and " + dc.Domain)
+			}
+			owner[h] = dc.Domain
+		}
+	}
+
+	return dcs, nil
+}
+
+// flagDomain returns the single domain configured through flags.
+func flagDomain() DomainConfig {
+	return DomainConfig{
+		Domain:        *domain,
+		ExternalURL:   *externalURL,
+		Destination:   *destination,
+		DirectoryURL:  *directoryURL,
+		DirectoryFile: *directoryFile,
+	}
+}
+
+func parseDomainKey(s string) (*btcec.PrivateKey, error) {
+	buf, err := hex.DecodeString(s)
+	if err != nil || len(buf) != btcec.PrivKeyBytesLen {
+		return nil, errors.New("domain key must be 32 hex encoded bytes")
+	}
+	k, _ := btcec.PrivKeyFromBytes(btcec.S256(), buf)
+	return k, nil
+}
+
+// domainKeys returns the domain's current key followed by the previous one,
+// if they are configured.
+func domainKeys(dc DomainConfig) ([]*btcec.PrivateKey, error) {
+	current, previous := dc.DomainKey.Value, dc.DomainKeyPrevious.Value
+	if current == "" {
+		current = *domainKey
+	}
+	if previous == "" {
+		previous = *domainKeyPrevious
+	}
+	if current == "" {
+		if previous != "" {
+			return nil, errors.New("previous domain key requires a domain key for " + dc.Domain)
+		}
+		return nil, nil
+	}
+
+	var keys []*btcec.PrivateKey
+	for _, s := range []string{current, previous} {
+		if s == "" {
+			continue
+		}
+		k, err := parseDomainKey(s)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// documentPeriod is how often a signed moonbeam.json is re-signed. Each
+// document expires after two periods.
+const documentPeriod = 12 * time.Hour
+
+// documentExpires returns the expiry of the signed moonbeam.json at now. It
+// only depends on the time so that every server of the domain signs the same
+// expiry, otherwise senders would reject documents from a server that signed
+// earlier than the last one they saw.
+func documentExpires(now time.Time) int64 {
+	return now.Truncate(documentPeriod).Add(2 * documentPeriod).Unix()
+}
+
+// domainDocument returns the domain's moonbeam.json, signed if it has
+// domain keys.
+func domainDocument(dc DomainConfig, keys []*btcec.PrivateKey, now time.Time) (*resolver.Domain, error) {
+	d := &resolver.Domain{
+		Receivers: []resolver.DomainReceiver{
+			{URL: dc.ExternalURL + rpcPath},
+		},
+	}
+	if len(keys) == 0 {
+		return d, nil
+	}
+
+	d.Expires = documentExpires(now)
+	if err := resolver.SignDomain(dc.Domain, d, keys); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// DomainState is a domain served by this process together with its own
+// receiver.
+type DomainState struct {
+	Config   DomainConfig
+	Receiver *receiver.Receiver
+
+	// DomainKeys sign the domain's moonbeam.json.
+	DomainKeys []*btcec.PrivateKey
+
+	mu  sync.Mutex
+	doc *resolver.Domain
+}
+
+// document returns the domain's moonbeam.json. A signed document is signed
+// again once its period is over.
+func (ds *DomainState) document(now time.Time) (*resolver.Domain, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if ds.doc != nil && (len(ds.DomainKeys) == 0 || ds.doc.Expires == documentExpires(now)) {
+		return ds.doc, nil
+	}
+	d, err := domainDocument(ds.Config, ds.DomainKeys, now)
+	if err != nil {
+		return nil, err
+	}
+	ds.doc = d
+	return d, nil
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// domainHosts returns the hostnames that select the domain.
+func domainHosts(dc DomainConfig) []string {
+	hosts := []string{dc.Domain}
+	if u, err := url.Parse(dc.ExternalURL); err == nil && u.Host != "" {
+		hosts = append(hosts, strings.ToLower(stripPort(u.Host)))
+	}
+	return hosts
+}
+
+// hosts returns the hostnames that select this domain.
+func (d *DomainState) hosts() []string {
+	return domainHosts(d.Config)
+}
+
+// forHost returns the domain selected by the request's Host header.
+func (s *ServerState) forHost(r *http.Request) *DomainState {
+	host := strings.ToLower(stripPort(r.Host))
+	for _, d := range s.Domains {
+		for _, h := range d.hosts() {
+			if h == host {
+				return d
+			}
+		}
+	}
+	return nil
+}
+
+// forChannel returns the domain whose receiver stores the channel.
+func (s *ServerState) forChannel(txid string, vout uint32) *DomainState {
+	for _, d := range s.Domains {
+		if d.Receiver.Get(txid, vout) != nil {
+			return d
+		}
+	}
+	return nil
+}
+
+// forTarget returns the domain of the target address.
+func (s *ServerState) forTarget(target string) *DomainState {
+	i := strings.LastIndex(target, "@")
+	if i < 0 {
+		return nil
+	}
+	domain, err := address.NormalizeDomain(target[i+1:])
+	if err != nil {
+		return nil
+	}
+	return s.forDomain(domain)
+}
+
+// selectDomain picks the domain to handle a request. The Host header is
+// preferred. Requests for existing channels are otherwise routed to the
+// domain that stores the channel, whose directory only accepts targets for
+// that domain. Requests about a target go to the target's domain. The first
+// configured domain is the default.
+func (s *ServerState) selectDomain(r *http.Request, txid string, vout uint32, target string) *DomainState {
+	if d := s.forHost(r); d != nil {
+		return d
+	}
+	if txid != "" {
+		if d := s.forChannel(txid, vout); d != nil {
+			return d
+		}
+	}
+	if target != "" {
+		if d := s.forTarget(target); d != nil {
+			return d
+		}
+	}
+	return s.Domains[0]
+}
+
+// findChannel returns the receiver storing the channel, if any.
+func (s *ServerState) findChannel(txid string, vout uint32) *receiver.Receiver {
+	d := s.forChannel(txid, vout)
+	if d == nil {
+		return nil
+	}
+	return d.Receiver
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcrpcclient"
+
+	"github.com/luno/moonbeam/receiver"
+	"github.com/luno/moonbeam/storage"
+	"github.com/luno/moonbeam/storage/filesystem"
+)
+
+func TestCheckDomains(t *testing.T) {
+	tests := []struct {
+		dcs []DomainConfig
+		err string
+	}{
+		{nil, "no domains configured"},
+		{[]DomainConfig{{Domain: "Example.com"}, {Domain: "example.COM"}}, "duplicate domain"},
+		{[]DomainConfig{{Domain: "a/b"}}, "invalid domain"},
+		{[]DomainConfig{
+			{Domain: "a.com", ExternalURL: "https://pay.example.com"},
+			{Domain: "b.com", ExternalURL: "https://PAY.example.com:8443"},
+		}, "host pay.example.com is used by both a.com and b.com"},
+		{[]DomainConfig{
+			{Domain: "a.com", ExternalURL: "https://b.com"},
+			{Domain: "b.com"},
+		}, "host b.com is used by both a.com and b.com"},
+		{[]DomainConfig{
+			{Domain: "a.com", ExternalURL: "https://a.com"},
+			{Domain: "b.com", ExternalURL: "https://pay.b.com"},
+		}, ""},
+	}
+	for i, test := range tests {
+		_, err := checkDomains(test.dcs)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%d: unexpected error %v", i, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%d: expected error %q, got %v", i, test.err, err)
+		}
+	}
+}
+
+const (
+	testTxID   = "8ac37b4fb0ddc50e3a1b3a5b8fac35c9b4f5fea4bc9ccb6b3ac1b7ae6d4c6d3b"
+	testTarget = "mgzdqkEjYEjR5QNdJxYFnCKZHuNYa5bUZ2+mb7vCiK@example.com"
+)
+
+// newTestServerState returns a server for the domains on testnet, the
+// directory holding the state file <domain>.json of each domain and a
+// function to remove it.
+func newTestServerState(t *testing.T, bc *btcrpcclient.Client, dcs ...DomainConfig) (*ServerState, string, func()) {
+	dir, err := ioutil.TempDir("", "moonbeam")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dcs, err = checkDomains(dcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	net := &chaincfg.TestNet3Params
+	ss := &ServerState{BC: bc}
+	for _, dc := range dcs {
+		db := filesystem.NewFilesystemStorage(filepath.Join(dir, dc.Domain+".json"))
+		rc := receiver.NewReceiver(net, nil, bc, db,
+			receiver.NewDomainDirectory(net, dc.Domain), "", "token")
+		ss.Domains = append(ss.Domains, &DomainState{Config: dc, Receiver: rc})
+	}
+
+	return ss, dir, func() { os.RemoveAll(dir) }
+}
+
+func TestSelectDomain(t *testing.T) {
+	ss, dir, cleanup := newTestServerState(t, nil,
+		DomainConfig{Domain: "example.org", ExternalURL: "https://pay.example.org"},
+		DomainConfig{Domain: "example.com", ExternalURL: "https://pay.example.com:8443"},
+		DomainConfig{Domain: "example.net"})
+	defer cleanup()
+	org, com, nt := ss.Domains[0], ss.Domains[1], ss.Domains[2]
+
+	// The channel is stored by example.net.
+	db := filesystem.NewFilesystemStorage(filepath.Join(dir, "example.net.json"))
+	err := db.Create(storage.Record{ID: testTxID + "-1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host   string
+		txid   string
+		vout   uint32
+		target string
+		exp    *DomainState
+	}{
+		{"pay.example.com", "", 0, "", com},
+		{"PAY.EXAMPLE.COM:8443", "", 0, "", com},
+		{"example.com", "", 0, "", com},
+		{"example.net", "", 0, "", nt},
+		{"unknown.com", "", 0, "", org},
+		{"pay.example.com", testTxID, 1, "", com},
+		{"unknown.com", testTxID, 1, "", nt},
+		{"unknown.com", testTxID, 2, "", org},
+		{"unknown.com", "", 0, testTarget, com},
+		{"unknown.com", "", 0, strings.Replace(testTarget, "example.com", "EXAMPLE.net", 1), nt},
+		{"unknown.com", "", 0, "invalid", org},
+		{"pay.example.org", "", 0, testTarget, org},
+		{"unknown.com", testTxID, 1, testTarget, nt},
+	}
+	for i, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = test.host
+		d := ss.selectDomain(r, test.txid, test.vout, test.target)
+		if d != test.exp {
+			t.Errorf("%d: expected %s, got %s", i, test.exp.Config.Domain, d.Config.Domain)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "unknown.com"
+	if ss.forHost(r) != nil {
+		t.Errorf("Unexpected domain for unknown host")
+	}
+	if ss.forChannel(testTxID, 0) != nil {
+		t.Errorf("Unexpected domain for unknown channel")
+	}
+	if ss.findChannel(testTxID, 1) != nt.Receiver {
+		t.Errorf("Expected channel to be found in example.net")
+	}
+}
+
+func TestLoadDomainsSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moonbeam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "xprivkey")
+	if err := ioutil.WriteFile(keyFile, []byte("xprv-from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("MOONBEAM_TEST_DOMAIN_KEY", "key-from-env")
+	defer os.Unsetenv("MOONBEAM_TEST_DOMAIN_KEY")
+
+	path := filepath.Join(dir, "domains.json")
+	config := `{"domains": [{
+		"domain": "example.com",
+		"xprivkey": {"file": "` + keyFile + `"},
+		"domainKey": {"env": "MOONBEAM_TEST_DOMAIN_KEY"},
+		"domainKeyPrevious": "inline-key"
+	}]}`
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	dcs, err := loadDomains(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc := dcs[0]
+	if dc.XPrivKey.Value != "xprv-from-file" ||
+		dc.DomainKey.Value != "key-from-env" ||
+		dc.DomainKeyPrevious.Value != "inline-key" {
+		t.Errorf("Unexpected secrets: %+v", dc)
+	}
+
+	os.Unsetenv("MOONBEAM_TEST_DOMAIN_KEY")
+	if _, err := loadDomains(path); err == nil {
+		t.Errorf("Expected error for unset environment variable")
+	}
+}
+
+func TestDomainDocument(t *testing.T) {
+	k, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc := DomainConfig{Domain: "example.com", ExternalURL: "https://mb.example.com"}
+	ds := &DomainState{Config: dc, DomainKeys: []*btcec.PrivateKey{k}}
+
+	t0 := time.Unix(1500000000, 0).Truncate(documentPeriod)
+	d1, err := ds.document(t0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d1.Expires != t0.Add(2*documentPeriod).Unix() {
+		t.Errorf("Unexpected expiry %d", d1.Expires)
+	}
+
+	// Servers signing at different times within a period agree.
+	other, err := domainDocument(dc, ds.DomainKeys, t0.Add(documentPeriod-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Expires != d1.Expires {
+		t.Errorf("Expected the same expiry within a period")
+	}
+	if d, _ := ds.document(t0.Add(time.Hour)); d != d1 {
+		t.Errorf("Expected document to be reused within a period")
+	}
+
+	d2, err := ds.document(t0.Add(documentPeriod))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d2.Expires != d1.Expires+int64(documentPeriod/time.Second) {
+		t.Errorf("Expected document to be signed again, got expiry %d", d2.Expires)
+	}
+}
+
+func TestOpenChannelOfOtherDomain(t *testing.T) {
+	ss, dir, cleanup := newTestServerState(t, nil,
+		DomainConfig{Domain: "example.com"},
+		DomainConfig{Domain: "example.org"})
+	defer cleanup()
+	ss.Limits = &rpcLimits{routes: map[string]*limiter{}}
+
+	// The channel was opened through example.com.
+	db := filesystem.NewFilesystemStorage(filepath.Join(dir, "example.com.json"))
+	if err := db.Create(storage.Record{ID: testTxID + "-0"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"txid":"` + testTxID + `","vout":0}`
+	r := httptest.NewRequest("POST", rpcPath+"/open/"+testTxID+"-0", strings.NewReader(body))
+	r.Host = "example.org"
+	w := httptest.NewRecorder()
+	rpcHandler(ss, w, r)
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected 409, got %d: %s", w.Code, w.Body.String())
+	}
+	if ss.Domains[1].Receiver.Get(testTxID, 0) != nil {
+		t.Errorf("Expected example.org not to store the channel")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/luno/moonbeam/logging"
+)
+
+var maxTipAge = flag.Duration("max_tip_age", 2*time.Hour, "Report not ready when bitcoind's best block is older than this, zero disables the check")
+var maxWatchAge = flag.Duration("max_watch_age", 5*time.Minute, "Report unhealthy when the blockchain watcher hasn't completed a run for this long")
+
+// startTime gives the watchers time for their first run before they are
+// reported as stuck.
+var startTime = time.Now()
+
+type healthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// writeHealth writes the result of the checks. Failures are logged but not
+// exposed since the endpoints are public.
+func writeHealth(w http.ResponseWriter, route string, checks map[string]error) {
+	resp := healthResponse{Status: "ok", Checks: make(map[string]string)}
+	status := http.StatusOK
+	for name, err := range checks {
+		if err == nil {
+			resp.Checks[name] = "ok"
+			continue
+		}
+		logger.Log(logging.Warn, "health check failed", logging.Fields{
+			"route": route,
+			"check": name,
+			"error": err,
+		})
+		resp.Checks[name] = "fail"
+		resp.Status = "fail"
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func checkRecent(what string, t time.Time, maxAge time.Duration) error {
+	if t.IsZero() {
+		if time.Since(startTime) < maxAge {
+			return nil
+		}
+		return errors.New(what + " never happened")
+	}
+	if age := time.Since(t); age > maxAge {
+		return fmt.Errorf("last %s was %s ago", what, age)
+	}
+	return nil
+}
+
+// healthzHandler reports whether the process is alive, i.e. whether the
+// blockchain watchers are still running. Errors from the chain backend don't
+// fail it since restarting won't fix them.
+func healthzHandler(ss *ServerState, w http.ResponseWriter, r *http.Request) {
+	checks := make(map[string]error)
+	for _, d := range ss.Domains {
+		lastRun, _ := d.Receiver.WatcherStatus()
+		checks["watcher:"+d.Config.Domain] = checkRecent("watcher run", lastRun, *maxWatchAge)
+	}
+	writeHealth(w, "healthz", checks)
+}
+
+// readyzHandler reports whether the server can accept payments: storage is
+// readable and writable, bitcoind is reachable and synced, and the watchers
+// have recently checked the channels.
+func readyzHandler(ss *ServerState, w http.ResponseWriter, r *http.Request) {
+	checks := make(map[string]error)
+
+	var chainErr error
+	if len(ss.Domains) > 0 {
+		_, tipTime, err := ss.Domains[0].Receiver.ChainTip()
+		chainErr = err
+		if err == nil && *maxTipAge > 0 {
+			if age := time.Since(tipTime); age > *maxTipAge {
+				chainErr = fmt.Errorf("best block is %s old", age)
+			}
+		}
+	}
+	checks["bitcoind"] = chainErr
+
+	for _, d := range ss.Domains {
+		checks["storage:"+d.Config.Domain] = d.Receiver.CheckStorage()
+
+		_, lastSuccess := d.Receiver.WatcherStatus()
+		checks["watcher:"+d.Config.Domain] = checkRecent("successful watcher run", lastSuccess, *maxWatchAge)
+	}
+
+	writeHealth(w, "readyz", checks)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcrpcclient"
+)
+
+const testBlockHash = "000000000000000000024bead8df69990852c202db0e0097c1a12ea637d7e96d"
+
+// fakeBitcoind serves the JSON-RPC calls used by the health checks.
+type fakeBitcoind struct {
+	mu      sync.Mutex
+	tipTime time.Time
+	down    bool
+}
+
+func (b *fakeBitcoind) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Method string          `json:"method"`
+		ID     json.RawMessage `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.down {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	var result interface{}
+	switch req.Method {
+	case "getbestblockhash":
+		result = testBlockHash
+	case "getblockheader":
+		result = map[string]interface{}{
+			"hash":   testBlockHash,
+			"height": 500000,
+			"time":   b.tipTime.Unix(),
+		}
+	default:
+		http.Error(w, "unknown method", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"result": result,
+		"error":  nil,
+		"id":     req.ID,
+	})
+}
+
+func (b *fakeBitcoind) set(tipTime time.Time, down bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tipTime, b.down = tipTime, down
+}
+
+func newFakeBitcoind(t *testing.T) (*fakeBitcoind, *btcrpcclient.Client, func()) {
+	fb := &fakeBitcoind{tipTime: time.Now()}
+	srv := httptest.NewServer(fb)
+	bc, err := btcrpcclient.New(&btcrpcclient.ConnConfig{
+		Host:         strings.TrimPrefix(srv.URL, "http://"),
+		User:         "user",
+		Pass:         "pass",
+		HTTPPostMode: true,
+		DisableTLS:   true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fb, bc, func() {
+		bc.Shutdown()
+		srv.Close()
+	}
+}
+
+func getHealth(t *testing.T, ss *ServerState, h func(*ServerState, http.ResponseWriter, *http.Request)) (int, healthResponse) {
+	w := httptest.NewRecorder()
+	h(ss, w, httptest.NewRequest("GET", "/readyz", nil))
+	var resp healthResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, resp
+}
+
+func TestReadyz(t *testing.T) {
+	fb, bc, stop := newFakeBitcoind(t)
+	defer stop()
+
+	ss, dir, cleanup := newTestServerState(t, bc,
+		DomainConfig{Domain: "example.com"},
+		DomainConfig{Domain: "example.org"})
+	defer cleanup()
+
+	defer func(tip, watch time.Duration) {
+		*maxTipAge, *maxWatchAge = tip, watch
+	}(*maxTipAge, *maxWatchAge)
+	*maxTipAge = time.Hour
+	// The watchers haven't run yet, which is fine shortly after starting.
+	*maxWatchAge = time.Since(startTime) + time.Hour
+
+	tests := []struct {
+		name   string
+		setup  func()
+		failed []string
+	}{
+		{"ok", func() {}, nil},
+		{"bitcoind down", func() { fb.set(time.Now(), true) }, []string{"bitcoind"}},
+		{"bitcoind not synced", func() { fb.set(time.Now().Add(-2*time.Hour), false) }, []string{"bitcoind"}},
+		{"storage", func() {
+			fb.set(time.Now(), false)
+			err := ioutil.WriteFile(filepath.Join(dir, "example.org.json"), []byte("garbage"), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"storage:example.org"}},
+		{"watcher stale", func() {
+			if err := ioutil.WriteFile(filepath.Join(dir, "example.org.json"), []byte("{}"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			*maxWatchAge = time.Nanosecond
+		}, []string{"watcher:example.com", "watcher:example.org"}},
+	}
+	for _, test := range tests {
+		test.setup()
+		code, resp := getHealth(t, ss, readyzHandler)
+
+		expCode, expStatus := http.StatusOK, "ok"
+		if len(test.failed) > 0 {
+			expCode, expStatus = http.StatusServiceUnavailable, "fail"
+		}
+		if code != expCode || resp.Status != expStatus {
+			t.Errorf("%s: unexpected response %d %+v", test.name, code, resp)
+		}
+
+		failed := make(map[string]bool)
+		for _, name := range test.failed {
+			failed[name] = true
+		}
+		for _, name := range []string{"bitcoind", "storage:example.com", "storage:example.org",
+			"watcher:example.com", "watcher:example.org"} {
+			exp := "ok"
+			if failed[name] {
+				exp = "fail"
+			}
+			if resp.Checks[name] != exp {
+				t.Errorf("%s: expected %s to be %s, got %q", test.name, name, exp, resp.Checks[name])
+			}
+		}
+	}
+
+	// Liveness only depends on the watchers.
+	fb.set(time.Now(), true)
+	*maxWatchAge = time.Since(startTime) + time.Hour
+	if code, resp := getHealth(t, ss, healthzHandler); code != http.StatusOK {
+		t.Errorf("Unexpected healthz response %d %+v", code, resp)
+	}
+}
+
+func TestCheckRecent(t *testing.T) {
+	if err := checkRecent("run", time.Now().Add(-time.Minute), time.Hour); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := checkRecent("run", time.Now().Add(-2*time.Hour), time.Hour); err == nil {
+		t.Errorf("Expected error for old run")
+	}
+	if err := checkRecent("run", time.Time{}, time.Since(startTime)+time.Hour); err != nil {
+		t.Errorf("Expected grace period after start, got %v", err)
+	}
+	if err := checkRecent("run", time.Time{}, time.Nanosecond); err == nil {
+		t.Errorf("Expected error when never run")
+	}
+}
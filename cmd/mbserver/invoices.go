@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/luno/moonbeam/address"
+	"github.com/luno/moonbeam/models"
+	"github.com/luno/moonbeam/storage"
+)
+
+// AdminInvoiceRequest is the body of POST /admin/invoices.
+type AdminInvoiceRequest struct {
+	Target string `json:"target"`
+	Amount int64  `json:"amount"`
+	Memo   string `json:"memo"`
+
+	// TTL is the lifetime of the invoice in seconds, zero for the default.
+	TTL int64 `json:"ttl"`
+}
+
+// AdminInvoice is an invoice as returned by the admin API.
+type AdminInvoice struct {
+	Invoice models.Invoice `json:"invoice"`
+	Domain  string         `json:"domain"`
+	URI     string         `json:"uri"`
+	Created time.Time      `json:"created"`
+	PaidBy  string         `json:"paidBy,omitempty"`
+	PaidAt  *time.Time     `json:"paidAt,omitempty"`
+}
+
+func newAdminInvoice(d *DomainState, rec storage.InvoiceRecord) AdminInvoice {
+	ai := AdminInvoice{
+		Invoice: rec.Invoice,
+		Domain:  d.Config.Domain,
+		Created: rec.Created,
+		PaidBy:  rec.PaidBy,
+	}
+	if rec.PaidBy != "" {
+		ai.PaidAt = &rec.PaidAt
+	}
+	if a, err := address.Parse(rec.Invoice.Target, nil); err == nil {
+		u := address.URI{
+			Address: a,
+			Amount:  rec.Invoice.Amount,
+			Memo:    rec.Invoice.Memo,
+			Invoice: rec.Invoice.ID,
+			Expires: time.Unix(rec.Invoice.Expires, 0),
+		}
+		ai.URI = u.String()
+	}
+	return ai
+}
+
+// forDomain returns the state of the named domain, if it's served.
+func (s *ServerState) forDomain(domain string) *DomainState {
+	for _, d := range s.Domains {
+		if d.Config.Domain == domain {
+			return d
+		}
+	}
+	return nil
+}
+
+// forInvoice returns the domain that issued the invoice, if any.
+func (s *ServerState) forInvoice(id string) (*DomainState, *storage.InvoiceRecord, error) {
+	for _, d := range s.Domains {
+		rec, err := d.Receiver.Invoice(id)
+		if err == storage.ErrInvoiceNotFound {
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		return d, rec, nil
+	}
+	return nil, nil, storage.ErrInvoiceNotFound
+}
+
+func adminCreateInvoiceHandler(ss *ServerState, w http.ResponseWriter, r *http.Request) {
+	var req AdminInvoiceRequest
+	if !parse(w, r, &req) {
+		return
+	}
+
+	a, err := address.Parse(req.Target, getnet())
+	if err != nil {
+		writeError(w, http.StatusBadRequest,
+			models.ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	d := ss.forDomain(a.Domain)
+	if d == nil {
+		writeError(w, http.StatusBadRequest,
+			models.ErrCodeUnknownTarget, "address is for a different domain")
+		return
+	}
+
+	ttl := time.Duration(req.TTL) * time.Second
+	inv, err := d.Receiver.CreateInvoice(a.String(), req.Amount, req.Memo, ttl)
+	if err != nil {
+		adminRespond(w, nil, err)
+		return
+	}
+	adminRespond(w, newAdminInvoice(d, storage.InvoiceRecord{
+		Invoice: *inv,
+		Created: time.Now(),
+	}), nil)
+}
+
+func adminListInvoicesHandler(ss *ServerState, w http.ResponseWriter, r *http.Request) {
+	list := []AdminInvoice{}
+	for _, d := range ss.Domains {
+		recs, err := d.Receiver.ListInvoices()
+		if err != nil {
+			adminError(w, err)
+			return
+		}
+		for _, rec := range recs {
+			list = append(list, newAdminInvoice(d, rec))
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.After(list[j].Created)
+	})
+
+	adminRespond(w, list, nil)
+}
+
+func adminInvoiceHandler(ss *ServerState, w http.ResponseWriter, id string) {
+	d, rec, err := ss.forInvoice(id)
+	if err == storage.ErrInvoiceNotFound {
+		writeError(w, http.StatusNotFound,
+			models.ErrCodeInvalidInvoice, "invoice not found")
+		return
+	}
+	if err != nil {
+		adminError(w, err)
+		return
+	}
+	adminRespond(w, newAdminInvoice(d, *rec), nil)
+}
+
+// adminInvoicesHandler serves:
+//
+//	GET  /admin/invoices
+//	POST /admin/invoices
+//	GET  /admin/invoices/<id>
+func adminInvoicesHandler(ss *ServerState, w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) > 2 {
+		writeError(w, http.StatusNotFound,
+			models.ErrCodeInvalidRequest, "not found")
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		adminListInvoicesHandler(ss, w, r)
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		adminCreateInvoiceHandler(ss, w, r)
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		adminInvoiceHandler(ss, w, parts[1])
+	default:
+		writeError(w, http.StatusMethodNotAllowed,
+			models.ErrCodeInvalidRequest, "method not allowed")
+	}
+}
+
+// rpcInvoiceHandler lets senders fetch a signed invoice before paying it.
+func rpcInvoiceHandler(ss *ServerState, w http.ResponseWriter, r *http.Request, id string) {
+	_, rec, err := ss.forInvoice(id)
+	if err == storage.ErrInvoiceNotFound {
+		writeError(w, http.StatusNotFound,
+			models.ErrCodeInvalidInvoice, "invoice not found")
+		return
+	}
+	if err != nil {
+		respond(w, r, nil, err)
+		return
+	}
+	respond(w, r, rec.Invoice, nil)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "moonbeam_rpc_duration_seconds",
+	Help: "Latency of RPC requests, by route and HTTP status code.",
+}, []string{"route", "code"})
+
+func init() {
+	prometheus.MustRegister(rpcDuration)
+}
+
+var rpcRoutes = map[string]bool{
+	"create":   true,
+	"open":     true,
+	"validate": true,
+	"send":     true,
+	"close":    true,
+	"status":   true,
+	"refresh":  true,
+	"invoice":  true,
+}
+
+// rpcRoute returns the route of an RPC request without the channel ID to
+// keep the number of label values bounded.
+func rpcRoute(path string) string {
+	path = strings.TrimPrefix(path, rpcPath+"/")
+	if i := strings.Index(path, "/"); i >= 0 {
+		path = path[:i]
+	}
+	if !rpcRoutes[path] {
+		return "other"
+	}
+	return path
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func instrumentRPC(h func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(sw, r)
+		rpcDuration.WithLabelValues(rpcRoute(r.URL.Path), strconv.Itoa(sw.status)).
+			Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luno/moonbeam/models"
+)
+
+var rateLimitIP = flag.Int("rate_limit_ip", 300, "RPC requests allowed per minute per client IP, zero disables the limit")
+var rateLimitChannel = flag.Int("rate_limit_channel", 600, "RPC requests allowed per minute per channel ID, zero disables the limit")
+var rateLimitRoutes = flag.String("rate_limit_routes", "create:10,open:30,refresh:10", "RPC requests allowed per minute per client IP for individual routes, as route:limit pairs")
+var trustProxy = flag.Bool("trust_proxy", false, "Take the client IP from the X-Forwarded-For header set by a reverse proxy")
+var maxBodyBytes = flag.Int64("max_body_bytes", 256<<10, "Maximum size of RPC request bodies")
+var httpReadTimeout = flag.Duration("http_read_timeout", 30*time.Second, "Maximum duration for reading a request")
+var httpWriteTimeout = flag.Duration("http_write_timeout", 30*time.Second, "Maximum duration for writing a response")
+var httpIdleTimeout = flag.Duration("http_idle_timeout", 2*time.Minute, "Maximum duration to keep idle connections open")
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter is a set of token buckets, one per key. Each bucket holds up to
+// burst tokens and is refilled at rate tokens per second.
+type limiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	pruned  time.Time
+}
+
+func newLimiter(perMinute int) *limiter {
+	return &limiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(perMinute),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// refill brings the key's bucket up to date and returns how long until it
+// holds a token, which is zero if it holds one already. l.mu must be held.
+func (l *limiter) refill(key string, now time.Time) time.Duration {
+	l.prune(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	return 0
+}
+
+// wait returns how long until the key's bucket holds a token, without
+// taking it.
+func (l *limiter) wait(key string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.refill(key, now)
+}
+
+// add adds n tokens to the key's bucket, which may be negative to take
+// tokens. The bucket is still capped at burst.
+func (l *limiter) add(key string, n float64, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(key, now)
+	b := l.buckets[key]
+	b.tokens += n
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+}
+
+// prune forgets buckets that have refilled completely since they behave
+// the same as new ones.
+func (l *limiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < time.Minute {
+		return
+	}
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for k, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, k)
+		}
+	}
+	l.pruned = now
+}
+
+// rpcLimits holds the rate limiters of the RPC server. Nil limiters are
+// disabled.
+type rpcLimits struct {
+	ip      *limiter
+	channel *limiter
+	routes  map[string]*limiter
+
+	// mu makes taking tokens from several limiters atomic.
+	mu sync.Mutex
+}
+
+func parseRouteLimits(s string) (map[string]*limiter, error) {
+	routes := make(map[string]*limiter)
+	if s == "" {
+		return routes, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		i := strings.Index(pair, ":")
+		if i < 0 {
+			return nil, errors.New("invalid route limit " + pair)
+		}
+		route := strings.TrimSpace(pair[:i])
+		if !rpcRoutes[route] {
+			return nil, errors.New("unknown route " + route)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(pair[i+1:]))
+		if err != nil || n < 0 {
+			return nil, errors.New("invalid route limit " + pair)
+		}
+		if n > 0 {
+			routes[route] = newLimiter(n)
+		}
+	}
+	return routes, nil
+}
+
+func newRPCLimits() (*rpcLimits, error) {
+	routes, err := parseRouteLimits(*rateLimitRoutes)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &rpcLimits{routes: routes}
+	if *rateLimitIP > 0 {
+		l.ip = newLimiter(*rateLimitIP)
+	}
+	if *rateLimitChannel > 0 {
+		l.channel = newLimiter(*rateLimitChannel)
+	}
+	return l, nil
+}
+
+func clientIP(r *http.Request) string {
+	if *trustProxy {
+		// The last address is the one added by our proxy.
+		fwd := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		if ip := strings.TrimSpace(fwd[len(fwd)-1]); ip != "" {
+			return ip
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+type limitCheck struct {
+	l   *limiter
+	key string
+}
+
+// ipChecks returns the limits applied to every request for the route by
+// the client's IP.
+func (l *rpcLimits) ipChecks(r *http.Request, route string) []limitCheck {
+	ip := clientIP(r)
+	return []limitCheck{
+		{l.ip, ip},
+		{l.routes[route], ip},
+	}
+}
+
+// check applies the limits of the client's IP to a request for the route.
+// If a limit is exceeded, it writes the error response and returns false.
+func (l *rpcLimits) check(w http.ResponseWriter, r *http.Request, route string) bool {
+	return l.apply(w, l.ipChecks(r, route)...)
+}
+
+// checkChannel applies the limit of the channel to a request that passed
+// check. It must only be called once the request is authenticated for the
+// channel, otherwise anyone could use up the channel's limit. If the limit
+// is exceeded, the tokens taken by check are returned.
+func (l *rpcLimits) checkChannel(w http.ResponseWriter, r *http.Request, route, channelID string) bool {
+	if l.apply(w, limitCheck{l.channel, channelID}) {
+		return true
+	}
+	now := time.Now()
+	for _, c := range l.ipChecks(r, route) {
+		if c.l != nil {
+			c.l.add(c.key, 1, now)
+		}
+	}
+	return false
+}
+
+// apply takes a token for each check, or none if any limit is exceeded. In
+// that case it writes the error response and returns false.
+func (l *rpcLimits) apply(w http.ResponseWriter, checks ...limitCheck) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	for _, c := range checks {
+		if c.l == nil {
+			continue
+		}
+		if d := c.l.wait(c.key, now); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		secs := int(wait/time.Second) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+		writeError(w, http.StatusTooManyRequests,
+			models.ErrCodeRateLimited, "rate limit exceeded")
+		return false
+	}
+
+	for _, c := range checks {
+		if c.l != nil {
+			c.l.add(c.key, -1, now)
+		}
+	}
+	return true
+}
+
+// newServer returns an HTTP server with the configured timeouts.
+func newServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         addr,
+		Handler:      h,
+		ReadTimeout:  *httpReadTimeout,
+		WriteTimeout: *httpWriteTimeout,
+		IdleTimeout:  *httpIdleTimeout,
+	}
+}
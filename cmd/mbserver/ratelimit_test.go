@@ -0,0 +1,202 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// take takes a token from the key's bucket if it has one.
+func take(l *limiter, key string, now time.Time) bool {
+	if l.wait(key, now) > 0 {
+		return false
+	}
+	l.add(key, -1, now)
+	return true
+}
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(60)
+	t0 := time.Now()
+
+	for i := 0; i < 60; i++ {
+		if !take(l, "a", t0) {
+			t.Fatalf("Expected burst of 60, denied after %d", i)
+		}
+	}
+	if take(l, "a", t0) {
+		t.Errorf("Expected empty bucket")
+	}
+	if d := l.wait("a", t0); d != time.Second {
+		t.Errorf("Expected wait of 1s, got %v", d)
+	}
+	if d := l.wait("a", t0.Add(500*time.Millisecond)); d != 500*time.Millisecond {
+		t.Errorf("Expected wait of 500ms, got %v", d)
+	}
+
+	// Buckets refill at the rate and are independent.
+	if !take(l, "a", t0.Add(time.Second)) {
+		t.Errorf("Expected token after refill")
+	}
+	if take(l, "a", t0.Add(time.Second)) {
+		t.Errorf("Expected only one token after 1s")
+	}
+	if !take(l, "b", t0.Add(time.Second)) {
+		t.Errorf("Expected other key to be independent")
+	}
+
+	// Refills and refunds are capped at the burst.
+	t1 := t0.Add(time.Hour)
+	l.add("a", 10, t1)
+	n := 0
+	for take(l, "a", t1) {
+		n++
+	}
+	if n != 60 {
+		t.Errorf("Expected bucket to be capped at 60, got %d", n)
+	}
+}
+
+func TestLimiterPrune(t *testing.T) {
+	l := newLimiter(60)
+	t0 := time.Now()
+
+	take(l, "a", t0)
+	take(l, "b", t0.Add(30*time.Second))
+	if len(l.buckets) != 2 {
+		t.Fatalf("Expected 2 buckets, got %d", len(l.buckets))
+	}
+
+	// Pruning runs at most once a minute and only forgets full buckets.
+	take(l, "c", t0.Add(59*time.Second))
+	if len(l.buckets) != 3 {
+		t.Errorf("Expected no pruning within a minute, got %d buckets", len(l.buckets))
+	}
+	take(l, "c", t0.Add(61*time.Second))
+	if _, ok := l.buckets["a"]; ok {
+		t.Errorf("Expected full bucket to be pruned")
+	}
+	if len(l.buckets) != 2 {
+		t.Errorf("Expected 2 buckets, got %d", len(l.buckets))
+	}
+}
+
+func TestParseRouteLimits(t *testing.T) {
+	routes, err := parseRouteLimits(" create:10, open : 30,refresh:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 || routes["create"].burst != 10 || routes["open"].burst != 30 {
+		t.Errorf("Unexpected routes: %v", routes)
+	}
+
+	routes, err = parseRouteLimits("")
+	if err != nil || len(routes) != 0 {
+		t.Errorf("Unexpected result for empty limits: %v %v", routes, err)
+	}
+
+	for _, s := range []string{"create", "bogus:1", "create:x", "create:-1", "create:1,"} {
+		if _, err := parseRouteLimits(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer func(v bool) { *trustProxy = v }(*trustProxy)
+
+	tests := []struct {
+		trust  bool
+		remote string
+		fwd    string
+		ip     string
+	}{
+		{false, "192.0.2.1:5678", "", "192.0.2.1"},
+		{false, "192.0.2.1:5678", "198.51.100.1", "192.0.2.1"},
+		{false, "[2001:db8::1]:5678", "", "2001:db8::1"},
+		{false, "192.0.2.1", "", "192.0.2.1"},
+		{true, "192.0.2.1:5678", "198.51.100.1, 203.0.113.1", "203.0.113.1"},
+		{true, "192.0.2.1:5678", "", "192.0.2.1"},
+	}
+	for _, test := range tests {
+		*trustProxy = test.trust
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remote
+		if test.fwd != "" {
+			r.Header.Set("X-Forwarded-For", test.fwd)
+		}
+		if ip := clientIP(r); ip != test.ip {
+			t.Errorf("%s %q: expected %s, got %s", test.remote, test.fwd, test.ip, ip)
+		}
+	}
+}
+
+func TestRPCLimits(t *testing.T) {
+	l := &rpcLimits{
+		ip:      newLimiter(3),
+		channel: newLimiter(1),
+		routes:  map[string]*limiter{"create": newLimiter(1)},
+	}
+	r := httptest.NewRequest("POST", "/", nil)
+	r.RemoteAddr = "192.0.2.1:5678"
+	ip := "192.0.2.1"
+
+	tokens := func(l *limiter, key string) int {
+		l.wait(key, time.Now())
+		return int(l.buckets[key].tokens)
+	}
+	allowed := func(ok bool, w *httptest.ResponseRecorder) bool {
+		if !ok && (w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "") {
+			t.Errorf("Unexpected response: %d", w.Code)
+		}
+		return ok
+	}
+
+	if !l.check(httptest.NewRecorder(), r, "create") {
+		t.Fatalf("Expected create to be allowed")
+	}
+	// Denied by the route limit, which mustn't take a token from the IP.
+	w := httptest.NewRecorder()
+	if allowed(l.check(w, r, "create"), w) {
+		t.Errorf("Expected create to be rate limited")
+	}
+	if n := tokens(l.ip, ip); n != 2 {
+		t.Errorf("Expected 2 IP tokens, got %d", n)
+	}
+
+	if !l.check(httptest.NewRecorder(), r, "send") ||
+		!l.checkChannel(httptest.NewRecorder(), r, "send", "a-0") {
+		t.Fatalf("Expected send to be allowed")
+	}
+	// Denied by the channel limit, which returns the IP token.
+	if !l.check(httptest.NewRecorder(), r, "send") {
+		t.Fatalf("Expected IP limit to allow send")
+	}
+	w = httptest.NewRecorder()
+	if allowed(l.checkChannel(w, r, "send", "a-0"), w) {
+		t.Errorf("Expected send to be rate limited by channel")
+	}
+	if n := tokens(l.ip, ip); n != 1 {
+		t.Errorf("Expected 1 IP token, got %d", n)
+	}
+}
+
+func TestRPCChannelLimitAfterAuth(t *testing.T) {
+	ss, _, cleanup := newTestServerState(t, nil, DomainConfig{Domain: "example.com"})
+	defer cleanup()
+	ss.Limits = &rpcLimits{channel: newLimiter(1), routes: map[string]*limiter{}}
+
+	// Unauthenticated requests can't use up the channel's limit.
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", rpcPath+"/send/"+testTxID+"-0", nil)
+		rpcHandler(ss, w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected 401, got %d", w.Code)
+		}
+	}
+	if len(ss.Limits.channel.buckets) != 0 {
+		t.Errorf("Expected channel limit to be untouched")
+	}
+}
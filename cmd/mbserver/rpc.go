@@ -1,34 +1,66 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
 
+	"github.com/luno/moonbeam/logging"
 	"github.com/luno/moonbeam/models"
 	"github.com/luno/moonbeam/receiver"
 )
 
-var debugServerRPC = flag.Bool(
-	"debug_server_rpc", false, "Log server RPC requests and responses")
+var authMode = flag.String("auth_mode", "any",
+	"How channel RPCs are authenticated: token, signature or any")
+
+// writeError writes an error response with a models.Error body.
+func writeError(w http.ResponseWriter, status int, code models.ErrorCode, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(models.Error{Code: code, Message: msg})
+	if err != nil {
+		logger.Log(logging.Error, "json encode error",
+			logging.Fields{"error": err})
+	}
+}
+
+func errorStatus(code models.ErrorCode) int {
+	switch code {
+	case models.ErrCodeInternal:
+		return http.StatusInternalServerError
+	case models.ErrCodeUnauthorized:
+		return http.StatusUnauthorized
+	case models.ErrCodeChannelNotFound:
+		return http.StatusNotFound
+	case models.ErrCodeChannelBusy, models.ErrCodeConcurrentUpdate:
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
 
 func parse(w http.ResponseWriter, r *http.Request, req interface{}) bool {
 	buf, err := ioutil.ReadAll(r.Body)
 	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge,
+			models.ErrCodeInvalidRequest, "request body too large or unreadable")
 		return false
 	}
 
-	if *debugServerRPC {
-		log.Printf("Request: %s", string(buf))
-	}
+	logger.Log(logging.Debug, "rpc request", logging.Fields{
+		"route": r.URL.Path,
+		"body":  logging.RedactJSON(buf),
+	})
 
 	if err := json.Unmarshal(buf, &req); err != nil {
-		http.Error(w, "json parse error", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest,
+			models.ErrCodeInvalidRequest, "json parse error")
 		return false
 	}
 	return true
@@ -69,51 +101,98 @@ func splitTxIDVout(txidvout string) (string, uint32, bool) {
 
 func checkID(w http.ResponseWriter, atxid string, avout uint32, btxid string, bvout uint32) bool {
 	if !(atxid == btxid && avout == bvout) {
-		http.Error(w, "URL doesn't match channel ID", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest,
+			models.ErrCodeInvalidRequest, "URL doesn't match channel ID")
 		return false
 	}
 	return true
 }
 
-func checkAuthToken(s *ServerState, r *http.Request, txid string, vout uint32) bool {
+func checkAuthToken(rc *receiver.Receiver, r *http.Request, txid string, vout uint32) bool {
 	h := r.Header.Get("Authorization")
 	const prefix = "Bearer "
 	if !strings.HasPrefix(h, prefix) {
 		return false
 	}
 	h = h[len(prefix):]
-	return s.Receiver.ValidateToken(txid, vout, h)
+	return rc.ValidateToken(txid, vout, h)
 }
 
-func respond(w http.ResponseWriter, r *http.Request, resp interface{}, err error) {
+// checkRequestSig verifies a request signed with the sender's channel key.
+// The body is buffered so that it can still be parsed afterwards.
+func checkRequestSig(rc *receiver.Receiver, r *http.Request, route string, txid string, vout uint32) bool {
+	h := r.Header.Get("Authorization")
+	prefix := models.SigAuthScheme + " "
+	if !strings.HasPrefix(h, prefix) {
+		return false
+	}
+	sig, err := base64.StdEncoding.DecodeString(h[len(prefix):])
+	if err != nil {
+		return false
+	}
+	ts, err := strconv.ParseInt(r.Header.Get(models.TimestampHeader), 10, 64)
+	if err != nil {
+		return false
+	}
+	nonce := r.Header.Get(models.NonceHeader)
+
+	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		if *debugServerRPC {
-			log.Printf("error: %v", err)
+		return false
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return rc.ValidateRequestSig(txid, vout, r.Method, route, ts, nonce, body, sig)
+}
+
+func checkAuth(rc *receiver.Receiver, r *http.Request, route string, txid string, vout uint32) bool {
+	isSig := strings.HasPrefix(r.Header.Get("Authorization"), models.SigAuthScheme+" ")
+	switch *authMode {
+	case "token":
+		return !isSig && checkAuthToken(rc, r, txid, vout)
+	case "signature":
+		return isSig && checkRequestSig(rc, r, route, txid, vout)
+	default:
+		if isSig {
+			return checkRequestSig(rc, r, route, txid, vout)
 		}
+		return checkAuthToken(rc, r, txid, vout)
+	}
+}
 
-		if ee, ok := err.(receiver.ExposableError); ok {
-			http.Error(w, ee.Error(), http.StatusBadRequest)
-		} else {
-			http.Error(w, "error", http.StatusInternalServerError)
+func respond(w http.ResponseWriter, r *http.Request, resp interface{}, err error) {
+	if err != nil {
+		me := receiver.ToModelError(err)
+		level := logging.Debug
+		if me.Code == models.ErrCodeInternal {
+			level = logging.Error
 		}
+		logger.Log(level, "rpc error", logging.Fields{
+			"route": r.URL.Path,
+			"code":  me.Code,
+			"error": err,
+		})
+
+		writeError(w, errorStatus(me.Code), me.Code, me.Message)
 	} else {
 		err := json.NewEncoder(w).Encode(resp)
 		if err != nil {
-			log.Printf("json encode error: %v", err)
+			logger.Log(logging.Error, "json encode error",
+				logging.Fields{"error": err})
 		}
 	}
 }
 
-func rpcCreateHandler(s *ServerState, w http.ResponseWriter, r *http.Request) {
+func rpcCreateHandler(rc *receiver.Receiver, w http.ResponseWriter, r *http.Request) {
 	var req models.CreateRequest
 	if !parse(w, r, &req) {
 		return
 	}
-	resp, err := s.Receiver.Create(req)
+	resp, err := rc.Create(req)
 	respond(w, r, resp, err)
 }
 
-func rpcOpenHandler(s *ServerState, w http.ResponseWriter, r *http.Request, txid string, vout uint32) {
+func rpcOpenHandler(rc *receiver.Receiver, w http.ResponseWriter, r *http.Request, txid string, vout uint32) {
 	var req models.OpenRequest
 	if !parse(w, r, &req) {
 		return
@@ -121,11 +200,11 @@ func rpcOpenHandler(s *ServerState, w http.ResponseWriter, r *http.Request, txid
 	if !checkID(w, txid, vout, req.TxID, req.Vout) {
 		return
 	}
-	resp, err := s.Receiver.Open(req)
+	resp, err := rc.Open(req)
 	respond(w, r, resp, err)
 }
 
-func rpcValidateHandler(s *ServerState, w http.ResponseWriter, r *http.Request, txid string, vout uint32) {
+func rpcValidateHandler(rc *receiver.Receiver, w http.ResponseWriter, r *http.Request, txid string, vout uint32) {
 	var req models.ValidateRequest
 	if !parse(w, r, &req) {
 		return
@@ -133,11 +212,11 @@ func rpcValidateHandler(s *ServerState, w http.ResponseWriter, r *http.Request,
 	if !checkID(w, txid, vout, req.TxID, req.Vout) {
 		return
 	}
-	resp, err := s.Receiver.Validate(req)
+	resp, err := rc.Validate(req)
 	respond(w, r, resp, err)
 }
 
-func rpcSendHandler(s *ServerState, w http.ResponseWriter, r *http.Request, txid string, vout uint32) {
+func rpcSendHandler(rc *receiver.Receiver, w http.ResponseWriter, r *http.Request, txid string, vout uint32) {
 	var req models.SendRequest
 	if !parse(w, r, &req) {
 		return
@@ -145,11 +224,11 @@ func rpcSendHandler(s *ServerState, w http.ResponseWriter, r *http.Request, txid
 	if !checkID(w, txid, vout, req.TxID, req.Vout) {
 		return
 	}
-	resp, err := s.Receiver.Send(req)
+	resp, err := rc.Send(req)
 	respond(w, r, resp, err)
 }
 
-func rpcCloseHandler(s *ServerState, w http.ResponseWriter, r *http.Request, txid string, vout uint32) {
+func rpcCloseHandler(rc *receiver.Receiver, w http.ResponseWriter, r *http.Request, txid string, vout uint32) {
 	var req models.CloseRequest
 	if !parse(w, r, &req) {
 		return
@@ -157,11 +236,11 @@ func rpcCloseHandler(s *ServerState, w http.ResponseWriter, r *http.Request, txi
 	if !checkID(w, txid, vout, req.TxID, req.Vout) {
 		return
 	}
-	resp, err := s.Receiver.Close(req)
+	resp, err := rc.Close(req)
 	respond(w, r, resp, err)
 }
 
-func rpcStatusHandler(s *ServerState, w http.ResponseWriter, r *http.Request, txid string, vout uint32) {
+func rpcStatusHandler(rc *receiver.Receiver, w http.ResponseWriter, r *http.Request, txid string, vout uint32) {
 	var req models.StatusRequest
 	if !parse(w, r, &req) {
 		return
@@ -169,60 +248,126 @@ func rpcStatusHandler(s *ServerState, w http.ResponseWriter, r *http.Request, tx
 	if !checkID(w, txid, vout, req.TxID, req.Vout) {
 		return
 	}
-	resp, err := s.Receiver.Status(req)
+	resp, err := rc.Status(req)
+	respond(w, r, resp, err)
+}
+
+func rpcRefreshHandler(rc *receiver.Receiver, w http.ResponseWriter, r *http.Request, txid string, vout uint32) {
+	var req models.RefreshRequest
+	if !parse(w, r, &req) {
+		return
+	}
+	if !checkID(w, txid, vout, req.TxID, req.Vout) {
+		return
+	}
+	resp, err := rc.Refresh(req)
 	respond(w, r, resp, err)
 }
 
 const rpcPath = "/moonbeamrpc"
 
 func rpcHandler(s *ServerState, w http.ResponseWriter, r *http.Request) {
-	if *debugServerRPC {
-		log.Printf("%s %s", r.Method, r.URL.Path)
-	}
+	logger.Log(logging.Debug, "rpc", logging.Fields{
+		"method": r.Method,
+		"route":  r.URL.Path,
+	})
+
+	// The body is read by parse, or checkRequestSig for signed requests.
+	r.Body = http.MaxBytesReader(w, r.Body, *maxBodyBytes)
 
 	if r.URL.Path == rpcPath+"/create" {
+		if !s.Limits.check(w, r, "create") {
+			return
+		}
 		if r.Method == http.MethodPost {
-			rpcCreateHandler(s, w, r)
+			rc := s.selectDomain(r, "", 0, "").Receiver
+			rpcCreateHandler(rc, w, r)
 			return
 		}
-		http.Error(w, "", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed,
+			models.ErrCodeInvalidRequest, "method not allowed")
 		return
 	}
 
 	path := strings.TrimPrefix(r.URL.Path, rpcPath+"/")
 
+	if strings.HasPrefix(path, "invoice/") {
+		if !s.Limits.check(w, r, "invoice") {
+			return
+		}
+		if r.Method == http.MethodGet {
+			rpcInvoiceHandler(s, w, r, strings.TrimPrefix(path, "invoice/"))
+			return
+		}
+		writeError(w, http.StatusMethodNotAllowed,
+			models.ErrCodeInvalidRequest, "method not allowed")
+		return
+	}
+
 	i := strings.Index(path, "/")
 	if i < 0 {
-		http.NotFound(w, r)
+		writeError(w, http.StatusNotFound,
+			models.ErrCodeInvalidRequest, "unknown call")
 		return
 	}
 	call := path[:i]
 	txid, vout, ok := splitTxIDVout(path[i+1:])
 	if !ok {
-		http.Error(w, "Invalid channel ID", http.StatusNotFound)
+		writeError(w, http.StatusNotFound,
+			models.ErrCodeInvalidRequest, "Invalid channel ID")
+		return
+	}
+
+	route := call
+	if !rpcRoutes[route] {
+		route = "other"
+	}
+	if !s.Limits.check(w, r, route) {
 		return
 	}
 
+	ds := s.selectDomain(r, txid, vout, "")
+	rc := ds.Receiver
+
 	if call == "open" {
-		rpcOpenHandler(s, w, r, txid, vout)
+		// Domains may share keys, so a channel opened by one domain must
+		// not be opened again by another or its capacity could be paid
+		// out twice.
+		s.openMu.Lock()
+		defer s.openMu.Unlock()
+		if d := s.forChannel(txid, vout); d != nil && d != ds {
+			writeError(w, http.StatusConflict, models.ErrCodeInvalidRequest,
+				"channel is already open for another domain")
+			return
+		}
+		rpcOpenHandler(rc, w, r, txid, vout)
+		return
+	}
+	if call == "refresh" {
+		rpcRefreshHandler(rc, w, r, txid, vout)
 		return
 	}
 
-	if !checkAuthToken(s, r, txid, vout) {
-		http.Error(w, "invalid auth token", http.StatusUnauthorized)
+	if !checkAuth(rc, r, "/"+path, txid, vout) {
+		writeError(w, http.StatusUnauthorized,
+			models.ErrCodeUnauthorized, "invalid auth token")
+		return
+	}
+	if !s.Limits.checkChannel(w, r, route, path[i+1:]) {
 		return
 	}
 
 	switch call {
 	case "validate":
-		rpcValidateHandler(s, w, r, txid, vout)
+		rpcValidateHandler(rc, w, r, txid, vout)
 	case "send":
-		rpcSendHandler(s, w, r, txid, vout)
+		rpcSendHandler(rc, w, r, txid, vout)
 	case "close":
-		rpcCloseHandler(s, w, r, txid, vout)
+		rpcCloseHandler(rc, w, r, txid, vout)
 	case "status":
-		rpcStatusHandler(s, w, r, txid, vout)
+		rpcStatusHandler(rc, w, r, txid, vout)
 	default:
-		http.Error(w, "", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed,
+			models.ErrCodeInvalidRequest, "unknown call")
 	}
 }
@@ -6,12 +6,18 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcrpcclient"
 	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/prometheus/client_golang/prometheus"
 
+	"github.com/luno/moonbeam/logging"
 	"github.com/luno/moonbeam/receiver"
 	"github.com/luno/moonbeam/resolver"
 	"github.com/luno/moonbeam/storage/filesystem"
@@ -26,9 +32,32 @@ var bitcoindPassword = flag.String("bitcoind_password", "password", "")
 var listenAddr = flag.String("listen", ":3211", "Address to listen on")
 var externalURL = flag.String("external_url", "https://example.com:3211", "External server URL")
 var domain = flag.String("domain", "example.com", "Domain to accept payments for")
+var directoryURL = flag.String("directory_url", "", "Account service URL used to check whether targets exist")
+var directoryFile = flag.String("directory_file", "", "File listing the targets that may receive payments")
+var distributedLock = flag.Bool("distributed_lock", false, "Lock channels with leases in storage shared between instances")
+var domainsConfig = flag.String("domains_config", "", "JSON file configuring multiple domains, overrides --domain")
 var tlsCert = flag.String("tls_cert", "tls/cert.pem", "TLS certificate")
 var tlsKey = flag.String("tls_key", "tls/key.pem", "TLS key")
 var authToken = flag.String("auth_token", "", "Secret used to issue auth tokens, generate with openssl rand -hex 32")
+var authTokenID = flag.String("auth_token_id", "1", "Key ID of --auth_token, change it when rotating the secret")
+var authTokenPrevious = flag.String("auth_token_previous", "", "Previous auth token secret that is still accepted")
+var authTokenPreviousID = flag.String("auth_token_previous_id", "", "Key ID of --auth_token_previous")
+var authTokenPreviousExpires = flag.String("auth_token_previous_expires", "", "RFC3339 time after which --auth_token_previous is no longer accepted")
+var authTokenTTL = flag.Duration("auth_token_ttl", 0, "Lifetime of issued auth tokens, zero means no expiry")
+var webhookURL = flag.String("webhook_url", "", "URL to POST channel and payment events to")
+var webhookSecret = flag.String("webhook_secret", "", "Secret used to sign webhook requests")
+var softTimeout = flag.Int("soft_timeout", 0, "Blocks after which open channels are closed, zero means the network's default")
+var fundingMinConf = flag.Int("funding_min_conf", 0, "Confirmations required to open a channel, zero means the network's default")
+var channelTimeout = flag.Int64("channel_timeout", 0, "Minimum channel timeout in blocks required from senders, zero means the default")
+var feeRate = flag.Int64("fee_rate", 0, "Minimum closure transaction fee rate in satoshis per byte required from senders, zero means the default")
+var storageBackend = flag.String("storage", "filesystem", "Storage backend")
+var storageDir = flag.String("storage_dir", ".", "Directory of the filesystem storage's state files")
+var domainKey = flag.String("domain_key", "", "Hex private key signing moonbeam.json, generate with openssl rand -hex 32")
+var domainKeyPrevious = flag.String("domain_key_previous", "", "Previous --domain_key that still signs moonbeam.json while senders move to the new key")
+var targetKeys = flag.String("target_keys", "", "File of WIF private keys used to prove ownership of targets in validate responses")
+var logLevel = flag.String("log_level", "info", "Minimum level to log: debug, info, warn or error")
+
+var logger logging.Logger = logging.NewStdLogger(logging.Info)
 
 func getnet() *chaincfg.Params {
 	if *testnet {
@@ -37,8 +66,8 @@ func getnet() *chaincfg.Params {
 	return &chaincfg.MainNetParams
 }
 
-func loadkey(net *chaincfg.Params) (*hdkeychain.ExtendedKey, error) {
-	ek, err := hdkeychain.NewKeyFromString(*xprivkey)
+func loadkey(net *chaincfg.Params, xprivkey string) (*hdkeychain.ExtendedKey, error) {
+	ek, err := hdkeychain.NewKeyFromString(xprivkey)
 	if err != nil {
 		return nil, err
 	}
@@ -63,15 +92,161 @@ func bitcoinClient() (*btcrpcclient.Client, error) {
 		return nil, err
 	}
 
-	blockCount, _ := bc.GetBlockCount()
-	log.Printf("Connected to bitcoind. Block count = %d", blockCount)
+	blockCount, err := bc.GetBlockCount()
+	if err != nil {
+		bc.Shutdown()
+		return nil, fmt.Errorf("connecting to bitcoind: %v", err)
+	}
+	logger.Log(logging.Info, "connected to bitcoind",
+		logging.Fields{"blockCount": blockCount})
 
 	return bc, nil
 }
 
+func getDirectory(net *chaincfg.Params, dc DomainConfig) (receiver.Directory, error) {
+	if dc.DirectoryURL != "" && dc.DirectoryFile != "" {
+		return nil, errors.New("only one of directory URL and file may be set")
+	}
+	if dc.DirectoryURL != "" {
+		return receiver.NewHTTPDirectory(net, dc.Domain, dc.DirectoryURL), nil
+	}
+	if dc.DirectoryFile != "" {
+		return receiver.NewFileDirectory(net, dc.Domain, dc.DirectoryFile), nil
+	}
+	return receiver.NewDomainDirectory(net, dc.Domain), nil
+}
+
+func getTokenKeys() ([]receiver.TokenKey, error) {
+	keys := []receiver.TokenKey{{ID: *authTokenID, Secret: []byte(*authToken)}}
+	if *authTokenPrevious == "" {
+		return keys, nil
+	}
+
+	if *authTokenPreviousID == "" || *authTokenPreviousID == *authTokenID {
+		return nil, errors.New("--auth_token_previous_id must be set and differ from --auth_token_id")
+	}
+	prev := receiver.TokenKey{ID: *authTokenPreviousID, Secret: []byte(*authTokenPrevious)}
+	if *authTokenPreviousExpires != "" {
+		t, err := time.Parse(time.RFC3339, *authTokenPreviousExpires)
+		if err != nil {
+			return nil, err
+		}
+		prev.Expires = t
+	}
+
+	return append(keys, prev), nil
+}
+
+func getStoragePath(net *chaincfg.Params, dc DomainConfig, multi bool) string {
+	name := fmt.Sprintf("mbserver-state.%s.json", net.Name)
+	if multi {
+		name = fmt.Sprintf("mbserver-state.%s.%s.json", net.Name, dc.Domain)
+	}
+	return filepath.Join(*storageDir, name)
+}
+
+const leaseTTL = 30 * time.Second
+
+// leaseOwner identifies this process when holding channel leases.
+func leaseOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+func newDomain(net *chaincfg.Params, bc *btcrpcclient.Client, dc DomainConfig, multi bool) (*DomainState, error) {
+	if dc.Destination == "" {
+		dc.Destination = *destination
+	}
+	if dc.Destination == "" {
+		return nil, errors.New("destination is required for " + dc.Domain)
+	}
+
+	key := dc.XPrivKey.Value
+	if key == "" {
+		key = *xprivkey
+	}
+	ek, err := loadkey(net, key)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := getDirectory(net, dc)
+	if err != nil {
+		return nil, err
+	}
+
+	dkeys, err := domainKeys(dc)
+	if err != nil {
+		return nil, err
+	}
+
+	storage := filesystem.NewFilesystemStorage(getStoragePath(net, dc, multi))
+
+	tokenKeys, err := getTokenKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	r := receiver.NewReceiver(net, ek, bc, storage, dir, dc.Destination, *authToken)
+	r.Logger = logger
+	r.Domain = dc.Domain
+	if len(dkeys) > 0 {
+		r.DomainKey = dkeys[0]
+	}
+	r.TokenKeys = tokenKeys
+	r.TokenTTL = *authTokenTTL
+	if *distributedLock {
+		ll := receiver.NewLeaseLocker(storage, leaseOwner(), leaseTTL)
+		ll.Logger = logger
+		r.Locker = ll
+	}
+	if *channelTimeout != 0 {
+		r.ChannelConfig.Timeout = *channelTimeout
+	}
+	if *feeRate != 0 {
+		r.ChannelConfig.FeeRate = *feeRate
+	}
+	if *softTimeout != 0 {
+		r.Policy.SoftTimeout = *softTimeout
+	}
+	if *fundingMinConf != 0 {
+		r.Policy.FundingMinConf = *fundingMinConf
+	}
+	if dc.SoftTimeout != 0 {
+		r.Policy.SoftTimeout = dc.SoftTimeout
+	}
+	if dc.FundingMinConf != 0 {
+		r.Policy.FundingMinConf = dc.FundingMinConf
+	}
+
+	if *targetKeys != "" {
+		ks, err := receiver.LoadKeySigner(net, *targetKeys)
+		if err != nil {
+			return nil, err
+		}
+		r.TargetSigner = ks
+	}
+
+	r.Metrics = receiver.NewMetrics(r, prometheus.Labels{"domain": dc.Domain})
+	if err := r.Metrics.Register(prometheus.DefaultRegisterer); err != nil {
+		return nil, err
+	}
+
+	return &DomainState{
+		Config:     dc,
+		Receiver:   r,
+		DomainKeys: dkeys,
+	}, nil
+}
+
 type ServerState struct {
-	BC       *btcrpcclient.Client
-	Receiver *receiver.Receiver
+	BC      *btcrpcclient.Client
+	Domains []*DomainState
+	Limits  *rpcLimits
+
+	// openMu serializes opens so that a channel can't be opened by two
+	// domains at once.
+	openMu sync.Mutex
 }
 
 func wrap(s *ServerState, h func(*ServerState, http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
@@ -83,25 +258,42 @@ func wrap(s *ServerState, h func(*ServerState, http.ResponseWriter, *http.Reques
 func main() {
 	flag.Parse()
 
-	if *destination == "" {
-		log.Fatalf("--destination is required")
-	}
-	if *xprivkey == "" {
-		log.Fatalf("--xprivkey is required")
+	if *configPath != "" {
+		c, err := loadConfig(*configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := applyConfig(c); err != nil {
+			log.Fatal(err)
+		}
 	}
-	if *authToken == "" {
-		log.Fatalf("--auth_token is required")
+	if err := validateConfig(); err != nil {
+		log.Fatal(err)
 	}
 
-	net := getnet()
-
-	ek, err := loadkey(net)
+	level, err := logging.ParseLevel(*logLevel)
 	if err != nil {
 		log.Fatal(err)
 	}
+	logger = logging.NewStdLogger(level)
+
+	net := getnet()
 
-	path := fmt.Sprintf("mbserver-state.%s.json", net.Name)
-	storage := filesystem.NewFilesystemStorage(path)
+	dcs := []DomainConfig{flagDomain()}
+	multi := false
+	if *domainsConfig != "" {
+		dcs, err = loadDomains(*domainsConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		multi = true
+	} else if len(configDomains) > 0 {
+		dcs, err = checkDomains(configDomains)
+		if err != nil {
+			log.Fatal(err)
+		}
+		multi = true
+	}
 
 	bc, err := bitcoinClient()
 	if err != nil {
@@ -109,32 +301,59 @@ func main() {
 	}
 	defer bc.Shutdown()
 
-	dir := receiver.NewDirectory(*domain)
-	s := receiver.NewReceiver(net, ek, bc, storage, dir, *destination, *authToken)
+	limits, err := newRPCLimits()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ss := &ServerState{BC: bc, Limits: limits}
 
-	go s.WatchBlockchainForever()
+	for _, dc := range dcs {
+		d, err := newDomain(net, bc, dc, multi)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ss.Domains = append(ss.Domains, d)
 
-	ss := &ServerState{bc, s}
+		go d.Receiver.WatchBlockchainForever()
 
-	http.HandleFunc("/", wrap(ss, indexHandler))
-	http.HandleFunc("/details", wrap(ss, detailsHandler))
+		if *webhookURL != "" {
+			wd := receiver.NewWebhookDispatcher(d.Receiver, *webhookURL, *webhookSecret)
+			go wd.DispatchForever()
+		}
+
+		logger.Log(logging.Info, "serving domain",
+			logging.Fields{"domain": d.Config.Domain})
+	}
+
+	if *adminListenAddr != "" {
+		go serveAdmin(ss)
+	}
 
-	if *externalURL != "" {
-		http.HandleFunc(resolver.MoonbeamPath, domainHandler)
+	// The public listener only serves what senders need unless the
+	// dashboard is explicitly made public.
+	if *publicDashboard {
+		http.HandleFunc("/", wrap(ss, indexHandler))
+		http.HandleFunc("/details", wrap(ss, detailsHandler))
+		http.HandleFunc("/request", wrap(ss, requestHandler))
 	}
+	http.HandleFunc(resolver.MoonbeamPath, wrap(ss, domainHandler))
+	http.HandleFunc("/healthz", wrap(ss, healthzHandler))
+	http.HandleFunc("/readyz", wrap(ss, readyzHandler))
 
-	http.HandleFunc(rpcPath, wrap(ss, rpcHandler))
-	http.HandleFunc(rpcPath+"/", wrap(ss, rpcHandler))
+	http.HandleFunc(rpcPath, instrumentRPC(wrap(ss, rpcHandler)))
+	http.HandleFunc(rpcPath+"/", instrumentRPC(wrap(ss, rpcHandler)))
 
 	fullAddr := *listenAddr
 	if strings.HasPrefix(fullAddr, ":") {
 		fullAddr = "127.0.0.1" + fullAddr
 	}
-	log.Printf("Listening on https://%s", fullAddr)
+	logger.Log(logging.Info, "listening",
+		logging.Fields{"url": "https://" + fullAddr})
 
+	srv := newServer(*listenAddr, http.DefaultServeMux)
 	if *tlsCert == "" {
-		log.Fatal(http.ListenAndServe(*listenAddr, nil))
+		log.Fatal(srv.ListenAndServe())
 	} else {
-		log.Fatal(http.ListenAndServeTLS(*listenAddr, *tlsCert, *tlsKey, nil))
+		log.Fatal(srv.ListenAndServeTLS(*tlsCert, *tlsKey))
 	}
 }
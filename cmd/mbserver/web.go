@@ -2,19 +2,24 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
-	"log"
 	"net/http"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/luno/moonbeam/resolver"
+	"github.com/luno/moonbeam/address"
+	"github.com/luno/moonbeam/logging"
 	"github.com/luno/moonbeam/storage"
 )
 
 func render(t *template.Template, w http.ResponseWriter, data interface{}) {
 	if err := t.Execute(w, data); err != nil {
-		log.Printf("template error: %v", err)
+		logger.Log(logging.Error, "template error",
+			logging.Fields{"error": err})
 		http.Error(w, "template error", http.StatusInternalServerError)
 		return
 	}
@@ -55,12 +60,15 @@ instant off-chain payments between multi-user platforms.</p>
 <li><a href="https://github.com/luno/moonbeam/blob/master/docs/spec.md">Specification</a></li>
 </ul>
 
+<p><a href="/request">Create a payment request</a></p>
+
 <h4>Channels</h4>
 
 <table class="table">
 <thead>
 <tr>
 <th>ID</th>
+<th>Domain</th>
 <th>Status</th>
 <th>Capacity</th>
 <th>Balance</th>
@@ -71,6 +79,7 @@ instant off-chain payments between multi-user platforms.</p>
 {{range .ChanItems}}
 <tr>
 <td><a href="/details?id={{.ID}}">{{.ID}}</a></td>
+<td>{{.Domain}}</td>
 <td>{{.SharedState.Status}}</td>
 <td>{{.SharedState.Capacity}}</td>
 <td>{{.SharedState.Balance}}</td>
@@ -88,21 +97,32 @@ func indexHandler(ss *ServerState, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	recs, err := ss.Receiver.List()
-	if err != nil {
-		http.Error(w, "error", http.StatusInternalServerError)
-		return
+	var items []chanItem
+	for _, d := range ss.Domains {
+		recs, err := d.Receiver.List()
+		if err != nil {
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+		for _, rec := range recs {
+			items = append(items, chanItem{rec, d.Config.Domain})
+		}
 	}
 
-	sort.Sort(chanItems(recs))
+	sort.Sort(chanItems(items))
 
 	c := struct {
-		ChanItems []storage.Record
-	}{recs}
+		ChanItems []chanItem
+	}{items}
 	render(indexT, w, c)
 }
 
-type chanItems []storage.Record
+type chanItem struct {
+	storage.Record
+	Domain string
+}
+
+type chanItems []chanItem
 
 func (items chanItems) Len() int {
 	return len(items)
@@ -144,15 +164,21 @@ func detailsHandler(ss *ServerState, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s := ss.Receiver.Get(txid, vout)
+	rc := ss.findChannel(txid, vout)
+	if rc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	s := rc.Get(txid, vout)
 	if s == nil {
 		http.NotFound(w, r)
 		return
 	}
 
-	payments, err := ss.Receiver.ListPayments(txid, vout)
+	payments, err := rc.ListPayments(txid, vout)
 	if err != nil {
-		log.Printf("error: %v", err)
+		logger.Log(logging.Error, "list payments error",
+			logging.Fields{"error": err})
 		http.Error(w, "error", http.StatusInternalServerError)
 		return
 	}
@@ -175,11 +201,126 @@ func detailsHandler(ss *ServerState, w http.ResponseWriter, r *http.Request) {
 	render(detailsT, w, c)
 }
 
-func domainHandler(w http.ResponseWriter, r *http.Request) {
-	d := resolver.Domain{
-		Receivers: []resolver.DomainReceiver{
-			{URL: *externalURL + rpcPath},
-		},
+var requestT = template.Must(template.New("request").Parse(header + `
+<h1>Payment request</h1>
+
+<p><a href="/">Home</a></p>
+
+<form method="get" action="/request">
+<div class="form-group">
+<label for="target">Target</label>
+<input class="form-control" id="target" name="target" value="{{.Target}}" placeholder="Bitcoin or moonbeam address">
+</div>
+<div class="form-group">
+<label for="amount">Amount (Satoshi)</label>
+<input class="form-control" id="amount" name="amount" value="{{.Amount}}">
+</div>
+<div class="form-group">
+<label for="memo">Memo</label>
+<input class="form-control" id="memo" name="memo" value="{{.Memo}}">
+</div>
+<div class="form-group">
+<label for="expiry">Expiry (minutes)</label>
+<input class="form-control" id="expiry" name="expiry" value="{{.Expiry}}">
+</div>
+<button type="submit" class="btn btn-default">Create</button>
+</form>
+
+{{if .Error}}
+<p class="text-danger">{{.Error}}</p>
+{{end}}
+
+{{if .URI}}
+<h4>Request URI</h4>
+<p><a href="{{.URI}}"><code>{{.URI}}</code></a></p>
+{{end}}
+
+` + footer))
+
+// requestURI returns the moonbeam URI for a payment request to a target of
+// the domain. The target may also be given as a bitcoin address.
+func requestURI(ds *DomainState, target, amount, memo, expiry string) (*address.URI, error) {
+	if !strings.Contains(target, "@") {
+		addr, err := address.Encode(target, ds.Config.Domain)
+		if err != nil {
+			return nil, err
+		}
+		target = addr
 	}
-	json.NewEncoder(w).Encode(d)
+	a, err := address.Parse(target, getnet())
+	if err != nil {
+		return nil, err
+	}
+
+	ok, reason, err := ds.Receiver.CheckTarget(a.String())
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New(reason)
+	}
+
+	u := &address.URI{Address: a, Memo: memo}
+	if amount != "" {
+		u.Amount, err = strconv.ParseInt(amount, 10, 64)
+		if err != nil || u.Amount <= 0 {
+			return nil, errors.New("invalid amount")
+		}
+	}
+	if expiry != "" {
+		minutes, err := strconv.Atoi(expiry)
+		if err != nil || minutes <= 0 {
+			return nil, errors.New("invalid expiry")
+		}
+		u.Expires = time.Now().Add(time.Duration(minutes) * time.Minute)
+	}
+	return u, nil
+}
+
+func requestHandler(ss *ServerState, w http.ResponseWriter, r *http.Request) {
+	c := struct {
+		Target, Amount, Memo, Expiry string
+
+		URI   template.URL
+		Error string
+	}{
+		Target: r.FormValue("target"),
+		Amount: r.FormValue("amount"),
+		Memo:   r.FormValue("memo"),
+		Expiry: r.FormValue("expiry"),
+	}
+
+	if c.Target != "" {
+		ds := ss.selectDomain(r, "", 0, c.Target)
+		u, err := requestURI(ds, c.Target, c.Amount, c.Memo, c.Expiry)
+		if err != nil {
+			c.Error = err.Error()
+		} else {
+			// The URI is built from a validated address so it's safe to
+			// use as a link despite its scheme.
+			c.URI = template.URL(u.String())
+		}
+	}
+
+	render(requestT, w, c)
+}
+
+func domainHandler(ss *ServerState, w http.ResponseWriter, r *http.Request) {
+	ds := ss.selectDomain(r, "", 0, "")
+	if ds.Config.ExternalURL == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	doc, err := ds.document(time.Now())
+	if err != nil {
+		logger.Log(logging.Error, "domain document error",
+			logging.Fields{"domain": ds.Config.Domain, "error": err})
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=300")
+	json.NewEncoder(w).Encode(doc)
 }
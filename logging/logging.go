@@ -0,0 +1,162 @@
+// Package logging provides the leveled, structured logger used by the
+// moonbeam packages.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+func (l Level) String() string {
+	switch l {
+	case Debug:
+		return "debug"
+	case Info:
+		return "info"
+	case Warn:
+		return "warn"
+	case Error:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+func ParseLevel(s string) (Level, error) {
+	for l := Debug; l <= Error; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+	return 0, errors.New("unknown log level " + s)
+}
+
+// Fields are structured context attached to a log entry, e.g. the channel ID
+// or the RPC route.
+type Fields map[string]interface{}
+
+// Logger writes log entries. Implementations decide which levels to keep
+// and how to format fields.
+type Logger interface {
+	Log(level Level, msg string, fields Fields)
+}
+
+type discard struct{}
+
+func (discard) Log(Level, string, Fields) {}
+
+// Discard drops all entries.
+var Discard Logger = discard{}
+
+// StdLogger writes entries at or above Level to the standard library's
+// default logger in logfmt style. Values of sensitive fields are redacted.
+type StdLogger struct {
+	Level Level
+}
+
+func NewStdLogger(level Level) *StdLogger {
+	return &StdLogger{Level: level}
+}
+
+func (l *StdLogger) Log(level Level, msg string, fields Fields) {
+	if level < l.Level {
+		return
+	}
+	log.Print(format(level, msg, fields))
+}
+
+func format(level Level, msg string, fields Fields) string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	b.WriteString("level=" + level.String())
+	b.WriteString(" msg=" + quote(msg))
+	for _, k := range keys {
+		v := fmt.Sprint(fields[k])
+		if isSensitive(k) {
+			v = redacted
+		}
+		b.WriteString(" " + k + "=" + quote(v))
+	}
+	return b.String()
+}
+
+func quote(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+const redacted = "[redacted]"
+
+// sensitiveKeys are lowercased field and JSON keys whose values must never
+// be logged.
+var sensitiveKeys = map[string]bool{
+	"authorization": true,
+	"authtoken":     true,
+	"token":         true,
+	"secret":        true,
+	"signature":     true,
+	"sendersig":     true,
+	"receiversig":   true,
+	"targetsig":     true,
+	"domainsig":     true,
+	"closetx":       true,
+}
+
+func isSensitive(key string) bool {
+	return sensitiveKeys[strings.ToLower(key)]
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if isSensitive(k) {
+				v[k] = redacted
+			} else {
+				v[k] = redactValue(e)
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = redactValue(e)
+		}
+	}
+	return v
+}
+
+// RedactJSON returns the JSON document buf with the values of sensitive keys
+// replaced so that it can be logged. Documents that can't be parsed are
+// omitted entirely.
+func RedactJSON(buf []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return fmt.Sprintf("[%d bytes]", len(buf))
+	}
+	out, err := json.Marshal(redactValue(v))
+	if err != nil {
+		return fmt.Sprintf("[%d bytes]", len(buf))
+	}
+	return string(out)
+}
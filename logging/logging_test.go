@@ -0,0 +1,66 @@
+package logging
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/luno/moonbeam/models"
+)
+
+func TestFormat(t *testing.T) {
+	s := format(Info, "channel closed", Fields{
+		"channel":   "abc-1",
+		"authToken": "secret",
+		"error":     "not found",
+	})
+	const exp = `level=info msg="channel closed" authToken=[redacted] channel=abc-1 error="not found"`
+	if s != exp {
+		t.Errorf("Unexpected entry: %s", s)
+	}
+}
+
+func TestRedactJSON(t *testing.T) {
+	in := `{"authToken":"abc","nested":[{"senderSig":"c2ln","amount":1}]}`
+	exp := `{"authToken":"[redacted]","nested":[{"amount":1,"senderSig":"[redacted]"}]}`
+	if s := RedactJSON([]byte(in)); s != exp {
+		t.Errorf("Unexpected result: %s", s)
+	}
+
+	if s := RedactJSON([]byte("not json")); s != "[8 bytes]" {
+		t.Errorf("Unexpected result: %s", s)
+	}
+}
+
+func TestRedactModels(t *testing.T) {
+	secret := []byte("secret")
+	for _, v := range []interface{}{
+		models.SendRequest{TxID: "abc", Payment: []byte("{}"), SenderSig: secret},
+		models.SendResponse{Receipt: &models.Receipt{TxID: "abc", ReceiverSig: secret}},
+		models.CloseResponse{CloseTx: secret},
+		models.ValidateResponse{Valid: true, TargetSig: secret},
+		models.Invoice{ID: "inv", DomainPubKey: []byte("pub"), DomainSig: secret},
+		models.OpenResponse{AuthToken: "secret", Certificate: &models.ChannelCertificate{DomainSig: secret}},
+	} {
+		buf, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := RedactJSON(buf)
+		if strings.Contains(s, "c2VjcmV0") || strings.Contains(s, `"secret"`) {
+			t.Errorf("%T: not redacted: %s", v, s)
+		}
+		if !strings.Contains(s, redacted) {
+			t.Errorf("%T: expected redacted value: %s", v, s)
+		}
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	if l, err := ParseLevel("WARN"); err != nil || l != Warn {
+		t.Errorf("Unexpected result: %v %v", l, err)
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Errorf("Expected error")
+	}
+}
@@ -0,0 +1,38 @@
+package models
+
+// ErrorCode identifies the kind of error returned by an RPC. Codes are stable
+// so that clients can branch on them.
+type ErrorCode string
+
+const (
+	ErrCodeInternal       ErrorCode = "internal"
+	ErrCodeInvalidRequest ErrorCode = "invalid_request"
+	ErrCodeUnauthorized   ErrorCode = "unauthorized"
+	ErrCodeRateLimited    ErrorCode = "rate_limited"
+
+	ErrCodeChannelNotFound  ErrorCode = "channel_not_found"
+	ErrCodeChannelNotOpen   ErrorCode = "channel_not_open"
+	ErrCodeChannelFrozen    ErrorCode = "channel_frozen"
+	ErrCodeChannelBusy      ErrorCode = "channel_busy"
+	ErrCodeConcurrentUpdate ErrorCode = "concurrent_update"
+
+	ErrCodeUTXONotFound        ErrorCode = "utxo_not_found"
+	ErrCodeTooFewConfirmations ErrorCode = "too_few_confirmations"
+
+	ErrCodeAmountTooSmall       ErrorCode = "amount_too_small"
+	ErrCodeInsufficientCapacity ErrorCode = "insufficient_capacity"
+	ErrCodeInvalidPayment       ErrorCode = "invalid_payment"
+	ErrCodeUnknownTarget        ErrorCode = "unknown_target"
+	ErrCodeInvalidSignature     ErrorCode = "invalid_signature"
+	ErrCodeInvalidInvoice       ErrorCode = "invalid_invoice"
+)
+
+// Error is the body of an RPC error response.
+type Error struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return string(e.Code) + ": " + e.Message
+}
@@ -1,5 +1,17 @@
 package models
 
+// Requests after Open may be authenticated by signing them with the sender's
+// channel key instead of using the auth token:
+//
+//	Authorization: MoonbeamSig <base64 signature>
+//	X-Moonbeam-Timestamp: <unix seconds>
+//	X-Moonbeam-Nonce: <random string>
+const (
+	SigAuthScheme   = "MoonbeamSig"
+	TimestampHeader = "X-Moonbeam-Timestamp"
+	NonceHeader     = "X-Moonbeam-Nonce"
+)
+
 type CreateRequest struct {
 	Version int    `json:"version"`
 	Net     string `json:"net"`
@@ -42,13 +54,61 @@ type OpenRequest struct {
 	SenderSig []byte `json:"senderSig"`
 }
 
+// ChannelCertificate states that the receiver accepted the channel. It is
+// signed with the receiver's channel key and optionally the domain key.
+type ChannelCertificate struct {
+	Domain string `json:"domain"`
+
+	TxID     string `json:"txid"`
+	Vout     uint32 `json:"vout"`
+	Net      string `json:"net"`
+	Capacity int64  `json:"capacity"`
+	Timeout  int64  `json:"timeout"`
+	Fee      int64  `json:"fee"`
+
+	SenderPubKey   []byte `json:"senderPubKey"`
+	ReceiverPubKey []byte `json:"receiverPubKey"`
+	SenderOutput   string `json:"senderOutput"`
+	ReceiverOutput string `json:"receiverOutput"`
+
+	ReceiverSig []byte `json:"receiverSig"`
+
+	DomainPubKey []byte `json:"domainPubKey,omitempty"`
+	DomainSig    []byte `json:"domainSig,omitempty"`
+}
+
 type OpenResponse struct {
 	AuthToken string `json:"authToken"`
+
+	Certificate *ChannelCertificate `json:"certificate,omitempty"`
 }
 
 type Payment struct {
 	Amount int64  `json:"amount"`
 	Target string `json:"target"`
+
+	// Invoice optionally identifies the invoice paid. The amount and target
+	// must then match the invoice.
+	Invoice string `json:"invoice,omitempty"`
+}
+
+// Invoice is a request for a payment issued by the receiver and signed with
+// its domain key.
+type Invoice struct {
+	ID     string `json:"id"`
+	Target string `json:"target"`
+	Amount int64  `json:"amount"`
+	Memo   string `json:"memo,omitempty"`
+
+	// Expires is the unix time from which the invoice can no longer be paid.
+	Expires int64 `json:"expires"`
+
+	DomainPubKey []byte `json:"domainPubKey"`
+	DomainSig    []byte `json:"domainSig"`
+}
+
+type InvoiceRequest struct {
+	ID string `json:"id"`
 }
 
 type ValidateRequest struct {
@@ -59,7 +119,13 @@ type ValidateRequest struct {
 }
 
 type ValidateResponse struct {
-	Valid bool `json:"valid"`
+	Valid  bool      `json:"valid"`
+	Code   ErrorCode `json:"code,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+
+	// TargetSig optionally proves that the owner of the target's bitcoin
+	// address receives the payment. See address.VerifyTarget.
+	TargetSig []byte `json:"targetSig,omitempty"`
 }
 
 type SendRequest struct {
@@ -71,7 +137,22 @@ type SendRequest struct {
 	SenderSig []byte `json:"senderSig"`
 }
 
+// Receipt is the receiver's acknowledgement of a payment, signed with its
+// channel key. Senders can keep it as proof of payment.
+type Receipt struct {
+	TxID string `json:"txid"`
+	Vout uint32 `json:"vout"`
+
+	Count        int    `json:"count"`
+	Balance      int64  `json:"balance"`
+	PaymentsHash []byte `json:"paymentsHash"`
+	Payment      []byte `json:"payment"`
+
+	ReceiverSig []byte `json:"receiverSig"`
+}
+
 type SendResponse struct {
+	Receipt *Receipt `json:"receipt,omitempty"`
 }
 
 type CloseRequest struct {
@@ -83,6 +164,18 @@ type CloseResponse struct {
 	CloseTx []byte `json:"closeTx"`
 }
 
+type RefreshRequest struct {
+	TxID string `json:"txid"`
+	Vout uint32 `json:"vout"`
+
+	Timestamp int64  `json:"timestamp"`
+	SenderSig []byte `json:"senderSig"`
+}
+
+type RefreshResponse struct {
+	AuthToken string `json:"authToken"`
+}
+
 type StatusRequest struct {
 	TxID string `json:"txid"`
 	Vout uint32 `json:"vout"`
@@ -0,0 +1,129 @@
+package receiver
+
+import (
+	"github.com/luno/moonbeam/channels"
+	"github.com/luno/moonbeam/logging"
+	"github.com/luno/moonbeam/models"
+	"github.com/luno/moonbeam/storage"
+)
+
+// These methods are meant for operators of the receiver and must not be
+// exposed to senders.
+
+var errChannelFrozen = newCodedError(models.ErrCodeChannelFrozen, "channel is frozen")
+
+// ChannelFilter selects channels in ListChannels. Zero values match any
+// channel.
+type ChannelFilter struct {
+	Status channels.Status
+	Frozen bool
+}
+
+func (f ChannelFilter) match(rec storage.Record) bool {
+	if f.Status != 0 && rec.SharedState.Status != f.Status {
+		return false
+	}
+	if f.Frozen && !rec.Frozen {
+		return false
+	}
+	return true
+}
+
+func (r *Receiver) ListChannels(f ChannelFilter) ([]storage.Record, error) {
+	recs, err := r.db.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []storage.Record
+	for _, rec := range recs {
+		if f.match(rec) {
+			res = append(res, rec)
+		}
+	}
+	return res, nil
+}
+
+// Channel returns the stored record of the channel.
+func (r *Receiver) Channel(txid string, vout uint32) (*storage.Record, error) {
+	return r.db.Get(getChannelID(txid, vout))
+}
+
+func (r *Receiver) setFrozen(txid string, vout uint32, frozen bool) error {
+	id := getChannelID(txid, vout)
+
+	unlock, err := r.lockChannel(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return r.db.SetFrozen(id, frozen)
+}
+
+// Freeze rejects any further payments on the channel until it is unfrozen.
+// The sender can still close the channel.
+func (r *Receiver) Freeze(txid string, vout uint32) error {
+	return r.setFrozen(txid, vout, true)
+}
+
+func (r *Receiver) Unfreeze(txid string, vout uint32) error {
+	return r.setFrozen(txid, vout, false)
+}
+
+// ForceClose closes the channel without a request from the sender.
+func (r *Receiver) ForceClose(txid string, vout uint32) (*models.CloseResponse, error) {
+	r.Logger.Log(logging.Info, "force closing channel",
+		logging.Fields{"channel": getChannelID(txid, vout)})
+
+	return r.Close(models.CloseRequest{TxID: txid, Vout: vout})
+}
+
+// Rebroadcast sends the closure transaction of a closing channel to the
+// network again, e.g. if it was dropped from the mempool.
+func (r *Receiver) Rebroadcast(txid string, vout uint32) (string, error) {
+	id := getChannelID(txid, vout)
+
+	unlock, err := r.lockChannel(id)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	c, err := r.get(id)
+	if err != nil {
+		return "", err
+	}
+	if c.State.Status != channels.StatusClosing {
+		return "", channels.ErrNotStatusClosing
+	}
+
+	// The closure transaction is deterministic so it can be recreated from
+	// the stored state.
+	resp, err := c.Close(&models.CloseRequest{TxID: txid, Vout: vout})
+	if err != nil {
+		return "", err
+	}
+
+	return r.broadcast(id, c.State, resp.CloseTx)
+}
+
+// Check runs the blockchain watcher's check for the channel immediately.
+func (r *Receiver) Check(txid string, vout uint32) error {
+	blockCount, err := r.bc.GetBlockCount()
+	if err != nil {
+		return err
+	}
+
+	rec, err := r.db.Get(getChannelID(txid, vout))
+	if err != nil {
+		return err
+	}
+
+	return r.checkChannel(blockCount, *rec)
+}
+
+// CheckAll runs the blockchain watcher's check for all channels immediately.
+func (r *Receiver) CheckAll() error {
+	return r.watchBlockchain()
+}
@@ -0,0 +1,285 @@
+package receiver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luno/moonbeam/channels"
+	"github.com/luno/moonbeam/models"
+)
+
+// TokenKey is a secret used to issue and validate auth tokens.
+type TokenKey struct {
+	// ID is embedded in tokens to identify the key. It must not contain
+	// any dots.
+	ID     string
+	Secret []byte
+
+	// Expires is the end of the key's overlap window after it has been
+	// rotated out. Tokens signed by the key are rejected after this time.
+	// Zero means never.
+	Expires time.Time
+}
+
+const tokenVersion = "1"
+
+// Tokens have the form
+//
+//	1.<keyID>.<issued>.<expires>.<mac>
+//
+// where issued and expires are unix timestamps (expires is 0 for tokens that
+// don't expire) and mac is the base64url HMAC-SHA256 of everything before it
+// plus the channel ID.
+//
+// Tokens issued before versioned keys were introduced are the base64 HMAC of
+// just the channel ID. These are still accepted until the channel's tokens
+// are revoked.
+func tokenMAC(key TokenKey, payload, id string) []byte {
+	mac := hmac.New(sha256.New, key.Secret)
+	mac.Write([]byte(payload))
+	mac.Write([]byte("."))
+	mac.Write([]byte(id))
+	return mac.Sum(nil)
+}
+
+func legacyTokenMAC(key TokenKey, id string) []byte {
+	mac := hmac.New(sha256.New, key.Secret)
+	mac.Write([]byte(id))
+	return mac.Sum(nil)
+}
+
+func (r *Receiver) issueToken(id string) (string, error) {
+	if len(r.TokenKeys) == 0 {
+		return "", errors.New("no token keys configured")
+	}
+	key := r.TokenKeys[0]
+
+	now := time.Now()
+	var expires int64
+	if r.TokenTTL > 0 {
+		expires = now.Add(r.TokenTTL).Unix()
+	}
+
+	payload := strings.Join([]string{
+		tokenVersion,
+		key.ID,
+		strconv.FormatInt(now.Unix(), 10),
+		strconv.FormatInt(expires, 10),
+	}, ".")
+
+	mac := tokenMAC(key, payload, id)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac), nil
+}
+
+func (r *Receiver) findTokenKey(keyID string, now time.Time) (TokenKey, bool) {
+	for _, key := range r.TokenKeys {
+		if key.ID != keyID {
+			continue
+		}
+		if !key.Expires.IsZero() && now.After(key.Expires) {
+			return TokenKey{}, false
+		}
+		return key, true
+	}
+	return TokenKey{}, false
+}
+
+func (r *Receiver) validateLegacyToken(id, token string, notBefore time.Time, now time.Time) bool {
+	// Legacy tokens don't carry an issue time so any revocation applies.
+	if !notBefore.IsZero() {
+		return false
+	}
+	actual, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return false
+	}
+	for _, key := range r.TokenKeys {
+		if !key.Expires.IsZero() && now.After(key.Expires) {
+			continue
+		}
+		if hmac.Equal(actual, legacyTokenMAC(key, id)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Receiver) ValidateToken(txid string, vout uint32, token string) bool {
+	id := getChannelID(txid, vout)
+	rec, err := r.db.Get(id)
+	if err != nil {
+		return false
+	}
+
+	now := time.Now()
+	notBefore := rec.TokensNotBefore
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 {
+		return r.validateLegacyToken(id, token, notBefore, now)
+	}
+	if parts[0] != tokenVersion {
+		return false
+	}
+
+	key, ok := r.findTokenKey(parts[1], now)
+	if !ok {
+		return false
+	}
+	issued, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return false
+	}
+	expires, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return false
+	}
+	actual, err := base64.RawURLEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+
+	payload := strings.Join(parts[:4], ".")
+	if !hmac.Equal(actual, tokenMAC(key, payload, id)) {
+		return false
+	}
+
+	if expires != 0 && now.Unix() >= expires {
+		return false
+	}
+	if !notBefore.IsZero() && issued < notBefore.Unix() {
+		return false
+	}
+
+	return true
+}
+
+// RevokeTokens invalidates all auth tokens issued for the channel so far.
+// The sender can get a new token with Refresh.
+func (r *Receiver) RevokeTokens(txid string, vout uint32) error {
+	id := getChannelID(txid, vout)
+	// Tokens only have second precision, so revoke the whole current second.
+	notBefore := time.Now().Truncate(time.Second).Add(time.Second)
+	return r.db.SetTokensNotBefore(id, notBefore)
+}
+
+// refreshWindow limits how far the timestamp of a refresh request may be
+// from the current time.
+const refreshWindow = 5 * time.Minute
+
+// Refresh issues a new auth token to a sender that proves possession of its
+// channel key. Each request can only be used once, and requests timestamped
+// before the channel's tokens were revoked are rejected.
+func (r *Receiver) Refresh(req models.RefreshRequest) (*models.RefreshResponse, error) {
+	id := getChannelID(req.TxID, req.Vout)
+	rec, err := r.db.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	ts := time.Unix(req.Timestamp, 0)
+	if d := now.Sub(ts); d > refreshWindow || d < -refreshWindow {
+		return nil, NewExposableError("timestamp out of range")
+	}
+	// A token issued before notBefore would already be revoked.
+	notBefore := rec.TokensNotBefore
+	if !notBefore.IsZero() && (req.Timestamp < notBefore.Unix() || now.Before(notBefore)) {
+		return nil, NewExposableError("timestamp is before tokens were revoked")
+	}
+
+	msg := channels.RefreshMessage(req.TxID, req.Vout, req.Timestamp)
+	if err := rec.SharedState.VerifySenderMessage(msg, req.SenderSig); err != nil {
+		return nil, newCodedError(models.ErrCodeInvalidSignature, "invalid signature")
+	}
+
+	// The timestamp serves as the nonce of the signed message.
+	nonce := "refresh:" + id + "/" + strconv.FormatInt(req.Timestamp, 10)
+	if !r.nonces.add(nonce, now) {
+		return nil, NewExposableError("refresh request already used")
+	}
+
+	token, err := r.issueToken(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.RefreshResponse{AuthToken: token}, nil
+}
+
+// requestSigWindow limits how far the timestamp of a signed request may be
+// from the current time. Nonces are remembered for twice as long, which
+// covers the lifetime of a request timestamped in the future.
+const requestSigWindow = 5 * time.Minute
+
+// nonceCache remembers recently seen request nonces, and timestamps of
+// refresh requests, to prevent replays. refreshWindow must not exceed
+// requestSigWindow.
+// It is local to the process, so instances sharing storage only rely on the
+// timestamp window to limit replays across instances.
+type nonceCache struct {
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+// add returns false if the nonce has already been seen.
+func (c *nonceCache) add(nonce string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.seen == nil {
+		c.seen = make(map[string]time.Time)
+	}
+
+	if now.Sub(c.pruned) > requestSigWindow {
+		for n, t := range c.seen {
+			if now.Sub(t) > 2*requestSigWindow {
+				delete(c.seen, n)
+			}
+		}
+		c.pruned = now
+	}
+
+	if _, ok := c.seen[nonce]; ok {
+		return false
+	}
+	c.seen[nonce] = now
+	return true
+}
+
+// ValidateRequestSig checks a request signed with the sender's channel key
+// as an alternative to an auth token. See channels.RequestMessage.
+func (r *Receiver) ValidateRequestSig(txid string, vout uint32,
+	method, route string, timestamp int64, nonce string, body, sig []byte) bool {
+
+	now := time.Now()
+	ts := time.Unix(timestamp, 0)
+	if d := now.Sub(ts); d > requestSigWindow || d < -requestSigWindow {
+		return false
+	}
+	if nonce == "" || len(nonce) > 64 {
+		return false
+	}
+
+	id := getChannelID(txid, vout)
+	rec, err := r.db.Get(id)
+	if err != nil {
+		return false
+	}
+
+	msg := channels.RequestMessage(method, route, timestamp, nonce, body)
+	if err := rec.SharedState.VerifySenderMessage(msg, sig); err != nil {
+		return false
+	}
+
+	// Only remember nonces of valid signatures so that they can't be used
+	// to fill the cache.
+	return r.nonces.add(id+"/"+nonce, now)
+}
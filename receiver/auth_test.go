@@ -0,0 +1,315 @@
+package receiver
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+
+	"github.com/luno/moonbeam/channels"
+	"github.com/luno/moonbeam/models"
+	"github.com/luno/moonbeam/storage"
+)
+
+const testTxID = "8ac37b4fb0ddc50e3a1b3a5b8fac35c9b4f5fea4bc9ccb6b3ac1b7ae6d4c6d3b"
+
+// createTestChannel stores a channel with a new sender key and returns the
+// key.
+func createTestChannel(t *testing.T, db storage.Storage, vout uint32) *btcec.PrivateKey {
+	key, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := channels.SharedState{
+		SenderPubKey: key.PubKey().SerializeCompressed(),
+		FundingTxID:  testTxID,
+		FundingVout:  vout,
+	}
+	if err := db.Create(storage.Record{ID: getChannelID(testTxID, vout), SharedState: s}, nil); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func signTestMessage(t *testing.T, key *btcec.PrivateKey, msg []byte) []byte {
+	hash := sha256.Sum256(msg)
+	sig, err := key.Sign(hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig.Serialize()
+}
+
+func makeToken(key TokenKey, issued, expires time.Time, id string) string {
+	var exp int64
+	if !expires.IsZero() {
+		exp = expires.Unix()
+	}
+	payload := strings.Join([]string{
+		tokenVersion,
+		key.ID,
+		strconv.FormatInt(issued.Unix(), 10),
+		strconv.FormatInt(exp, 10),
+	}, ".")
+	return payload + "." + base64.RawURLEncoding.EncodeToString(tokenMAC(key, payload, id))
+}
+
+func TestValidateToken(t *testing.T) {
+	r, db, cleanup := newTestReceiver(t)
+	defer cleanup()
+
+	now := time.Now()
+	current := TokenKey{ID: "3", Secret: []byte("current")}
+	previous := TokenKey{ID: "2", Secret: []byte("previous"), Expires: now.Add(time.Hour)}
+	expired := TokenKey{ID: "1", Secret: []byte("expired"), Expires: now.Add(-time.Hour)}
+	r.TokenKeys = []TokenKey{current, previous, expired}
+
+	createTestChannel(t, db, 0)
+	createTestChannel(t, db, 1)
+	revokedAt := now.Add(-time.Minute)
+	if err := db.SetTokensNotBefore(getChannelID(testTxID, 1), revokedAt); err != nil {
+		t.Fatal(err)
+	}
+	id := getChannelID(testTxID, 0)
+	revokedID := getChannelID(testTxID, 1)
+
+	legacy := func(key TokenKey, id string) string {
+		return base64.StdEncoding.EncodeToString(legacyTokenMAC(key, id))
+	}
+	valid := makeToken(current, now, now.Add(time.Hour), id)
+
+	tests := []struct {
+		name  string
+		vout  uint32
+		token string
+		ok    bool
+	}{
+		{"current key", 0, valid, true},
+		{"no expiry", 0, makeToken(current, now, time.Time{}, id), true},
+		{"previous key in overlap", 0, makeToken(previous, now, now.Add(time.Hour), id), true},
+		{"previous key expired", 0, makeToken(expired, now, now.Add(time.Hour), id), false},
+		{"unknown key", 0, makeToken(TokenKey{ID: "4", Secret: []byte("current")}, now, time.Time{}, id), false},
+		{"token expired", 0, makeToken(current, now.Add(-2*time.Hour), now.Add(-time.Hour), id), false},
+		{"other channel", 0, makeToken(current, now, time.Time{}, revokedID), false},
+		{"tampered", 0, strings.Replace(valid, "."+strconv.FormatInt(now.Unix(), 10)+".", ".1.", 1), false},
+		{"wrong version", 0, "2" + valid[1:], false},
+		{"garbage", 0, "a.b.c.d.e", false},
+		{"issued before revocation", 1, makeToken(current, revokedAt.Add(-time.Second), time.Time{}, revokedID), false},
+		{"issued after revocation", 1, makeToken(current, now, time.Time{}, revokedID), true},
+		{"legacy", 0, legacy(current, id), true},
+		{"legacy previous key", 0, legacy(previous, id), true},
+		{"legacy expired key", 0, legacy(expired, id), false},
+		{"legacy revoked", 1, legacy(current, revokedID), false},
+		{"unknown channel", 2, makeToken(current, now, time.Time{}, getChannelID(testTxID, 2)), false},
+	}
+	for _, test := range tests {
+		if ok := r.ValidateToken(testTxID, test.vout, test.token); ok != test.ok {
+			t.Errorf("%s: expected %v, got %v", test.name, test.ok, ok)
+		}
+	}
+}
+
+func TestRevokeTokens(t *testing.T) {
+	r, db, cleanup := newTestReceiver(t)
+	defer cleanup()
+	r.TokenTTL = time.Hour
+	createTestChannel(t, db, 0)
+	createTestChannel(t, db, 1)
+
+	token, err := r.issueToken(getChannelID(testTxID, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := r.issueToken(getChannelID(testTxID, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.ValidateToken(testTxID, 0, token) {
+		t.Fatalf("Expected token to be valid")
+	}
+
+	if err := r.RevokeTokens(testTxID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if r.ValidateToken(testTxID, 0, token) {
+		t.Errorf("Expected token issued in the same second to be revoked")
+	}
+	if !r.ValidateToken(testTxID, 1, other) {
+		t.Errorf("Expected token of another channel to stay valid")
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	r, db, cleanup := newTestReceiver(t)
+	defer cleanup()
+	key := createTestChannel(t, db, 0)
+
+	refresh := func(ts int64) (string, error) {
+		sig := signTestMessage(t, key, channels.RefreshMessage(testTxID, 0, ts))
+		resp, err := r.Refresh(models.RefreshRequest{
+			TxID:      testTxID,
+			Vout:      0,
+			Timestamp: ts,
+			SenderSig: sig,
+		})
+		if err != nil {
+			return "", err
+		}
+		return resp.AuthToken, nil
+	}
+
+	now := time.Now().Unix()
+	token, err := refresh(now - 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.ValidateToken(testTxID, 0, token) {
+		t.Errorf("Expected refreshed token to be valid")
+	}
+
+	// A captured request can't be replayed.
+	if _, err := refresh(now - 60); err == nil {
+		t.Errorf("Expected replayed request to be rejected")
+	}
+
+	// Requests signed before revocation are rejected even if unused.
+	if err := r.RevokeTokens(testTxID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := refresh(now - 30); err == nil {
+		t.Errorf("Expected request from before revocation to be rejected")
+	}
+	if r.ValidateToken(testTxID, 0, token) {
+		t.Errorf("Expected token to be revoked")
+	}
+
+	rec, err := db.Get(getChannelID(testTxID, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(rec.TokensNotBefore.Sub(time.Now()))
+	token, err = refresh(rec.TokensNotBefore.Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.ValidateToken(testTxID, 0, token) {
+		t.Errorf("Expected token refreshed after revocation to be valid")
+	}
+
+	invalid := []struct {
+		name string
+		req  models.RefreshRequest
+	}{
+		{"too old", models.RefreshRequest{TxID: testTxID, Timestamp: now - 600,
+			SenderSig: signTestMessage(t, key, channels.RefreshMessage(testTxID, 0, now-600))}},
+		{"too new", models.RefreshRequest{TxID: testTxID, Timestamp: now + 600,
+			SenderSig: signTestMessage(t, key, channels.RefreshMessage(testTxID, 0, now+600))}},
+		{"wrong message", models.RefreshRequest{TxID: testTxID, Timestamp: now + 60,
+			SenderSig: signTestMessage(t, key, channels.RefreshMessage(testTxID, 0, now+61))}},
+		{"unknown channel", models.RefreshRequest{TxID: testTxID, Vout: 1, Timestamp: now + 60,
+			SenderSig: signTestMessage(t, key, channels.RefreshMessage(testTxID, 1, now+60))}},
+	}
+	for _, test := range invalid {
+		if _, err := r.Refresh(test.req); err == nil {
+			t.Errorf("%s: expected error", test.name)
+		}
+	}
+}
+
+func TestValidateRequestSig(t *testing.T) {
+	r, db, cleanup := newTestReceiver(t)
+	defer cleanup()
+	key := createTestChannel(t, db, 0)
+	other := createTestChannel(t, db, 1)
+
+	const (
+		method = "POST"
+		route  = "/send/" + testTxID + "-0"
+	)
+	body := []byte(`{"txid":"` + testTxID + `"}`)
+	now := time.Now().Unix()
+
+	sign := func(key *btcec.PrivateKey, ts int64, nonce string) []byte {
+		return signTestMessage(t, key, channels.RequestMessage(method, route, ts, nonce, body))
+	}
+
+	if !r.ValidateRequestSig(testTxID, 0, method, route, now, "n1", body, sign(key, now, "n1")) {
+		t.Fatalf("Expected valid signature")
+	}
+
+	tests := []struct {
+		name   string
+		vout   uint32
+		method string
+		route  string
+		ts     int64
+		nonce  string
+		body   []byte
+		sig    []byte
+	}{
+		{"replayed nonce", 0, method, route, now, "n1", body, sign(key, now, "n1")},
+		{"tampered body", 0, method, route, now, "n2", []byte("{}"), sign(key, now, "n2")},
+		{"tampered method", 0, "GET", route, now, "n3", body, sign(key, now, "n3")},
+		{"tampered route", 0, method, "/close/" + testTxID + "-0", now, "n4", body, sign(key, now, "n4")},
+		{"other channel's key", 1, method, route, now, "n5", body, sign(key, now, "n5")},
+		{"too old", 0, method, route, now - 600, "n6", body, sign(key, now-600, "n6")},
+		{"too new", 0, method, route, now + 600, "n7", body, sign(key, now+600, "n7")},
+		{"empty nonce", 0, method, route, now, "", body, sign(key, now, "")},
+		{"long nonce", 0, method, route, now, strings.Repeat("n", 65), body, sign(key, now, strings.Repeat("n", 65))},
+		{"unknown channel", 2, method, route, now, "n8", body, sign(key, now, "n8")},
+	}
+	for _, test := range tests {
+		if r.ValidateRequestSig(testTxID, test.vout, test.method, test.route,
+			test.ts, test.nonce, test.body, test.sig) {
+			t.Errorf("%s: expected invalid signature", test.name)
+		}
+	}
+
+	// Nonces are per channel, and rejected requests don't use them up.
+	if !r.ValidateRequestSig(testTxID, 1, method, route, now, "n1", body, sign(other, now, "n1")) {
+		t.Errorf("Expected nonce to be accepted for another channel")
+	}
+	if !r.ValidateRequestSig(testTxID, 0, method, route, now, "n2", body, sign(key, now, "n2")) {
+		t.Errorf("Expected nonce of rejected request to be accepted")
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	var c nonceCache
+	t0 := time.Now()
+
+	if !c.add("a", t0) {
+		t.Errorf("Expected new nonce to be added")
+	}
+	if c.add("a", t0.Add(time.Minute)) {
+		t.Errorf("Expected seen nonce to be rejected")
+	}
+	if !c.add("b", t0.Add(requestSigWindow)) {
+		t.Errorf("Expected new nonce to be added")
+	}
+
+	// Nonces are kept for twice the window.
+	if c.add("a", t0.Add(2*requestSigWindow)) {
+		t.Errorf("Expected nonce to be remembered within twice the window")
+	}
+	if len(c.seen) != 2 {
+		t.Errorf("Expected 2 nonces, got %d", len(c.seen))
+	}
+
+	// Pruning runs at most once per window and drops nonces older than
+	// twice the window.
+	t1 := t0.Add(3*requestSigWindow + time.Second)
+	if !c.add("c", t1) {
+		t.Errorf("Expected new nonce to be added")
+	}
+	if len(c.seen) != 1 {
+		t.Errorf("Expected old nonces to be pruned, got %d", len(c.seen))
+	}
+	if !c.add("a", t1) {
+		t.Errorf("Expected pruned nonce to be added")
+	}
+}
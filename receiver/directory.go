@@ -1,29 +1,50 @@
 package receiver
 
 import (
+	"github.com/btcsuite/btcd/chaincfg"
+
 	"github.com/luno/moonbeam/address"
 )
 
 // Directory provides access to the set of targets.
 // For example, a hosted wallet will have a list of targets corresponding to
 // user accounts.
-type Directory struct {
-	domain string
-}
-
-func NewDirectory(domain string) *Directory {
-	return &Directory{domain}
+type Directory interface {
+	// CheckTarget reports whether payments to target can be accepted.
+	// If not, reason briefly explains why. The reason is returned to the
+	// sender so it shouldn't contain any sensitive information.
+	CheckTarget(target string) (ok bool, reason string, err error)
 }
 
-func (d *Directory) HasTarget(target string) (bool, error) {
-	_, domain, valid := address.Decode(target)
-	if !valid {
-		return false, nil
+// checkAddress checks that target is a valid address on net for domain.
+// If not, reason explains why.
+func checkAddress(net *chaincfg.Params, domain, target string) (*address.Address, string) {
+	a, err := address.Parse(target, net)
+	if err != nil {
+		return nil, err.Error()
 	}
 
-	if domain != d.domain {
-		return false, nil
+	if d, err := address.NormalizeDomain(domain); err == nil {
+		domain = d
+	}
+	if a.Domain != domain {
+		return nil, "address is for a different domain"
 	}
 
-	return true, nil
+	return a, ""
+}
+
+// DomainDirectory accepts any valid address for its domain.
+type DomainDirectory struct {
+	net    *chaincfg.Params
+	domain string
+}
+
+func NewDomainDirectory(net *chaincfg.Params, domain string) *DomainDirectory {
+	return &DomainDirectory{net, domain}
+}
+
+func (d *DomainDirectory) CheckTarget(target string) (bool, string, error) {
+	_, reason := checkAddress(d.net, d.domain, target)
+	return reason == "", reason, nil
 }
@@ -0,0 +1,101 @@
+package receiver
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+
+	"github.com/luno/moonbeam/address"
+)
+
+// FileDirectory accepts targets listed in an allowlist file. The file
+// contains one address per line. Blank lines and lines starting with # are
+// ignored. The file is reloaded whenever it is modified.
+type FileDirectory struct {
+	net    *chaincfg.Params
+	domain string
+	path   string
+
+	mu      sync.Mutex
+	modTime time.Time
+	targets map[string]bool
+}
+
+func NewFileDirectory(net *chaincfg.Params, domain, path string) *FileDirectory {
+	return &FileDirectory{
+		net:    net,
+		domain: domain,
+		path:   path,
+	}
+}
+
+func readAllowlist(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	targets := make(map[string]bool)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// Compare addresses in their canonical form.
+		if a, err := address.Parse(line, nil); err == nil {
+			line = a.String()
+		}
+		targets[line] = true
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	return targets, nil
+}
+
+func (d *FileDirectory) load() (map[string]bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	fi, err := os.Stat(d.path)
+	if err != nil {
+		return nil, err
+	}
+	if d.targets != nil && fi.ModTime().Equal(d.modTime) {
+		return d.targets, nil
+	}
+
+	targets, err := readAllowlist(d.path)
+	if err != nil {
+		return nil, err
+	}
+	d.targets = targets
+	d.modTime = fi.ModTime()
+
+	return targets, nil
+}
+
+func (d *FileDirectory) CheckTarget(target string) (bool, string, error) {
+	a, reason := checkAddress(d.net, d.domain, target)
+	if a == nil {
+		return false, reason, nil
+	}
+
+	targets, err := d.load()
+	if err != nil {
+		return false, "", err
+	}
+
+	if !targets[a.String()] {
+		return false, "unknown target", nil
+	}
+
+	return true, "", nil
+}
@@ -0,0 +1,106 @@
+package receiver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// HTTPDirectory asks an external account service whether a target exists
+// and can receive payments.
+//
+// The service is called with GET <url>?target=<target>, with the target in
+// its canonical form, and must respond
+// with HTTP 200 and a TargetResponse. HTTP 404 is treated as an unknown
+// target.
+type HTTPDirectory struct {
+	Client *http.Client
+
+	net    *chaincfg.Params
+	domain string
+	url    string
+}
+
+// TargetResponse is the response expected from the HTTPDirectory callback.
+type TargetResponse struct {
+	Exists     bool   `json:"exists"`
+	CanReceive bool   `json:"canReceive"`
+	Reason     string `json:"reason"`
+}
+
+// directoryTimeout bounds calls to the directory callback, which is made for
+// every payment.
+const directoryTimeout = 10 * time.Second
+
+// directoryMaxResponseBytes limits the size of directory callback responses.
+const directoryMaxResponseBytes = 64 << 10
+
+func NewHTTPDirectory(net *chaincfg.Params, domain, callbackURL string) *HTTPDirectory {
+	return &HTTPDirectory{
+		Client: &http.Client{Timeout: directoryTimeout},
+		net:    net,
+		domain: domain,
+		url:    callbackURL,
+	}
+}
+
+func (d *HTTPDirectory) CheckTarget(target string) (bool, string, error) {
+	a, reason := checkAddress(d.net, d.domain, target)
+	if a == nil {
+		return false, reason, nil
+	}
+
+	u, err := url.Parse(d.url)
+	if err != nil {
+		return false, "", err
+	}
+	q := u.Query()
+	q.Set("target", a.String())
+	u.RawQuery = q.Encode()
+
+	resp, err := d.Client.Get(u.String())
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, "unknown target", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, "", fmt.Errorf("directory callback returned http status %d", resp.StatusCode)
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(resp.Body, directoryMaxResponseBytes+1))
+	if err != nil {
+		return false, "", err
+	}
+	if len(buf) > directoryMaxResponseBytes {
+		return false, "", errors.New("directory callback response is too large")
+	}
+
+	var tr TargetResponse
+	if err := json.Unmarshal(buf, &tr); err != nil {
+		return false, "", err
+	}
+
+	if !tr.Exists {
+		return false, "unknown target", nil
+	}
+	if !tr.CanReceive {
+		reason := tr.Reason
+		if reason == "" {
+			reason = "target cannot receive payments"
+		}
+		return false, reason, nil
+	}
+
+	return true, "", nil
+}
@@ -0,0 +1,158 @@
+package receiver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+
+	"github.com/luno/moonbeam/address"
+)
+
+func mustEncode(t *testing.T, bitcoinAddr, domain string) string {
+	a, err := address.Encode(bitcoinAddr, domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestDomainDirectory(t *testing.T) {
+	d := NewDomainDirectory(&chaincfg.TestNet3Params, "Example.com")
+
+	tests := []struct {
+		target string
+		ok     bool
+		reason string
+	}{
+		{testTarget, true, ""},
+		{mustEncode(t, "mgzdqkEjYEjR5QNdJxYFnCKZHuNYa5bUZ2", "example.org"), false, "address is for a different domain"},
+		{"mgzdqkEjYEjR5QNdJxYFnCKZHuNYa5bUZ2+mb7vCiK@examp1e.com", false, address.ErrBadChecksum.Error()},
+		{mustEncode(t, "1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2", "example.com"), false, address.ErrWrongNet.Error()},
+	}
+	for _, test := range tests {
+		ok, reason, err := d.CheckTarget(test.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != test.ok || reason != test.reason {
+			t.Errorf("%s: unexpected result %v %q", test.target, ok, reason)
+		}
+	}
+}
+
+func TestFileDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moonbeam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	other := mustEncode(t, "mnRYb3Zpn6CUR9TNDL6GGGNY9jjU1XURD5", "example.com")
+
+	path := filepath.Join(dir, "allowlist")
+	write := func(content string, mtime time.Time) {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := NewFileDirectory(&chaincfg.TestNet3Params, "example.com", path)
+
+	if _, _, err := d.CheckTarget(testTarget); err == nil {
+		t.Errorf("Expected error for missing allowlist")
+	}
+
+	// Entries are compared in canonical form.
+	now := time.Now()
+	write("# Targets\n\n"+testTarget[:len(testTarget)-len("example.com")]+"EXAMPLE.COM\n", now)
+
+	check := func(target string, ok bool, reason string) {
+		gotOK, gotReason, err := d.CheckTarget(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotOK != ok || gotReason != reason {
+			t.Errorf("%s: unexpected result %v %q", target, gotOK, gotReason)
+		}
+	}
+	check(testTarget, true, "")
+	check(other, false, "unknown target")
+	check("invalid", false, address.ErrInvalidFormat.Error())
+
+	// The file is reloaded when it's modified.
+	write(other+"\n", now.Add(time.Minute))
+	check(testTarget, false, "unknown target")
+	check(other, true, "")
+}
+
+func TestHTTPDirectory(t *testing.T) {
+	var status int
+	var resp TargetResponse
+	var delay time.Duration
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		if r.FormValue("target") != testTarget {
+			t.Errorf("Unexpected target: %s", r.FormValue("target"))
+		}
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	d := NewHTTPDirectory(&chaincfg.TestNet3Params, "example.com", srv.URL+"/targets")
+	if d.Client.Timeout == 0 {
+		t.Errorf("Expected client timeout")
+	}
+
+	tests := []struct {
+		status int
+		resp   TargetResponse
+		ok     bool
+		reason string
+		err    bool
+	}{
+		{http.StatusOK, TargetResponse{Exists: true, CanReceive: true}, true, "", false},
+		{http.StatusOK, TargetResponse{Exists: false}, false, "unknown target", false},
+		{http.StatusOK, TargetResponse{Exists: true, Reason: "account frozen"}, false, "account frozen", false},
+		{http.StatusOK, TargetResponse{Exists: true}, false, "target cannot receive payments", false},
+		{http.StatusNotFound, TargetResponse{}, false, "unknown target", false},
+		{http.StatusInternalServerError, TargetResponse{}, false, "", true},
+		{http.StatusOK, TargetResponse{Exists: true, Reason: strings.Repeat("x", directoryMaxResponseBytes)}, false, "", true},
+	}
+	for i, test := range tests {
+		status, resp = test.status, test.resp
+		ok, reason, err := d.CheckTarget(testTarget)
+		if (err != nil) != test.err {
+			t.Errorf("%d: unexpected error %v", i, err)
+		}
+		if ok != test.ok || reason != test.reason {
+			t.Errorf("%d: unexpected result %v %q", i, ok, reason)
+		}
+	}
+
+	// Invalid addresses aren't looked up.
+	if ok, _, err := d.CheckTarget("invalid"); ok || err != nil {
+		t.Errorf("Unexpected result for invalid address: %v %v", ok, err)
+	}
+
+	status = http.StatusOK
+	delay = 100 * time.Millisecond
+	d.Client.Timeout = 10 * time.Millisecond
+	if _, _, err := d.CheckTarget(testTarget); err == nil {
+		t.Errorf("Expected timeout error")
+	}
+}
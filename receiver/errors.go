@@ -1,15 +1,67 @@
 package receiver
 
+import (
+	"github.com/luno/moonbeam/channels"
+	"github.com/luno/moonbeam/models"
+	"github.com/luno/moonbeam/storage"
+)
+
 type ExposableError struct {
-	err string
+	code models.ErrorCode
+	err  string
 }
 
 func NewExposableError(err string) ExposableError {
 	return ExposableError{
-		err: err,
+		code: models.ErrCodeInvalidRequest,
+		err:  err,
+	}
+}
+
+func newCodedError(code models.ErrorCode, err string) ExposableError {
+	return ExposableError{
+		code: code,
+		err:  err,
 	}
 }
 
 func (e ExposableError) Error() string {
 	return e.err
 }
+
+func (e ExposableError) Code() models.ErrorCode {
+	return e.code
+}
+
+// errorCodes maps errors returned by the channels and storage packages to the
+// codes exposed to senders.
+var errorCodes = map[error]models.ErrorCode{
+	channels.ErrAmountTooSmall:       models.ErrCodeAmountTooSmall,
+	channels.ErrInsufficientCapacity: models.ErrCodeInsufficientCapacity,
+	channels.ErrInvalidPaymentSize:   models.ErrCodeInvalidPayment,
+	channels.ErrInvalidSignature:     models.ErrCodeInvalidSignature,
+	channels.ErrNotStatusOpen:        models.ErrCodeChannelNotOpen,
+	storage.ErrNotFound:              models.ErrCodeChannelNotFound,
+	storage.ErrConcurrentUpdate:      models.ErrCodeConcurrentUpdate,
+	storage.ErrInvoiceNotFound:       models.ErrCodeInvalidInvoice,
+	storage.ErrInvoicePaid:           models.ErrCodeInvalidInvoice,
+}
+
+func errorCode(err error) (models.ErrorCode, bool) {
+	if ee, ok := err.(ExposableError); ok {
+		return ee.Code(), true
+	}
+	code, ok := errorCodes[err]
+	return code, ok
+}
+
+// ToModelError converts an error returned by the receiver into the error
+// returned to the sender. Errors that aren't known to be safe to expose are
+// reported as internal errors without any detail.
+func ToModelError(err error) *models.Error {
+	code, ok := errorCode(err)
+	if !ok {
+		return &models.Error{Code: models.ErrCodeInternal, Message: "error"}
+	}
+	return &models.Error{Code: code, Message: err.Error()}
+}
@@ -0,0 +1,31 @@
+package receiver
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/luno/moonbeam/channels"
+	"github.com/luno/moonbeam/models"
+	"github.com/luno/moonbeam/storage"
+)
+
+func TestToModelError(t *testing.T) {
+	tests := []struct {
+		err  error
+		code models.ErrorCode
+		msg  string
+	}{
+		{channels.ErrInsufficientCapacity, models.ErrCodeInsufficientCapacity, "amount exceeds channel capacity"},
+		{storage.ErrConcurrentUpdate, models.ErrCodeConcurrentUpdate, "concurrent update"},
+		{ErrLockTimeout, models.ErrCodeChannelBusy, "channel is busy"},
+		{NewExposableError("bad"), models.ErrCodeInvalidRequest, "bad"},
+		{errors.New("secret"), models.ErrCodeInternal, "error"},
+	}
+
+	for _, test := range tests {
+		me := ToModelError(test.err)
+		if me.Code != test.code || me.Message != test.msg {
+			t.Errorf("%v: unexpected error: %+v", test.err, me)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package receiver
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/luno/moonbeam/channels"
+	"github.com/luno/moonbeam/logging"
+	"github.com/luno/moonbeam/storage"
+)
+
+type EventType string
+
+const (
+	EventChannelOpened    EventType = "channel_opened"
+	EventPaymentAccepted  EventType = "payment_accepted"
+	EventChannelClosing   EventType = "channel_closing"
+	EventClosureBroadcast EventType = "closure_broadcast"
+	EventChannelClosed    EventType = "channel_closed"
+)
+
+// Event describes a change to a channel. Events are written to the outbox in
+// the same storage transaction as the change itself, so consumers that track
+// the last Seq they processed see every event exactly once. The exception is
+// EventClosureBroadcast, which is written once per closure transaction after
+// it has been broadcast. If that write fails, the event is written when the
+// transaction is broadcast again.
+type Event struct {
+	Seq       int64     `json:"seq"`
+	Type      EventType `json:"type"`
+	ChannelID string    `json:"channelId"`
+	Time      time.Time `json:"time"`
+
+	Status  channels.Status `json:"status"`
+	Count   int             `json:"count"`
+	Balance int64           `json:"balance"`
+
+	// Set for EventPaymentAccepted.
+	Amount  int64  `json:"amount,omitempty"`
+	Target  string `json:"target,omitempty"`
+	Invoice string `json:"invoice,omitempty"`
+	Payment []byte `json:"payment,omitempty"`
+
+	// Set for EventClosureBroadcast.
+	CloseTxID string `json:"closeTxId,omitempty"`
+}
+
+func newEvent(typ EventType, id string, s channels.SharedState) Event {
+	return Event{
+		Type:      typ,
+		ChannelID: id,
+		Time:      time.Now(),
+		Status:    s.Status,
+		Count:     s.Count,
+		Balance:   s.Balance,
+	}
+}
+
+func toStorageEvents(events ...Event) ([]storage.Event, error) {
+	var sl []storage.Event
+	for _, e := range events {
+		buf, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		sl = append(sl, storage.Event{
+			Type:      string(e.Type),
+			ChannelID: e.ChannelID,
+			Data:      buf,
+		})
+	}
+	return sl, nil
+}
+
+func fromStorageEvent(se storage.Event) (Event, error) {
+	var e Event
+	if err := json.Unmarshal(se.Data, &e); err != nil {
+		return Event{}, err
+	}
+	e.Seq = se.Seq
+	return e, nil
+}
+
+// Events returns up to limit events with Seq greater than after.
+func (r *Receiver) Events(after int64, limit int) ([]Event, error) {
+	sl, err := r.db.ListEvents(after, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []Event
+	for _, se := range sl {
+		e, err := fromStorageEvent(se)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// eventHub wakes up subscriptions when new events are written.
+type eventHub struct {
+	mu   sync.Mutex
+	wake chan struct{}
+}
+
+func (h *eventHub) wait() <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.wake == nil {
+		h.wake = make(chan struct{})
+	}
+	return h.wake
+}
+
+func (h *eventHub) notify() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.wake != nil {
+		close(h.wake)
+		h.wake = nil
+	}
+}
+
+const (
+	subscriptionBatchSize = 100
+
+	// Events may also be written by other instances sharing the storage, so
+	// subscriptions poll even if they aren't woken up.
+	subscriptionPollInterval = 5 * time.Second
+)
+
+// Subscription delivers events in order on C until it is closed.
+type Subscription struct {
+	C <-chan Event
+
+	c    chan Event
+	done chan struct{}
+	once sync.Once
+}
+
+// Close stops the subscription. C is closed once delivery has stopped.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+// Subscribe returns a subscription for events with Seq greater than after.
+// Events already in the outbox are delivered first, followed by new events as
+// they are emitted. Consumers that need exactly-once processing should
+// persist the Seq of the last event they processed and resume from there.
+func (r *Receiver) Subscribe(after int64) *Subscription {
+	c := make(chan Event)
+	s := &Subscription{
+		C:    c,
+		c:    c,
+		done: make(chan struct{}),
+	}
+	go r.deliver(s, after)
+	return s
+}
+
+func (r *Receiver) deliver(s *Subscription, after int64) {
+	defer close(s.c)
+
+	for {
+		wake := r.hub.wait()
+
+		events, err := r.Events(after, subscriptionBatchSize)
+		if err != nil {
+			r.Logger.Log(logging.Error, "subscription error",
+				logging.Fields{"error": err})
+		}
+
+		for _, e := range events {
+			select {
+			case s.c <- e:
+				after = e.Seq
+			case <-s.done:
+				return
+			}
+		}
+
+		if len(events) == subscriptionBatchSize {
+			continue
+		}
+
+		select {
+		case <-wake:
+		case <-time.After(subscriptionPollInterval):
+		case <-s.done:
+			return
+		}
+	}
+}
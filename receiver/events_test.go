@@ -0,0 +1,127 @@
+package receiver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/luno/moonbeam/channels"
+	"github.com/luno/moonbeam/storage"
+)
+
+func mustEvents(t *testing.T, events ...Event) []storage.Event {
+	sl, err := toStorageEvents(events...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sl
+}
+
+func TestEventsWrittenWithState(t *testing.T) {
+	r, db, cleanup := newTestReceiver(t)
+	defer cleanup()
+
+	var s channels.SharedState
+	err := db.Create(storage.Record{ID: "a-0", SharedState: s},
+		mustEvents(t, newEvent(EventChannelOpened, "a-0", s)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := s
+	next.Count = 1
+	next.Balance = 1000
+	e := newEvent(EventPaymentAccepted, "a-0", next)
+	e.Amount = 1000
+	if err := db.Update("a-0", s, next, []byte("p1"), "", mustEvents(t, e)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A concurrent update must not leave its events behind.
+	err = db.Update("a-0", s, next, []byte("p2"), "", mustEvents(t, e))
+	if err != storage.ErrConcurrentUpdate {
+		t.Fatalf("Expected ErrConcurrentUpdate, got %v", err)
+	}
+
+	events, err := r.Events(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(events))
+	}
+	if events[0].Type != EventChannelOpened || events[0].Seq != 1 {
+		t.Errorf("Unexpected first event: %+v", events[0])
+	}
+	if events[1].Type != EventPaymentAccepted || events[1].Seq != 2 ||
+		events[1].Amount != 1000 || events[1].Balance != 1000 {
+		t.Errorf("Unexpected second event: %+v", events[1])
+	}
+
+	payments, err := db.ListPayments("a-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 1 {
+		t.Errorf("Expected 1 payment, got %d", len(payments))
+	}
+}
+
+func appendTestEvents(t *testing.T, db storage.Storage, n int) {
+	var sl []Event
+	for i := 0; i < n; i++ {
+		sl = append(sl, newEvent(EventPaymentAccepted, "a-0", channels.SharedState{}))
+	}
+	if err := db.AppendEvents(mustEvents(t, sl...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receive reads n events from the subscription and checks that they follow
+// after in sequence.
+func receive(t *testing.T, s *Subscription, after int64, n int) int64 {
+	for i := 0; i < n; i++ {
+		select {
+		case e := <-s.C:
+			if e.Seq != after+1 {
+				t.Fatalf("Expected seq %d, got %d", after+1, e.Seq)
+			}
+			after = e.Seq
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timeout waiting for event %d", after+1)
+		}
+	}
+	return after
+}
+
+func TestSubscribe(t *testing.T) {
+	r, db, cleanup := newTestReceiver(t)
+	defer cleanup()
+
+	// More than two batches.
+	const n = 2*subscriptionBatchSize + 50
+	appendTestEvents(t, db, n)
+
+	s := r.Subscribe(0)
+	last := receive(t, s, 0, n)
+
+	// New events are delivered once the subscription is woken up.
+	appendTestEvents(t, db, 3)
+	r.hub.notify()
+	last = receive(t, s, last, 3)
+
+	select {
+	case e := <-s.C:
+		t.Errorf("Unexpected extra event: %d", e.Seq)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.Close()
+	for range s.C {
+	}
+
+	// Resuming delivers exactly the events after the cursor, across the
+	// batch boundary.
+	s = r.Subscribe(subscriptionBatchSize - 1)
+	defer s.Close()
+	receive(t, s, subscriptionBatchSize-1, int(last)-subscriptionBatchSize+1)
+}
@@ -0,0 +1,24 @@
+package receiver
+
+import (
+	"time"
+)
+
+// CheckStorage verifies that the receiver's storage can be read and written.
+func (r *Receiver) CheckStorage() error {
+	return r.db.Check()
+}
+
+// ChainTip returns the height and timestamp of the chain backend's best
+// block.
+func (r *Receiver) ChainTip() (int64, time.Time, error) {
+	hash, err := r.bc.GetBestBlockHash()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	header, err := r.bc.GetBlockHeaderVerbose(hash)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return int64(header.Height), time.Unix(header.Time, 0), nil
+}
@@ -0,0 +1,113 @@
+package receiver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/luno/moonbeam/address"
+	"github.com/luno/moonbeam/channels"
+	"github.com/luno/moonbeam/models"
+	"github.com/luno/moonbeam/storage"
+)
+
+// DefaultInvoiceTTL is the lifetime of invoices created without one.
+const DefaultInvoiceTTL = time.Hour
+
+var errNoDomainKey = errors.New("a domain key is required to issue invoices")
+
+func genInvoiceID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// CreateInvoice issues an invoice for a payment of amount to target that
+// expires after ttl, or DefaultInvoiceTTL if ttl is zero. The invoice is
+// signed with DomainKey so that senders can check that it was issued by the
+// domain.
+func (r *Receiver) CreateInvoice(target string, amount int64, memo string, ttl time.Duration) (*models.Invoice, error) {
+	if r.DomainKey == nil {
+		return nil, errNoDomainKey
+	}
+	if amount <= 0 {
+		return nil, NewExposableError("invalid amount")
+	}
+
+	a, err := address.Parse(target, r.Net)
+	if err != nil {
+		return nil, NewExposableError(err.Error())
+	}
+	ok, reason, err := r.dir.CheckTarget(a.String())
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, newCodedError(models.ErrCodeUnknownTarget, reason)
+	}
+
+	if ttl <= 0 {
+		ttl = DefaultInvoiceTTL
+	}
+	id, err := genInvoiceID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+
+	inv := models.Invoice{
+		ID:      id,
+		Target:  a.String(),
+		Amount:  amount,
+		Memo:    memo,
+		Expires: now.Add(ttl).Unix(),
+	}
+	if err := channels.SignInvoice(&inv, r.DomainKey); err != nil {
+		return nil, err
+	}
+
+	if err := r.db.CreateInvoice(storage.InvoiceRecord{Invoice: inv, Created: now}); err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+// Invoice returns an issued invoice and whether it has been paid.
+func (r *Receiver) Invoice(id string) (*storage.InvoiceRecord, error) {
+	return r.db.GetInvoice(id)
+}
+
+func (r *Receiver) ListInvoices() ([]storage.InvoiceRecord, error) {
+	return r.db.ListInvoices()
+}
+
+// checkInvoice returns the reason the payment can't pay its invoice at now,
+// or an empty reason if it can. Storage only allows the invoice to be paid
+// once, even if two channels race to pay it.
+func (r *Receiver) checkInvoice(p *models.Payment, now time.Time) (string, error) {
+	rec, err := r.db.GetInvoice(p.Invoice)
+	if err == storage.ErrInvoiceNotFound {
+		return "unknown invoice", nil
+	} else if err != nil {
+		return "", err
+	}
+	inv := rec.Invoice
+
+	if rec.PaidBy != "" {
+		return "invoice is already paid", nil
+	}
+	if now.Unix() >= inv.Expires {
+		return "invoice has expired", nil
+	}
+	if p.Amount != inv.Amount {
+		return "amount doesn't match invoice", nil
+	}
+	if a, err := address.Parse(p.Target, r.Net); err != nil || a.String() != inv.Target {
+		return "target doesn't match invoice", nil
+	}
+
+	return "", nil
+}
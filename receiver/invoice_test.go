@@ -0,0 +1,119 @@
+package receiver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+
+	"github.com/luno/moonbeam/address"
+	"github.com/luno/moonbeam/channels"
+	"github.com/luno/moonbeam/models"
+	"github.com/luno/moonbeam/storage"
+	"github.com/luno/moonbeam/storage/filesystem"
+)
+
+const testTarget = "mgzdqkEjYEjR5QNdJxYFnCKZHuNYa5bUZ2+mb7vCiK@example.com"
+
+func TestInvoice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moonbeam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	net := &chaincfg.TestNet3Params
+	db := filesystem.NewFilesystemStorage(filepath.Join(dir, "state.json"))
+	r := NewReceiver(net, nil, nil, db, NewDomainDirectory(net, "example.com"), "", "token")
+
+	if _, err := r.CreateInvoice(testTarget, 1000, "", 0); err != errNoDomainKey {
+		t.Errorf("Expected errNoDomainKey, got %v", err)
+	}
+
+	r.DomainKey, err = btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.CreateInvoice("mgzdqkEjYEjR5QNdJxYFnCKZHuNYa5bUZ2+mb7vCiK@example.org", 1000, "", 0); err == nil {
+		t.Errorf("Expected error for target of a different domain")
+	}
+
+	inv, err := r.CreateInvoice(testTarget, 1000, "Order 12", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := channels.VerifyInvoice(inv); err != nil {
+		t.Errorf("Unexpected error verifying invoice: %v", err)
+	}
+	tampered := *inv
+	tampered.Amount = 1
+	if err := channels.VerifyInvoice(&tampered); err != channels.ErrInvalidSignature {
+		t.Errorf("Expected ErrInvalidSignature, got %v", err)
+	}
+
+	otherTarget, err := address.Encode("mnRYb3Zpn6CUR9TNDL6GGGNY9jjU1XURD5", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	p := models.Payment{Amount: 1000, Target: testTarget, Invoice: inv.ID}
+	tests := []struct {
+		p      models.Payment
+		now    time.Time
+		reason string
+	}{
+		{p, now, ""},
+		{models.Payment{Amount: 1000, Target: testTarget, Invoice: "unknown"}, now, "unknown invoice"},
+		{models.Payment{Amount: 999, Target: testTarget, Invoice: inv.ID}, now, "amount doesn't match invoice"},
+		{models.Payment{Amount: 1000, Target: otherTarget, Invoice: inv.ID}, now, "target doesn't match invoice"},
+		{p, time.Unix(inv.Expires, 0), "invoice has expired"},
+	}
+	for i, test := range tests {
+		reason, err := r.checkInvoice(&test.p, test.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason != test.reason {
+			t.Errorf("%d: expected reason %q, got %q", i, test.reason, reason)
+		}
+	}
+
+	// The invoice can only be paid once, even by different channels.
+	for _, id := range []string{"a-0", "b-0"} {
+		if err := db.Create(storage.Record{ID: id}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var prev channels.SharedState
+	next := prev
+	next.Count = 1
+	next.Balance = 1000
+	if err := db.Update("a-0", prev, next, []byte("payment"), inv.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update("b-0", prev, next, []byte("payment"), inv.ID, nil); err != storage.ErrInvoicePaid {
+		t.Errorf("Expected ErrInvoicePaid, got %v", err)
+	}
+
+	reason, err := r.checkInvoice(&p, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason != "invoice is already paid" {
+		t.Errorf("Unexpected reason: %q", reason)
+	}
+
+	rec, err := r.Invoice(inv.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.PaidBy != "a-0" {
+		t.Errorf("Unexpected PaidBy: %s", rec.PaidBy)
+	}
+}
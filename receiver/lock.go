@@ -0,0 +1,129 @@
+package receiver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/luno/moonbeam/logging"
+	"github.com/luno/moonbeam/models"
+	"github.com/luno/moonbeam/storage"
+)
+
+// Locker serializes operations on the same channel.
+type Locker interface {
+	// Lock blocks until the named lock is held and returns a function that
+	// releases it.
+	Lock(name string) (unlock func(), err error)
+}
+
+type memLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// MemLocker serializes operations within a single process.
+type MemLocker struct {
+	mu    sync.Mutex
+	locks map[string]*memLock
+}
+
+func NewMemLocker() *MemLocker {
+	return &MemLocker{
+		locks: make(map[string]*memLock),
+	}
+}
+
+func (l *MemLocker) Lock(name string) (func(), error) {
+	l.mu.Lock()
+	ml, ok := l.locks[name]
+	if !ok {
+		ml = new(memLock)
+		l.locks[name] = ml
+	}
+	ml.refs++
+	l.mu.Unlock()
+
+	ml.mu.Lock()
+
+	return func() {
+		ml.mu.Unlock()
+
+		l.mu.Lock()
+		ml.refs--
+		if ml.refs == 0 {
+			delete(l.locks, name)
+		}
+		l.mu.Unlock()
+	}, nil
+}
+
+var ErrLockTimeout = newCodedError(models.ErrCodeChannelBusy, "channel is busy")
+
+const (
+	leaseRetryInterval = 50 * time.Millisecond
+	leaseWaitTimeout   = 10 * time.Second
+)
+
+// LeaseLocker serializes operations between instances sharing the same
+// storage by holding a lease in the storage. The lease expires after ttl in
+// case the holder dies, so ttl must be longer than any single operation.
+type LeaseLocker struct {
+	Logger logging.Logger
+
+	// Timeout is how long Lock waits for the lease before giving up with
+	// ErrLockTimeout.
+	Timeout time.Duration
+
+	db    storage.Storage
+	owner string
+	ttl   time.Duration
+	local *MemLocker
+}
+
+func NewLeaseLocker(db storage.Storage, owner string, ttl time.Duration) *LeaseLocker {
+	return &LeaseLocker{
+		Logger:  logging.NewStdLogger(logging.Info),
+		Timeout: leaseWaitTimeout,
+		db:      db,
+		owner:   owner,
+		ttl:     ttl,
+		local:   NewMemLocker(),
+	}
+}
+
+func (l *LeaseLocker) Lock(name string) (func(), error) {
+	// Avoid contending for the lease with ourselves.
+	unlock, err := l.local.Lock(name)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(l.Timeout)
+	for {
+		ok, err := l.db.AcquireLease(name, l.owner, l.ttl)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			unlock()
+			return nil, ErrLockTimeout
+		}
+		time.Sleep(leaseRetryInterval)
+	}
+
+	return func() {
+		if err := l.db.ReleaseLease(name, l.owner); err != nil {
+			l.Logger.Log(logging.Error, "release lease error",
+				logging.Fields{"lease": name, "error": err})
+		}
+		unlock()
+	}, nil
+}
+
+func (r *Receiver) lockChannel(id string) (func(), error) {
+	return r.Locker.Lock("channel:" + id)
+}
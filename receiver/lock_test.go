@@ -0,0 +1,165 @@
+package receiver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/luno/moonbeam/storage/filesystem"
+)
+
+func TestMemLocker(t *testing.T) {
+	l := NewMemLocker()
+
+	var wg sync.WaitGroup
+	var counter int
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := l.Lock("a")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer unlock()
+			c := counter
+			counter = c + 1
+		}()
+	}
+	wg.Wait()
+
+	if counter != 100 {
+		t.Errorf("Unexpected counter: %d", counter)
+	}
+	if len(l.locks) != 0 {
+		t.Errorf("Expected locks to be released, got: %d", len(l.locks))
+	}
+}
+
+func TestMemLockerIndependent(t *testing.T) {
+	l := NewMemLocker()
+
+	unlockA, err := l.Lock("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlockA()
+
+	// A different name must not block.
+	unlockB, err := l.Lock("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlockB()
+}
+
+// newTestLeaseLockers returns lockers for two instances sharing the same
+// state file, and a function to remove it.
+func newTestLeaseLockers(t *testing.T, ttl time.Duration) (*LeaseLocker, *LeaseLocker, func()) {
+	dir, err := ioutil.TempDir("", "moonbeam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "state.json")
+
+	a := NewLeaseLocker(filesystem.NewFilesystemStorage(path), "a", ttl)
+	b := NewLeaseLocker(filesystem.NewFilesystemStorage(path), "b", ttl)
+	return a, b, func() { os.RemoveAll(dir) }
+}
+
+func TestLeaseLockerContention(t *testing.T) {
+	a, b, cleanup := newTestLeaseLockers(t, time.Minute)
+	defer cleanup()
+
+	var wg sync.WaitGroup
+	var held, counter int32
+	for i := 0; i < 20; i++ {
+		l := a
+		if i%2 == 1 {
+			l = b
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := l.Lock("a")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer unlock()
+			if atomic.AddInt32(&held, 1) != 1 {
+				t.Errorf("Lease held by more than one instance")
+			}
+			atomic.AddInt32(&counter, 1)
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&held, -1)
+		}()
+	}
+	wg.Wait()
+
+	if counter != 20 {
+		t.Errorf("Unexpected counter: %d", counter)
+	}
+}
+
+func TestLeaseLockerTimeout(t *testing.T) {
+	a, b, cleanup := newTestLeaseLockers(t, time.Minute)
+	defer cleanup()
+	b.Timeout = 100 * time.Millisecond
+
+	unlock, err := a.Lock("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Lock("a"); err != ErrLockTimeout {
+		t.Errorf("Expected ErrLockTimeout, got %v", err)
+	}
+
+	// A different name must not block.
+	unlockB, err := b.Lock("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlockB()
+
+	unlock()
+	unlockB, err = b.Lock("a")
+	if err != nil {
+		t.Fatalf("Expected lease to be free after unlock, got %v", err)
+	}
+	unlockB()
+}
+
+func TestLeaseLockerExpiry(t *testing.T) {
+	a, b, cleanup := newTestLeaseLockers(t, 200*time.Millisecond)
+	defer cleanup()
+	b.Timeout = 5 * time.Second
+
+	// a dies while holding the lease.
+	unlockA, err := a.Lock("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t0 := time.Now()
+	unlockB, err := b.Lock("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(t0); d < 150*time.Millisecond {
+		t.Errorf("Lease taken over before it expired after %v", d)
+	}
+
+	// Releasing the expired lease must not release b's lease.
+	unlockA()
+	a.Timeout = 50 * time.Millisecond
+	if _, err := a.Lock("a"); err != ErrLockTimeout {
+		t.Errorf("Expected ErrLockTimeout, got %v", err)
+	}
+	unlockB()
+}
@@ -0,0 +1,201 @@
+package receiver
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/luno/moonbeam/channels"
+	"github.com/luno/moonbeam/logging"
+)
+
+// Metrics are the Prometheus metrics of a receiver. A nil *Metrics discards
+// all measurements.
+type Metrics struct {
+	paymentsAccepted       prometheus.Counter
+	amountAccepted         prometheus.Counter
+	paymentsRejected       *prometheus.CounterVec
+	watcherDuration        prometheus.Histogram
+	watcherErrors          prometheus.Counter
+	blocksUntilSoftTimeout prometheus.Gauge
+	broadcastFailures      prometheus.Counter
+
+	channels *channelCollector
+}
+
+// NewMetrics creates the metrics of r. labels are added to every metric,
+// e.g. to tell apart the domains served by one process. The metrics must be
+// registered before they are reported.
+func NewMetrics(r *Receiver, labels prometheus.Labels) *Metrics {
+	return &Metrics{
+		paymentsAccepted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "moonbeam_payments_accepted_total",
+			Help:        "Number of payments accepted.",
+			ConstLabels: labels,
+		}),
+		amountAccepted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "moonbeam_payments_accepted_satoshis_total",
+			Help:        "Sum of the amounts of payments accepted.",
+			ConstLabels: labels,
+		}),
+		paymentsRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "moonbeam_payments_rejected_total",
+			Help:        "Number of payments rejected, by error code.",
+			ConstLabels: labels,
+		}, []string{"reason"}),
+		watcherDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        "moonbeam_watcher_duration_seconds",
+			Help:        "Duration of blockchain watcher runs.",
+			ConstLabels: labels,
+			Buckets:     prometheus.ExponentialBuckets(0.01, 4, 8),
+		}),
+		watcherErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "moonbeam_watcher_errors_total",
+			Help:        "Number of blockchain watcher runs that failed.",
+			ConstLabels: labels,
+		}),
+		blocksUntilSoftTimeout: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "moonbeam_blocks_until_soft_timeout",
+			Help:        "Blocks until the next open channel reaches its soft timeout, +Inf if there are none.",
+			ConstLabels: labels,
+		}),
+		broadcastFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "moonbeam_broadcast_failures_total",
+			Help:        "Number of closure transactions that failed to broadcast.",
+			ConstLabels: labels,
+		}),
+		channels: newChannelCollector(r, labels),
+	}
+}
+
+func (m *Metrics) Register(reg prometheus.Registerer) error {
+	cs := []prometheus.Collector{
+		m.paymentsAccepted,
+		m.amountAccepted,
+		m.paymentsRejected,
+		m.watcherDuration,
+		m.watcherErrors,
+		m.blocksUntilSoftTimeout,
+		m.broadcastFailures,
+		m.channels,
+	}
+	for _, c := range cs {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Metrics) paymentAccepted(amount int64) {
+	if m == nil {
+		return
+	}
+	m.paymentsAccepted.Inc()
+	m.amountAccepted.Add(float64(amount))
+}
+
+func (m *Metrics) paymentRejected(err error) {
+	if m == nil {
+		return
+	}
+	code := ToModelError(err).Code
+	m.paymentsRejected.WithLabelValues(string(code)).Inc()
+}
+
+func (m *Metrics) watcherRun(start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.watcherDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.watcherErrors.Inc()
+	}
+}
+
+// setBlocksUntilSoftTimeout records the smallest number of blocks until an
+// open channel reaches its soft timeout. n is negative if there are no open
+// channels.
+func (m *Metrics) setBlocksUntilSoftTimeout(n int64) {
+	if m == nil {
+		return
+	}
+	if n < 0 {
+		m.blocksUntilSoftTimeout.Set(math.Inf(1))
+	} else {
+		m.blocksUntilSoftTimeout.Set(float64(n))
+	}
+}
+
+func (m *Metrics) broadcastFailed() {
+	if m == nil {
+		return
+	}
+	m.broadcastFailures.Inc()
+}
+
+// channelCollector reports the channels in storage when scraped so that the
+// values are always consistent with the stored state.
+type channelCollector struct {
+	r        *Receiver
+	count    *prometheus.Desc
+	capacity *prometheus.Desc
+	balance  *prometheus.Desc
+}
+
+func newChannelCollector(r *Receiver, labels prometheus.Labels) *channelCollector {
+	status := []string{"status"}
+	return &channelCollector{
+		r: r,
+		count: prometheus.NewDesc("moonbeam_channels",
+			"Number of channels, by status.", status, labels),
+		capacity: prometheus.NewDesc("moonbeam_channel_capacity_satoshis",
+			"Total capacity of channels, by status.", status, labels),
+		balance: prometheus.NewDesc("moonbeam_channel_balance_satoshis",
+			"Total balance of channels, by status.", status, labels),
+	}
+}
+
+func (c *channelCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.count
+	ch <- c.capacity
+	ch <- c.balance
+}
+
+func (c *channelCollector) Collect(ch chan<- prometheus.Metric) {
+	recs, err := c.r.db.List()
+	if err != nil {
+		c.r.Logger.Log(logging.Error, "metrics: list channels error",
+			logging.Fields{"error": err})
+		return
+	}
+
+	type totals struct {
+		count, capacity, balance int64
+	}
+	byStatus := make(map[channels.Status]*totals)
+	for st := channels.Status(channels.StatusCreated); st <= channels.StatusClosed; st++ {
+		byStatus[st] = new(totals)
+	}
+	for _, rec := range recs {
+		t, ok := byStatus[rec.SharedState.Status]
+		if !ok {
+			continue
+		}
+		t.count++
+		t.capacity += rec.SharedState.Capacity
+		t.balance += rec.SharedState.Balance
+	}
+
+	for st, t := range byStatus {
+		label := strings.ToLower(st.String())
+		ch <- prometheus.MustNewConstMetric(c.count,
+			prometheus.GaugeValue, float64(t.count), label)
+		ch <- prometheus.MustNewConstMetric(c.capacity,
+			prometheus.GaugeValue, float64(t.capacity), label)
+		ch <- prometheus.MustNewConstMetric(c.balance,
+			prometheus.GaugeValue, float64(t.balance), label)
+	}
+}
@@ -0,0 +1,86 @@
+package receiver
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/luno/moonbeam/channels"
+	"github.com/luno/moonbeam/storage"
+)
+
+func TestMetricsPerDomain(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	var ms []*Metrics
+	for _, domain := range []string{"example.com", "example.org"} {
+		r, db, cleanup := newTestReceiver(t)
+		defer cleanup()
+		rec := storage.Record{ID: "a-0"}
+		rec.SharedState.Status = channels.StatusOpen
+		if err := db.Create(rec, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		m := NewMetrics(r, prometheus.Labels{"domain": domain})
+		if err := m.Register(reg); err != nil {
+			t.Fatalf("%s: %v", domain, err)
+		}
+		ms = append(ms, m)
+
+		// Registering the same domain twice is an error rather than a
+		// panic.
+		if err := NewMetrics(r, prometheus.Labels{"domain": domain}).Register(reg); err == nil {
+			t.Errorf("%s: expected error registering twice", domain)
+		}
+	}
+
+	ms[0].paymentAccepted(1000)
+	ms[1].paymentAccepted(2000)
+	ms[1].paymentRejected(ErrLockTimeout)
+	ms[0].setBlocksUntilSoftTimeout(-1)
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]map[string]float64)
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			var domain string
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "domain" {
+					domain = l.GetValue()
+				}
+			}
+			if values[mf.GetName()] == nil {
+				values[mf.GetName()] = make(map[string]float64)
+			}
+			switch {
+			case m.Counter != nil:
+				values[mf.GetName()][domain] += m.GetCounter().GetValue()
+			case m.Gauge != nil:
+				values[mf.GetName()][domain] += m.GetGauge().GetValue()
+			}
+		}
+	}
+
+	accepted := values["moonbeam_payments_accepted_satoshis_total"]
+	if accepted["example.com"] != 1000 || accepted["example.org"] != 2000 {
+		t.Errorf("Unexpected amounts accepted: %v", accepted)
+	}
+	rejected := values["moonbeam_payments_rejected_total"]
+	if rejected["example.com"] != 0 || rejected["example.org"] != 1 {
+		t.Errorf("Unexpected rejections: %v", rejected)
+	}
+	chans := values["moonbeam_channels"]
+	if chans["example.com"] != 1 || chans["example.org"] != 1 {
+		t.Errorf("Unexpected channel counts: %v", chans)
+	}
+
+	// A receiver without metrics discards measurements.
+	var m *Metrics
+	m.paymentAccepted(1)
+	m.paymentRejected(ErrLockTimeout)
+	m.setBlocksUntilSoftTimeout(1)
+}
@@ -4,23 +4,25 @@ import (
 	"github.com/btcsuite/btcd/chaincfg"
 )
 
-type policy struct {
+// Policy contains the receiver policy parameters described in the spec.
+type Policy struct {
 	SoftTimeout    int
 	FundingMinConf int
 }
 
-var policies = map[string]policy{
-	"mainnet": policy{
+var policies = map[string]Policy{
+	"mainnet": Policy{
 		SoftTimeout:    144,
 		FundingMinConf: 3,
 	},
-	"testnet3": policy{
+	"testnet3": Policy{
 		SoftTimeout:    32,
 		FundingMinConf: 1,
 	},
 }
 
-func getPolicy(net *chaincfg.Params) policy {
+// DefaultPolicy returns the recommended policy for the network.
+func DefaultPolicy(net *chaincfg.Params) Policy {
 	p, ok := policies[net.Name]
 	if ok {
 		return p
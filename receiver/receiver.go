@@ -2,17 +2,15 @@ package receiver
 
 import (
 	"bytes"
-	"crypto/hmac"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/btcsuite/btcd/btcec"
 	"github.com/btcsuite/btcd/chaincfg"
@@ -22,26 +20,61 @@ import (
 	"github.com/btcsuite/btcutil/hdkeychain"
 
 	"github.com/luno/moonbeam/channels"
+	"github.com/luno/moonbeam/logging"
 	"github.com/luno/moonbeam/models"
 	"github.com/luno/moonbeam/storage"
 )
 
 type Receiver struct {
-	Net            *chaincfg.Params
+	Net    *chaincfg.Params
+	Policy Policy
+
+	// ChannelConfig holds the channel parameters required from senders.
+	ChannelConfig channels.ReceiverConfig
+
+	// TokenKeys are used to issue and validate auth tokens. The first key
+	// issues new tokens. The others are only used for validation so that
+	// keys can be rotated without breaking open channels.
+	TokenKeys []TokenKey
+
+	// TokenTTL limits the lifetime of issued tokens. Zero means that tokens
+	// don't expire.
+	TokenTTL time.Duration
+
+	// Locker serializes Send and Close calls on the same channel. The
+	// default only works within a single process. Use a LeaseLocker if the
+	// storage is shared between instances.
+	Locker Locker
+
+	// Domain is stated in channel certificates.
+	Domain string
+
+	// DomainKey, if set, also signs channel certificates.
+	DomainKey *btcec.PrivateKey
+
+	// TargetSigner, if set, proves ownership of targets in Validate.
+	TargetSigner TargetSigner
+
+	// Metrics, if set, records payments, watcher runs and broadcasts.
+	Metrics *Metrics
+
+	Logger logging.Logger
+
 	ek             *hdkeychain.ExtendedKey
 	bc             *btcrpcclient.Client
 	db             storage.Storage
-	dir            *Directory
+	dir            Directory
 	receiverOutput string
-	authKey        []byte
-	config         channels.ReceiverConfig
+	hub            eventHub
+	watch          watchStatus
+	nonces         nonceCache
 }
 
 func NewReceiver(net *chaincfg.Params,
 	ek *hdkeychain.ExtendedKey,
 	bc *btcrpcclient.Client,
 	db storage.Storage,
-	dir *Directory,
+	dir Directory,
 	destination string,
 	authKey string) *Receiver {
 
@@ -50,16 +83,24 @@ func NewReceiver(net *chaincfg.Params,
 
 	return &Receiver{
 		Net:            net,
+		Policy:         DefaultPolicy(net),
+		ChannelConfig:  config,
+		Locker:         NewMemLocker(),
+		Logger:         logging.NewStdLogger(logging.Info),
+		TokenKeys:      []TokenKey{{ID: "1", Secret: []byte(authKey)}},
 		ek:             ek,
 		bc:             bc,
 		db:             db,
 		dir:            dir,
 		receiverOutput: destination,
-		authKey:        []byte(authKey),
-		config:         config,
 	}
 }
 
+// CheckTarget reports whether the directory accepts payments to target.
+func (r *Receiver) CheckTarget(target string) (bool, string, error) {
+	return r.dir.CheckTarget(target)
+}
+
 func (r *Receiver) Get(txid string, vout uint32) *channels.SharedState {
 	id := getChannelID(txid, vout)
 	rec, err := r.db.Get(id)
@@ -81,26 +122,6 @@ func (r *Receiver) ListPayments(txid string, vout uint32) ([][]byte, error) {
 	return r.db.ListPayments(id)
 }
 
-func (r *Receiver) issue(txid string, vout uint32) []byte {
-	id := getChannelID(txid, vout)
-	mac := hmac.New(sha256.New, r.authKey)
-	mac.Write([]byte(id))
-	return mac.Sum(nil)
-}
-
-func (r *Receiver) issueToken(txid string, vout uint32) string {
-	return base64.StdEncoding.EncodeToString(r.issue(txid, vout))
-}
-
-func (r *Receiver) ValidateToken(txid string, vout uint32, token string) bool {
-	actual, err := base64.StdEncoding.DecodeString(token)
-	if err != nil {
-		return false
-	}
-	expected := r.issue(txid, vout)
-	return hmac.Equal(actual, expected)
-}
-
 func (r *Receiver) getKey(n int) (*btcec.PrivateKey, error) {
 	ek, err := r.ek.Child(uint32(n))
 	if err != nil {
@@ -131,7 +152,7 @@ func (r *Receiver) Create(req models.CreateRequest) (*models.CreateResponse, err
 		return nil, err
 	}
 
-	c, err := channels.NewReceiver(r.config, r.receiverOutput, privKey)
+	c, err := channels.NewReceiver(r.ChannelConfig, r.receiverOutput, privKey)
 	if err != nil {
 		return nil, err
 	}
@@ -157,7 +178,7 @@ func getTxOut(bc *btcrpcclient.Client, txid string, vout uint32) (*wire.TxOut, i
 		return nil, 0, "", err
 	}
 	if txout == nil {
-		return nil, 0, "", NewExposableError("confirmed utxo not found")
+		return nil, 0, "", newCodedError(models.ErrCodeUTXONotFound, "confirmed utxo not found")
 	}
 
 	if txout.Coinbase {
@@ -190,26 +211,28 @@ func getHeight(bc *btcrpcclient.Client, blockhash string) (int64, error) {
 }
 
 func (r *Receiver) get(id string) (*channels.Receiver, error) {
+	_, c, err := r.load(id)
+	return c, err
+}
+
+// load returns the stored record together with the channel.
+func (r *Receiver) load(id string) (*storage.Record, *channels.Receiver, error) {
 	rec, err := r.db.Get(id)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	privKey, err := r.getKey(rec.KeyPath)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	c, err := channels.LoadReceiver(r.config, rec.SharedState, privKey)
+	c, err := channels.LoadReceiver(r.ChannelConfig, rec.SharedState, privKey)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return c, nil
-}
-
-func (r *Receiver) getPolicy() policy {
-	return getPolicy(r.Net)
+	return rec, c, nil
 }
 
 func (r *Receiver) Open(req models.OpenRequest) (*models.OpenResponse, error) {
@@ -222,8 +245,8 @@ func (r *Receiver) Open(req models.OpenRequest) (*models.OpenResponse, error) {
 		return nil, err
 	}
 
-	if conf < r.getPolicy().FundingMinConf {
-		return nil, NewExposableError("too few confirmations")
+	if conf < r.Policy.FundingMinConf {
+		return nil, newCodedError(models.ErrCodeTooFewConfirmations, "too few confirmations")
 	}
 
 	height, err := getHeight(r.bc, blockHash)
@@ -237,7 +260,7 @@ func (r *Receiver) Open(req models.OpenRequest) (*models.OpenResponse, error) {
 		return nil, err
 	}
 
-	c, err := channels.NewReceiver(r.config, r.receiverOutput, privKey)
+	c, err := channels.NewReceiver(r.ChannelConfig, r.receiverOutput, privKey)
 	if err != nil {
 		return nil, err
 	}
@@ -248,7 +271,7 @@ func (r *Receiver) Open(req models.OpenRequest) (*models.OpenResponse, error) {
 	}
 
 	c.State.BlockHeight = int(height)
-	if conf > r.getPolicy().SoftTimeout {
+	if conf > r.Policy.SoftTimeout {
 		c.State.Status = channels.StatusClosing
 	}
 
@@ -260,86 +283,214 @@ func (r *Receiver) Open(req models.OpenRequest) (*models.OpenResponse, error) {
 		SharedState: c.State,
 	}
 
-	if err := r.db.Create(rec); err != nil {
+	opened := []Event{newEvent(EventChannelOpened, id, c.State)}
+	if c.State.Status == channels.StatusClosing {
+		opened = append(opened, newEvent(EventChannelClosing, id, c.State))
+	}
+	events, err := toStorageEvents(opened...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.db.Create(rec, events); err != nil {
+		return nil, err
+	}
+	r.hub.notify()
+
+	resp.AuthToken, err = r.issueToken(id)
+	if err != nil {
 		return nil, err
 	}
 
-	resp.AuthToken = r.issueToken(req.TxID, req.Vout)
+	resp.Certificate, err = r.certificate(c)
+	if err != nil {
+		return nil, err
+	}
 
 	return resp, nil
 }
 
-func (r *Receiver) validate(c *channels.Receiver, payment []byte) (bool, *models.Payment, error) {
+// certificate returns the channel certificate for an opened channel.
+func (r *Receiver) certificate(c *channels.Receiver) (*models.ChannelCertificate, error) {
+	cert, err := c.Certificate(r.Domain)
+	if err != nil {
+		return nil, err
+	}
+	if r.DomainKey != nil {
+		if err := channels.SignCertificateDomain(cert, r.DomainKey); err != nil {
+			return nil, err
+		}
+	}
+	return cert, nil
+}
+
+// checkTarget parses the payment and asks the directory whether its target
+// can receive payments. It returns the code and reason the payment would be
+// rejected, or an empty reason if it would be accepted. The directory may
+// call an external service, so this is done before taking the channel lock.
+func (r *Receiver) checkTarget(payment []byte) (models.ErrorCode, string, *models.Payment, error) {
 	var p models.Payment
 	if err := json.Unmarshal(payment, &p); err != nil {
-		return false, nil, errors.New("invalid payment")
+		return models.ErrCodeInvalidPayment, "invalid payment", nil, nil
 	}
 
-	valid, err := c.Validate(p.Amount, payment)
-	if err != nil {
-		return false, nil, err
-	}
-	if !valid {
-		return false, nil, nil
-	}
-	has, err := r.dir.HasTarget(p.Target)
+	ok, reason, err := r.dir.CheckTarget(p.Target)
 	if err != nil {
-		return false, nil, err
+		return "", "", nil, err
 	}
-	if !has {
-		return false, nil, nil
+	if !ok {
+		return models.ErrCodeUnknownTarget, reason, nil, nil
 	}
 
-	return true, &p, nil
+	return "", "", &p, nil
+}
+
+// validate returns the code and reason the payment would be rejected by the
+// channel or its invoice, or an empty reason if it would be accepted.
+func (r *Receiver) validate(c *channels.Receiver, p *models.Payment, payment []byte) (models.ErrorCode, string, error) {
+	if err := c.CheckPayment(p.Amount, payment); err == channels.ErrNotStatusOpen {
+		return "", "", err
+	} else if err != nil {
+		code, ok := errorCode(err)
+		if !ok {
+			code = models.ErrCodeInvalidPayment
+		}
+		return code, err.Error(), nil
+	}
+
+	if p.Invoice != "" {
+		reason, err := r.checkInvoice(p, time.Now())
+		if err != nil {
+			return "", "", err
+		}
+		if reason != "" {
+			return models.ErrCodeInvalidInvoice, reason, nil
+		}
+	}
+
+	return "", "", nil
 }
 
 func (r *Receiver) Validate(req models.ValidateRequest) (*models.ValidateResponse, error) {
 	id := getChannelID(req.TxID, req.Vout)
-	c, err := r.get(id)
+	rec, c, err := r.load(id)
 	if err != nil {
 		return nil, err
 	}
+	if rec.Frozen {
+		return &models.ValidateResponse{
+			Code:   errChannelFrozen.Code(),
+			Reason: errChannelFrozen.Error(),
+		}, nil
+	}
 
-	valid, _, err := r.validate(c, req.Payment)
+	code, reason, p, err := r.checkTarget(req.Payment)
+	if err == nil && reason == "" {
+		code, reason, err = r.validate(c, p, req.Payment)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if reason != "" {
+		return &models.ValidateResponse{
+			Code:   code,
+			Reason: reason,
+		}, nil
+	}
 
-	return &models.ValidateResponse{Valid: valid}, nil
+	sig, err := r.signTarget(req.TxID, req.Vout, p, req.Payment)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.ValidateResponse{
+		Valid:     true,
+		TargetSig: sig,
+	}, nil
 }
 
 func (r *Receiver) Send(req models.SendRequest) (*models.SendResponse, error) {
-	id := getChannelID(req.TxID, req.Vout)
-	c, err := r.get(id)
+	resp, amount, err := r.send(req)
 	if err != nil {
+		r.Metrics.paymentRejected(err)
 		return nil, err
 	}
+	r.Metrics.paymentAccepted(amount)
+	return resp, nil
+}
+
+func (r *Receiver) send(req models.SendRequest) (*models.SendResponse, int64, error) {
+	id := getChannelID(req.TxID, req.Vout)
+
+	code, reason, p, err := r.checkTarget(req.Payment)
+	if err != nil {
+		return nil, 0, err
+	}
+	if reason != "" {
+		return nil, 0, newCodedError(code, "invalid payment: "+reason)
+	}
+
+	unlock, err := r.lockChannel(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer unlock()
+
+	rec, c, err := r.load(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if rec.Frozen {
+		return nil, 0, errChannelFrozen
+	}
 	prevState := c.State
 
-	valid, p, err := r.validate(c, req.Payment)
+	code, reason, err = r.validate(c, p, req.Payment)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	if !valid {
-		return nil, errors.New("invalid payment")
+	if reason != "" {
+		return nil, 0, newCodedError(code, "invalid payment: "+reason)
 	}
 
 	resp, err := c.Send(p.Amount, &req)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	newState := c.State
 
-	if err := r.db.Update(id, prevState, newState, req.Payment); err != nil {
-		return nil, err
+	e := newEvent(EventPaymentAccepted, id, newState)
+	e.Amount = p.Amount
+	e.Target = p.Target
+	e.Invoice = p.Invoice
+	e.Payment = req.Payment
+	events, err := toStorageEvents(e)
+	if err != nil {
+		return nil, 0, err
 	}
 
-	return resp, nil
+	if err := r.db.Update(id, prevState, newState, req.Payment, p.Invoice, events); err != nil {
+		return nil, 0, err
+	}
+	r.hub.notify()
+
+	return resp, p.Amount, nil
 }
 
+// Close shares the closure transaction and broadcasts it. The channel is
+// marked as closing before the transaction is returned, and Send holds the
+// same channel lock, so no payment can be accepted after the closure
+// transaction has been shared.
 func (r *Receiver) Close(req models.CloseRequest) (*models.CloseResponse, error) {
 	id := getChannelID(req.TxID, req.Vout)
+
+	unlock, err := r.lockChannel(id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
 	c, err := r.get(id)
 	if err != nil {
 		return nil, err
@@ -351,27 +502,59 @@ func (r *Receiver) Close(req models.CloseRequest) (*models.CloseResponse, error)
 		return nil, err
 	}
 
-	log.Printf("closeTx: %s", hex.EncodeToString(resp.CloseTx))
-
 	newState := c.State
 
-	if err := r.db.Update(id, prevState, newState, nil); err != nil {
+	var events []storage.Event
+	if prevState.Status != channels.StatusClosing {
+		events, err = toStorageEvents(newEvent(EventChannelClosing, id, newState))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := r.db.Update(id, prevState, newState, nil, "", events); err != nil {
 		return nil, err
 	}
+	r.hub.notify()
 
+	if _, err := r.broadcast(id, newState, resp.CloseTx); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// broadcast sends the closure transaction to the network and returns its
+// txid.
+func (r *Receiver) broadcast(id string, s channels.SharedState, closeTx []byte) (string, error) {
 	var tx wire.MsgTx
-	err = tx.BtcDecode(bytes.NewReader(resp.CloseTx), wire.ProtocolVersion)
+	err := tx.BtcDecode(bytes.NewReader(closeTx), wire.ProtocolVersion)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
 	txid, err := r.bc.SendRawTransaction(&tx, false)
 	if err != nil {
-		return nil, err
+		r.Metrics.broadcastFailed()
+		return "", err
 	}
-	log.Printf("closeTx txid: %s", txid.String())
+	r.Logger.Log(logging.Info, "closure transaction broadcast",
+		logging.Fields{"channel": id, "txid": txid.String()})
 
-	return resp, nil
+	e := newEvent(EventClosureBroadcast, id, s)
+	e.CloseTxID = txid.String()
+	events, err := toStorageEvents(e)
+	if err != nil {
+		return "", err
+	}
+	// Rebroadcasting the same transaction doesn't emit the event again.
+	events[0].Key = string(EventClosureBroadcast) + ":" + id + ":" + e.CloseTxID
+	if err := r.db.AppendEvents(events); err != nil {
+		return "", err
+	}
+	r.hub.notify()
+
+	return txid.String(), nil
 }
 
 func (r *Receiver) Status(req models.StatusRequest) (*models.StatusResponse, error) {
@@ -0,0 +1,28 @@
+package receiver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+
+	"github.com/luno/moonbeam/storage/filesystem"
+)
+
+// newTestReceiver returns a receiver for example.com on testnet backed by a
+// temporary state file, and a function to remove it. The receiver has no
+// key chain or bitcoind connection.
+func newTestReceiver(t *testing.T) (*Receiver, *filesystem.FilesystemStorage, func()) {
+	dir, err := ioutil.TempDir("", "moonbeam")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	net := &chaincfg.TestNet3Params
+	db := filesystem.NewFilesystemStorage(filepath.Join(dir, "state.json"))
+	r := NewReceiver(net, nil, nil, db, NewDomainDirectory(net, "example.com"), "", "token")
+
+	return r, db, func() { os.RemoveAll(dir) }
+}
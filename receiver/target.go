@@ -0,0 +1,101 @@
+package receiver
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+
+	"github.com/luno/moonbeam/address"
+	"github.com/luno/moonbeam/models"
+)
+
+// TargetSigner proves ownership of target addresses in ValidateResponse.
+type TargetSigner interface {
+	// SignTarget signs msg with the key of bitcoinAddr using
+	// address.SignTarget. It returns a nil signature if it doesn't hold
+	// the key.
+	SignTarget(bitcoinAddr string, msg []byte) ([]byte, error)
+}
+
+// KeySigner signs with a fixed set of keys for their P2PKH and P2WPKH
+// addresses.
+type KeySigner struct {
+	keys map[string]*btcec.PrivateKey
+}
+
+func NewKeySigner(net *chaincfg.Params, keys []*btcec.PrivateKey) (*KeySigner, error) {
+	s := &KeySigner{keys: make(map[string]*btcec.PrivateKey)}
+	for _, k := range keys {
+		pkHash := btcutil.Hash160(k.PubKey().SerializeCompressed())
+		addr, err := btcutil.NewAddressPubKeyHash(pkHash, net)
+		if err != nil {
+			return nil, err
+		}
+		s.keys[addr.EncodeAddress()] = k
+
+		segwit, err := address.EncodeSegWit(net.Bech32HRPSegwit, 0, pkHash)
+		if err != nil {
+			return nil, err
+		}
+		s.keys[segwit] = k
+	}
+	return s, nil
+}
+
+// LoadKeySigner reads WIF private keys from a file with one key per line.
+// Blank lines and lines starting with # are ignored.
+func LoadKeySigner(net *chaincfg.Params, path string) (*KeySigner, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys []*btcec.PrivateKey
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		wif, err := btcutil.DecodeWIF(line)
+		if err != nil {
+			return nil, err
+		}
+		if !wif.IsForNet(net) {
+			return nil, errors.New("target key is for wrong network")
+		}
+		keys = append(keys, wif.PrivKey)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	return NewKeySigner(net, keys)
+}
+
+func (s *KeySigner) SignTarget(bitcoinAddr string, msg []byte) ([]byte, error) {
+	k, ok := s.keys[bitcoinAddr]
+	if !ok {
+		return nil, nil
+	}
+	return address.SignTarget(k, msg)
+}
+
+// signTarget returns the proof of ownership of the payment's target, if the
+// receiver has a signer holding its key.
+func (r *Receiver) signTarget(txid string, vout uint32, p *models.Payment, payment []byte) ([]byte, error) {
+	if r.TargetSigner == nil {
+		return nil, nil
+	}
+	a, err := address.Parse(p.Target, r.Net)
+	if err != nil {
+		return nil, nil
+	}
+	return r.TargetSigner.SignTarget(a.BitcoinAddr, address.TargetMessage(txid, vout, payment))
+}
@@ -1,31 +1,44 @@
 package receiver
 
 import (
-	"log"
+	"sync"
 	"time"
 
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+
 	"github.com/luno/moonbeam/channels"
+	"github.com/luno/moonbeam/logging"
 	"github.com/luno/moonbeam/models"
 	"github.com/luno/moonbeam/storage"
 )
 
+// softTimeoutHeight returns the block height at which an open channel is
+// closed.
+func (r *Receiver) softTimeoutHeight(s channels.SharedState) int64 {
+	timeout := int64(r.Policy.SoftTimeout)
+	if timeout < s.Timeout {
+		timeout = s.Timeout / 2
+	}
+	return int64(s.BlockHeight) + timeout
+}
+
 func (r *Receiver) checkChannel(blockCount int64, rec storage.Record) error {
 	s := rec.SharedState
+	if s.Status == channels.StatusClosing {
+		return r.checkClosing(rec)
+	}
 	if s.Status != channels.StatusOpen {
 		return nil
 	}
 
-	timeout := int64(r.getPolicy().SoftTimeout)
-	if timeout < s.Timeout {
-		timeout = s.Timeout / 2
-	}
-	cutoff := int64(s.BlockHeight) + timeout
+	cutoff := r.softTimeoutHeight(s)
 
 	if blockCount < cutoff {
 		return nil
 	}
 
-	log.Printf("Closing channel %s due to nearing timeout", rec.ID)
+	r.Logger.Log(logging.Info, "closing channel due to nearing timeout",
+		logging.Fields{"channel": rec.ID})
 
 	req := models.CloseRequest{
 		TxID: s.FundingTxID,
@@ -35,7 +48,87 @@ func (r *Receiver) checkChannel(blockCount int64, rec storage.Record) error {
 	return err
 }
 
+// checkClosing marks the channel as closed once the funding output has been
+// spent in a block.
+func (r *Receiver) checkClosing(rec storage.Record) error {
+	s := rec.SharedState
+
+	txhash, err := chainhash.NewHashFromStr(s.FundingTxID)
+	if err != nil {
+		return err
+	}
+	txout, err := r.bc.GetTxOut(txhash, s.FundingVout, false)
+	if err != nil {
+		return err
+	}
+	if txout != nil {
+		return nil
+	}
+
+	unlock, err := r.lockChannel(rec.ID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	c, err := r.get(rec.ID)
+	if err != nil {
+		return err
+	}
+	prevState := c.State
+
+	if err := c.CloseMined(); err != nil {
+		return err
+	}
+
+	r.Logger.Log(logging.Info, "channel closed",
+		logging.Fields{"channel": rec.ID})
+
+	events, err := toStorageEvents(newEvent(EventChannelClosed, rec.ID, c.State))
+	if err != nil {
+		return err
+	}
+	if err := r.db.Update(rec.ID, prevState, c.State, nil, "", events); err != nil {
+		return err
+	}
+	r.hub.notify()
+
+	return nil
+}
+
+// watchStatus records when the watcher last ran.
+type watchStatus struct {
+	mu          sync.Mutex
+	lastRun     time.Time
+	lastSuccess time.Time
+}
+
+func (s *watchStatus) record(t time.Time, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastRun = t
+	if err == nil {
+		s.lastSuccess = t
+	}
+}
+
+// WatcherStatus returns when the blockchain watcher last finished a run and
+// when it last finished one without errors.
+func (r *Receiver) WatcherStatus() (lastRun, lastSuccess time.Time) {
+	r.watch.mu.Lock()
+	defer r.watch.mu.Unlock()
+	return r.watch.lastRun, r.watch.lastSuccess
+}
+
 func (r *Receiver) watchBlockchain() error {
+	start := time.Now()
+	err := r.checkAllChannels()
+	r.Metrics.watcherRun(start, err)
+	r.watch.record(time.Now(), err)
+	return err
+}
+
+func (r *Receiver) checkAllChannels() error {
 	blockCount, err := r.bc.GetBlockCount()
 	if err != nil {
 		return err
@@ -47,11 +140,25 @@ func (r *Receiver) watchBlockchain() error {
 	}
 
 	var anyErr error
+	next := int64(-1)
 	for _, rec := range recs {
 		if err := r.checkChannel(blockCount, rec); err != nil {
 			anyErr = err
 		}
+
+		s := rec.SharedState
+		if s.Status != channels.StatusOpen {
+			continue
+		}
+		n := r.softTimeoutHeight(s) - blockCount
+		if n < 0 {
+			n = 0
+		}
+		if next < 0 || n < next {
+			next = n
+		}
 	}
+	r.Metrics.setBlocksUntilSoftTimeout(next)
 
 	return anyErr
 }
@@ -59,7 +166,8 @@ func (r *Receiver) watchBlockchain() error {
 func (r *Receiver) WatchBlockchainForever() {
 	for {
 		if err := r.watchBlockchain(); err != nil {
-			log.Printf("watchBlockchain error: %v", err)
+			r.Logger.Log(logging.Error, "watcher error",
+				logging.Fields{"error": err})
 		}
 		time.Sleep(time.Minute)
 	}
@@ -0,0 +1,206 @@
+package receiver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/luno/moonbeam/logging"
+)
+
+const (
+	webhookCursor = "webhook"
+
+	webhookMinBackoff = time.Second
+	webhookMaxBackoff = 10 * time.Minute
+
+	// webhookTimeout bounds each delivery attempt. Delivery is ordered, so a
+	// hung endpoint would otherwise hold up every later event.
+	webhookTimeout = 30 * time.Second
+)
+
+// WebhookPayload is the JSON body POSTed to the webhook URL for every event.
+type WebhookPayload struct {
+	// IdempotencyKey is unique per event. Receivers should use it to make
+	// sure that each payment is credited at most once, since deliveries are
+	// retried until they succeed.
+	IdempotencyKey string `json:"idempotencyKey"`
+	Event          Event  `json:"event"`
+}
+
+// IdempotencyKey is derived from the channel ID and the payment count.
+// Payments are identified by the count alone, while other events include
+// their type since they don't change the count.
+func (e Event) IdempotencyKey() string {
+	key := e.ChannelID + "-" + strconv.Itoa(e.Count)
+	if e.Type != EventPaymentAccepted {
+		key += "-" + string(e.Type)
+	}
+	return key
+}
+
+// WebhookDispatcher POSTs events to a webhook URL. Each request is signed with
+// an HMAC-SHA256 over the timestamp and body using a shared secret:
+//
+//	X-Moonbeam-Timestamp: <unix seconds>
+//	X-Moonbeam-Signature: hex(HMAC-SHA256(secret, timestamp + "." + body))
+//
+// Events are delivered in order. Failed deliveries are retried with
+// exponential backoff and the position of the last delivered event is
+// persisted so that delivery resumes where it left off after a restart.
+type WebhookDispatcher struct {
+	Client *http.Client
+
+	r      *Receiver
+	url    string
+	secret []byte
+
+	// sleep waits for d or until stop is closed, returning false if it was
+	// stopped. It's replaced in tests.
+	sleep func(d time.Duration, stop <-chan struct{}) bool
+}
+
+func NewWebhookDispatcher(r *Receiver, url, secret string) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		Client: &http.Client{Timeout: webhookTimeout},
+		r:      r,
+		url:    url,
+		secret: []byte(secret),
+		sleep:  sleepOrStop,
+	}
+}
+
+func sleepOrStop(d time.Duration, stop <-chan struct{}) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+func nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > webhookMaxBackoff {
+		backoff = webhookMaxBackoff
+	}
+	return backoff
+}
+
+func (d *WebhookDispatcher) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, d.secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *WebhookDispatcher) post(e Event) error {
+	body, err := json.Marshal(WebhookPayload{
+		IdempotencyKey: e.IdempotencyKey(),
+		Event:          e,
+	})
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", e.IdempotencyKey())
+	req.Header.Set("X-Moonbeam-Timestamp", timestamp)
+	req.Header.Set("X-Moonbeam-Signature", d.sign(timestamp, body))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned http status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// deliver posts the event until it succeeds. It returns false if it was
+// stopped first.
+func (d *WebhookDispatcher) deliver(e Event, stop <-chan struct{}) bool {
+	backoff := webhookMinBackoff
+	for {
+		err := d.post(e)
+		if err == nil {
+			return true
+		}
+
+		d.r.Logger.Log(logging.Warn, "webhook delivery failed", logging.Fields{
+			"seq":     e.Seq,
+			"channel": e.ChannelID,
+			"retryIn": backoff,
+			"error":   err,
+		})
+		if !d.sleep(backoff, stop) {
+			return false
+		}
+		backoff = nextBackoff(backoff)
+	}
+}
+
+func (d *WebhookDispatcher) DispatchForever() {
+	d.dispatch(nil)
+}
+
+// dispatch delivers events from the persisted cursor until stop is closed.
+func (d *WebhookDispatcher) dispatch(stop <-chan struct{}) {
+	var cursor int64
+	for {
+		var err error
+		cursor, err = d.r.db.GetCursor(webhookCursor)
+		if err == nil {
+			break
+		}
+		d.r.Logger.Log(logging.Error, "webhook cursor error",
+			logging.Fields{"error": err})
+		if !d.sleep(time.Minute, stop) {
+			return
+		}
+	}
+
+	sub := d.r.Subscribe(cursor)
+	defer sub.Close()
+
+	for {
+		var e Event
+		select {
+		case e = <-sub.C:
+		case <-stop:
+			return
+		}
+
+		if !d.deliver(e, stop) {
+			return
+		}
+
+		for {
+			err := d.r.db.SetCursor(webhookCursor, e.Seq)
+			if err == nil {
+				break
+			}
+			d.r.Logger.Log(logging.Error, "webhook cursor error",
+				logging.Fields{"error": err})
+			if !d.sleep(time.Minute, stop) {
+				return
+			}
+		}
+	}
+}
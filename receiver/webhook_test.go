@@ -0,0 +1,182 @@
+package receiver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testWebhookSecret = "secret"
+
+// webhookServer records the events it receives and fails the first fail
+// requests.
+type webhookServer struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	fail     int
+	seqs     []int64
+	received chan int64
+}
+
+func (s *webhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.t.Error(err)
+		return
+	}
+
+	ts := r.Header.Get("X-Moonbeam-Timestamp")
+	mac := hmac.New(sha256.New, []byte(testWebhookSecret))
+	mac.Write([]byte(ts + "." + string(body)))
+	if r.Header.Get("X-Moonbeam-Signature") != hex.EncodeToString(mac.Sum(nil)) {
+		s.t.Errorf("Invalid signature")
+	}
+
+	var p WebhookPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		s.t.Error(err)
+		return
+	}
+	if p.IdempotencyKey != p.Event.IdempotencyKey() ||
+		r.Header.Get("Idempotency-Key") != p.IdempotencyKey {
+		s.t.Errorf("Unexpected idempotency key: %s", p.IdempotencyKey)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail > 0 {
+		s.fail--
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	s.seqs = append(s.seqs, p.Event.Seq)
+	s.received <- p.Event.Seq
+}
+
+func newWebhookServer(t *testing.T, fail int) (*webhookServer, *httptest.Server) {
+	ws := &webhookServer{t: t, fail: fail, received: make(chan int64, 100)}
+	return ws, httptest.NewServer(ws)
+}
+
+func waitReceived(t *testing.T, ws *webhookServer, seqs ...int64) {
+	for _, seq := range seqs {
+		select {
+		case got := <-ws.received:
+			if got != seq {
+				t.Fatalf("Expected seq %d, got %d", seq, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timeout waiting for seq %d", seq)
+		}
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	r, db, cleanup := newTestReceiver(t)
+	defer cleanup()
+	appendTestEvents(t, db, 1)
+
+	ws, srv := newWebhookServer(t, 3)
+	defer srv.Close()
+
+	var mu sync.Mutex
+	var sleeps []time.Duration
+	d := NewWebhookDispatcher(r, srv.URL, testWebhookSecret)
+	d.sleep = func(dur time.Duration, stop <-chan struct{}) bool {
+		mu.Lock()
+		sleeps = append(sleeps, dur)
+		mu.Unlock()
+		return true
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		d.dispatch(stop)
+		close(done)
+	}()
+	waitReceived(t, ws, 1)
+	close(stop)
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}
+	if len(sleeps) != len(expected) {
+		t.Fatalf("Unexpected sleeps: %v", sleeps)
+	}
+	for i := range expected {
+		if sleeps[i] != expected[i] {
+			t.Errorf("Unexpected sleeps: %v", sleeps)
+		}
+	}
+
+	if b := nextBackoff(webhookMaxBackoff / 2 * 3); b != webhookMaxBackoff {
+		t.Errorf("Expected backoff to be capped, got %v", b)
+	}
+	if d.Client.Timeout == 0 {
+		t.Errorf("Expected client timeout")
+	}
+}
+
+func TestWebhookResume(t *testing.T) {
+	r, db, cleanup := newTestReceiver(t)
+	defer cleanup()
+	appendTestEvents(t, db, 3)
+
+	ws, srv := newWebhookServer(t, 0)
+	defer srv.Close()
+
+	run := func() (stop func()) {
+		s := make(chan struct{})
+		done := make(chan struct{})
+		d := NewWebhookDispatcher(r, srv.URL, testWebhookSecret)
+		go func() {
+			d.dispatch(s)
+			close(done)
+		}()
+		return func() {
+			close(s)
+			<-done
+		}
+	}
+
+	stop := run()
+	waitReceived(t, ws, 1, 2, 3)
+
+	// Wait for the cursor of the last event to be persisted.
+	for i := 0; ; i++ {
+		cursor, err := db.GetCursor(webhookCursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cursor == 3 {
+			break
+		}
+		if i > 500 {
+			t.Fatalf("Unexpected cursor: %d", cursor)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+
+	// A restarted dispatcher continues after the cursor.
+	appendTestEvents(t, db, 2)
+	stop = run()
+	waitReceived(t, ws, 4, 5)
+	stop()
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if len(ws.seqs) != 5 {
+		t.Errorf("Expected each event to be delivered once, got %v", ws.seqs)
+	}
+}
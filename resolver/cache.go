@@ -0,0 +1,95 @@
+package resolver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// CacheEntry is a moonbeam.json document and when it expires.
+type CacheEntry struct {
+	Domain  Domain    `json:"domain"`
+	Expires time.Time `json:"expires"`
+}
+
+// Cache stores resolved domains. Implementations must be safe for concurrent
+// use.
+type Cache interface {
+	Get(domain string) (CacheEntry, bool)
+	Put(domain string, e CacheEntry)
+}
+
+type MemoryCache struct {
+	mu      sync.Mutex
+	entries map[string]CacheEntry
+}
+
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{entries: make(map[string]CacheEntry)}
+}
+
+func (c *MemoryCache) Get(domain string) (CacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[domain]
+	return e, ok
+}
+
+func (c *MemoryCache) Put(domain string, e CacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[domain] = e
+}
+
+// DirCache stores entries as files in a directory so that they survive
+// restarts, e.g. between mbclient invocations. Errors are ignored since the
+// cache is only an optimisation.
+type DirCache struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func NewDirCache(dir string) *DirCache {
+	return &DirCache{dir: dir}
+}
+
+func (c *DirCache) path(domain string) string {
+	return filepath.Join(c.dir, url.PathEscape(domain)+".json")
+}
+
+func (c *DirCache) Get(domain string) (CacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	buf, err := ioutil.ReadFile(c.path(domain))
+	if err != nil {
+		return CacheEntry{}, false
+	}
+	var e CacheEntry
+	if err := json.Unmarshal(buf, &e); err != nil {
+		return CacheEntry{}, false
+	}
+	return e, true
+}
+
+func (c *DirCache) Put(domain string, e CacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return
+	}
+	tmp := c.path(domain) + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return
+	}
+	os.Rename(tmp, c.path(domain))
+}
@@ -3,42 +3,211 @@ package resolver
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/luno/moonbeam/logging"
 )
 
 const MoonbeamPath = "/moonbeam.json"
 
+const defaultMaxResponseBytes = 64 << 10
+
+var (
+	ErrInsecureURL      = errors.New("resolver: url must begin with https://")
+	ErrTrailingSlash    = errors.New("resolver: url must not have a trailing slash")
+	ErrInvalidDomain    = errors.New("resolver: invalid domain")
+	ErrNoReceivers      = errors.New("resolver: no receivers found")
+	ErrTooLarge         = errors.New("resolver: moonbeam.json is too large")
+	ErrTooManyRedirects = errors.New("resolver: too many redirects")
+)
+
 type DomainReceiver struct {
 	URL string `json:"url"`
 }
 
 type Domain struct {
 	Receivers []DomainReceiver `json:"receivers"`
+
+	// Expires is the unix time from which a signed document must no longer
+	// be used.
+	Expires int64 `json:"expires,omitempty"`
+
+	Signatures []DomainSignature `json:"signatures,omitempty"`
 }
 
+// Resolver finds the receiver endpoints of domains. The zero value is usable
+// but NewResolver sets more useful defaults.
 type Resolver struct {
+	// Client defaults to a new http.Client.
 	Client      *http.Client
 	DefaultPort int
+
+	// Logger may be nil to disable logging.
+	Logger logging.Logger
+
+	// Insecure allows http URLs. It must only be used for testing.
+	Insecure bool
+
+	// MaxRedirects is the number of redirects followed when fetching
+	// moonbeam.json. Redirects must stay on https.
+	MaxRedirects int
+
+	// MaxResponseBytes limits the size of moonbeam.json. Zero means
+	// defaultMaxResponseBytes.
+	MaxResponseBytes int64
+
+	// Cache stores moonbeam.json documents for as long as their
+	// Cache-Control header allows. Nil disables caching.
+	Cache Cache
+
+	// Keys stores the pinned domain keys. Nil disables signature checks.
+	Keys KeyStore
+
+	// RequireSignature rejects unsigned documents even for domains that
+	// haven't been seen before.
+	RequireSignature bool
 }
 
 func NewResolver() *Resolver {
 	var c http.Client
 	return &Resolver{
-		Client: &c,
+		Client:           &c,
+		Logger:           logging.NewStdLogger(logging.Info),
+		MaxRedirects:     3,
+		MaxResponseBytes: defaultMaxResponseBytes,
+		Cache:            NewMemoryCache(),
+	}
+}
+
+// log writes to the logger, if there is one.
+func (r *Resolver) log(level logging.Level, msg string, fields logging.Fields) {
+	if r.Logger != nil {
+		r.Logger.Log(level, msg, fields)
 	}
 }
 
+// checkURL validates an endpoint URL according to the spec.
+func (r *Resolver) checkURL(u *url.URL) error {
+	if u.Scheme != "https" && !(r.Insecure && u.Scheme == "http") {
+		return ErrInsecureURL
+	}
+	if u.Host == "" {
+		return fmt.Errorf("resolver: url %s has no host", u)
+	}
+	if strings.HasSuffix(u.Path, "/") {
+		return ErrTrailingSlash
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("resolver: url %s must not have a query or fragment", u)
+	}
+	return nil
+}
+
+// Resolve returns the preferred receiver endpoint of the domain.
 func (r *Resolver) Resolve(domain string) (*url.URL, error) {
-	if u, err := url.Parse(domain); err == nil {
-		if u.Scheme != "" {
-			return u, nil
+	urls, err := r.ResolveAll(domain)
+	if err != nil {
+		return nil, err
+	}
+	return urls[0], nil
+}
+
+// ResolveAll returns all receiver endpoints of the domain in the order
+// listed in its moonbeam.json. If domain is already a URL, it is the only
+// endpoint.
+func (r *Resolver) ResolveAll(domain string) ([]*url.URL, error) {
+	if strings.Contains(domain, "://") {
+		u, err := url.Parse(domain)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.checkURL(u); err != nil {
+			return nil, err
+		}
+		return []*url.URL{u}, nil
+	}
+
+	if domain == "" || strings.ContainsAny(domain, "/?#@ ") {
+		return nil, ErrInvalidDomain
+	}
+
+	d, err := r.getDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.verify(domain, d, time.Now()); err != nil {
+		return nil, err
+	}
+
+	if len(d.Receivers) == 0 {
+		return nil, ErrNoReceivers
+	}
+
+	var urls []*url.URL
+	for _, dr := range d.Receivers {
+		u, err := url.Parse(dr.URL)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.checkURL(u); err != nil {
+			return nil, err
+		}
+		urls = append(urls, u)
+	}
+
+	r.log(logging.Debug, "resolved domain",
+		logging.Fields{"domain": domain, "receivers": len(urls)})
+
+	return urls, nil
+}
+
+func (r *Resolver) getDomain(domain string) (*Domain, error) {
+	now := time.Now()
+	if r.Cache != nil {
+		// A signed document is refetched once it expires, even if the
+		// response could still be cached.
+		e, ok := r.Cache.Get(domain)
+		if ok && now.Before(e.Expires) && (e.Domain.Expires == 0 || now.Unix() < e.Domain.Expires) {
+			return &e.Domain, nil
 		}
 	}
 
+	d, maxAge, err := r.fetch(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Cache != nil && maxAge > 0 {
+		r.Cache.Put(domain, CacheEntry{Domain: *d, Expires: now.Add(maxAge)})
+	}
+	return d, nil
+}
+
+func (r *Resolver) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > r.MaxRedirects {
+		return ErrTooManyRedirects
+	}
+	if req.URL.Scheme != "https" && !(r.Insecure && req.URL.Scheme == "http") {
+		return ErrInsecureURL
+	}
+	return nil
+}
+
+// fetch gets the domain's moonbeam.json and how long it may be cached.
+func (r *Resolver) fetch(domain string) (*Domain, time.Duration, error) {
 	var rurl url.URL
 	rurl.Scheme = "https"
+	if r.Insecure {
+		rurl.Scheme = "http"
+	}
 	rurl.Host = domain
 	rurl.Path = MoonbeamPath
 
@@ -46,24 +215,66 @@ func (r *Resolver) Resolve(domain string) (*url.URL, error) {
 		rurl.Host += ":" + strconv.Itoa(r.DefaultPort)
 	}
 
-	resp, err := r.Client.Get(rurl.String())
+	r.log(logging.Debug, "resolving domain",
+		logging.Fields{"domain": domain, "url": rurl.String()})
+
+	// Copy the client so that the redirect policy doesn't affect other
+	// users of it, e.g. http.DefaultClient.
+	c := http.Client{}
+	if r.Client != nil {
+		c = *r.Client
+	}
+	c.CheckRedirect = r.checkRedirect
+
+	resp, err := c.Get(rurl.String())
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("bad http status code")
+		return nil, 0, fmt.Errorf("resolver: http status %d", resp.StatusCode)
 	}
 
-	var d Domain
-	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
-		return nil, err
+	limit := r.MaxResponseBytes
+	if limit <= 0 {
+		limit = defaultMaxResponseBytes
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, 0, err
+	}
+	if int64(len(buf)) > limit {
+		return nil, 0, ErrTooLarge
 	}
 
-	if len(d.Receivers) == 0 {
-		return nil, errors.New("no url found")
+	var d Domain
+	if err := json.Unmarshal(buf, &d); err != nil {
+		return nil, 0, err
 	}
 
-	return url.Parse(d.Receivers[0].URL)
+	return &d, maxAge(resp.Header), nil
+}
+
+// maxAge returns how long a response may be cached according to its
+// Cache-Control header. Responses without max-age aren't cached.
+func maxAge(h http.Header) time.Duration {
+	var age time.Duration
+	for _, d := range strings.Split(h.Get("Cache-Control"), ",") {
+		d = strings.ToLower(strings.TrimSpace(d))
+		switch {
+		case d == "no-store" || d == "no-cache":
+			return 0
+		case strings.HasPrefix(d, "max-age="):
+			secs, err := strconv.Atoi(strings.TrimPrefix(d, "max-age="))
+			if err != nil || secs < 0 {
+				return 0
+			}
+			age = time.Duration(secs) * time.Second
+		}
+	}
+	if a, err := strconv.Atoi(h.Get("Age")); err == nil && a > 0 {
+		age -= time.Duration(a) * time.Second
+	}
+	return age
 }
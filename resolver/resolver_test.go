@@ -0,0 +1,261 @@
+package resolver
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+
+	"github.com/luno/moonbeam/logging"
+)
+
+func TestCheckURL(t *testing.T) {
+	tests := []struct {
+		url      string
+		insecure bool
+		valid    bool
+	}{
+		{"https://mb.example.com", false, true},
+		{"https://mb.example.com/myprefix", false, true},
+		{"https://mb.example.com/myprefix/", false, false},
+		{"http://mb.example.com", false, false},
+		{"http://mb.example.com", true, true},
+		{"ftp://mb.example.com", true, false},
+		{"https://mb.example.com?a=b", false, false},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := &Resolver{Insecure: test.insecure}
+		if err := r.checkURL(u); (err == nil) != test.valid {
+			t.Errorf("%s: unexpected result %v", test.url, err)
+		}
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		age          string
+		exp          time.Duration
+	}{
+		{"", "", 0},
+		{"max-age=300", "", 300 * time.Second},
+		{"public, max-age=300", "100", 200 * time.Second},
+		{"max-age=300, no-store", "", 0},
+		{"no-cache", "", 0},
+		{"max-age=abc", "", 0},
+	}
+	for _, test := range tests {
+		h := make(http.Header)
+		h.Set("Cache-Control", test.cacheControl)
+		h.Set("Age", test.age)
+		if d := maxAge(h); d != test.exp {
+			t.Errorf("%q: expected %v, got %v", test.cacheControl, test.exp, d)
+		}
+	}
+}
+
+func TestResolveAll(t *testing.T) {
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != MoonbeamPath {
+			http.Redirect(w, r, MoonbeamPath, http.StatusFound)
+			return
+		}
+		fetches++
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, `{"receivers":[{"url":"http://mb1.example.com"},{"url":"http://mb2.example.com/x"}]}`)
+	}))
+	defer srv.Close()
+
+	r := NewResolver()
+	r.Logger = logging.Discard
+	r.Insecure = true
+	domain := strings.TrimPrefix(srv.URL, "http://")
+
+	for i := 0; i < 2; i++ {
+		urls, err := r.ResolveAll(domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(urls) != 2 || urls[1].String() != "http://mb2.example.com/x" {
+			t.Errorf("Unexpected urls: %v", urls)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("Expected 1 fetch, got %d", fetches)
+	}
+
+	r.Insecure = false
+	if _, err := r.ResolveAll(srv.URL); err != ErrInsecureURL {
+		t.Errorf("Expected ErrInsecureURL, got %v", err)
+	}
+}
+
+func TestResolveTooLarge(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.Repeat(" ", 100))
+	}))
+	defer srv.Close()
+
+	r := NewResolver()
+	r.Logger = logging.Discard
+	r.Insecure = true
+	r.MaxResponseBytes = 50
+	if _, err := r.ResolveAll(strings.TrimPrefix(srv.URL, "http://")); err != ErrTooLarge {
+		t.Errorf("Expected ErrTooLarge, got %v", err)
+	}
+}
+
+func TestZeroResolver(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"receivers":[{"url":"http://mb1.example.com"}]}`)
+	}))
+	defer srv.Close()
+
+	// A zero Resolver uses the default client and size limit and doesn't
+	// log.
+	r := &Resolver{Insecure: true}
+	urls, err := r.ResolveAll(strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 1 {
+		t.Errorf("Unexpected urls: %v", urls)
+	}
+}
+
+func newKey(t *testing.T) *btcec.PrivateKey {
+	k, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestVerify(t *testing.T) {
+	k1 := newKey(t)
+	k2 := newKey(t)
+	k3 := newKey(t)
+
+	r := NewResolver()
+	r.Logger = logging.Discard
+	r.Keys = NewMemoryKeyStore()
+
+	now := time.Now()
+	doc := func(keys ...*btcec.PrivateKey) *Domain {
+		d := &Domain{
+			Receivers: []DomainReceiver{{URL: "https://mb.example.com"}},
+			Expires:   now.Add(time.Hour).Unix(),
+		}
+		if err := SignDomain("example.com", d, keys); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	pinned := func() []byte {
+		k, _ := r.Keys.PinnedKey("example.com")
+		return k
+	}
+
+	// The first key seen is pinned.
+	if err := r.verify("example.com", doc(k1), now); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pinned(), k1.PubKey().SerializeCompressed()) {
+		t.Errorf("Expected k1 to be pinned")
+	}
+
+	// The signature covers the domain and receivers.
+	d := doc(k1)
+	d.Receivers[0].URL = "https://evil.example.com"
+	if err := r.verify("example.com", d, now); err != ErrUnsigned {
+		t.Errorf("Expected ErrUnsigned, got %v", err)
+	}
+	if err := r.verify("other.com", doc(k1), now); err != nil {
+		t.Errorf("Unexpected error for a new domain: %v", err)
+	}
+
+	// Unendorsed keys and unsigned documents are rejected.
+	if err := r.verify("example.com", doc(k2), now); err != ErrKeyChanged {
+		t.Errorf("Expected ErrKeyChanged, got %v", err)
+	}
+	if err := r.verify("example.com", doc(), now); err != ErrUnsigned {
+		t.Errorf("Expected ErrUnsigned, got %v", err)
+	}
+
+	// A new key endorsed by the pinned one replaces it.
+	if err := r.verify("example.com", doc(k2, k1), now); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pinned(), k2.PubKey().SerializeCompressed()) {
+		t.Errorf("Expected k2 to be pinned")
+	}
+	if err := r.verify("example.com", doc(k3, k1), now); err != ErrKeyChanged {
+		t.Errorf("Expected ErrKeyChanged, got %v", err)
+	}
+}
+
+func TestVerifyExpires(t *testing.T) {
+	k := newKey(t)
+
+	r := NewResolver()
+	r.Logger = logging.Discard
+	r.Keys = NewMemoryKeyStore()
+
+	t0 := time.Now()
+	doc := func(expires time.Time) *Domain {
+		d := &Domain{
+			Receivers: []DomainReceiver{{URL: "https://mb.example.com"}},
+			Expires:   expires.Unix(),
+		}
+		if err := SignDomain("example.com", d, []*btcec.PrivateKey{k}); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	// An expired document isn't pinned.
+	if err := r.verify("example.com", doc(t0), t0); err != ErrExpired {
+		t.Errorf("Expected ErrExpired, got %v", err)
+	}
+	if _, ok := r.Keys.PinnedKey("example.com"); ok {
+		t.Errorf("Expected no key to be pinned")
+	}
+
+	old := doc(t0.Add(time.Hour))
+	if err := r.verify("example.com", old, t0); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.verify("example.com", old, t0); err != nil {
+		t.Errorf("Unexpected error for the same document: %v", err)
+	}
+
+	// The signature covers the expiry.
+	d := doc(t0.Add(time.Hour))
+	d.Expires = t0.Add(48 * time.Hour).Unix()
+	if err := r.verify("example.com", d, t0); err != ErrUnsigned {
+		t.Errorf("Expected ErrUnsigned, got %v", err)
+	}
+
+	// Once a newer document is seen, older ones are rejected even if they
+	// haven't expired.
+	if err := r.verify("example.com", doc(t0.Add(2*time.Hour)), t0); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.verify("example.com", old, t0); err != ErrReplayed {
+		t.Errorf("Expected ErrReplayed, got %v", err)
+	}
+	if err := r.verify("example.com", doc(t0.Add(2*time.Hour)), t0.Add(2*time.Hour)); err != ErrExpired {
+		t.Errorf("Expected ErrExpired, got %v", err)
+	}
+}
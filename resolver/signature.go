@@ -0,0 +1,242 @@
+package resolver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+
+	"github.com/luno/moonbeam/logging"
+)
+
+var (
+	ErrUnsigned   = errors.New("resolver: moonbeam.json is not signed by the pinned domain key")
+	ErrKeyChanged = errors.New("resolver: domain key changed")
+	ErrExpired    = errors.New("resolver: moonbeam.json has expired")
+	ErrReplayed   = errors.New("resolver: moonbeam.json is older than one seen before")
+)
+
+// DomainSignature signs a moonbeam.json document with a long-term domain
+// key so that a sender who has seen the domain before can detect a
+// document served by someone else, e.g. after DNS hijacking.
+type DomainSignature struct {
+	PubKey    []byte `json:"pubKey"`
+	Signature []byte `json:"signature"`
+}
+
+// DomainMessage returns the message signed by the domain keys.
+func DomainMessage(domain string, expires int64, receivers []DomainReceiver) ([]byte, error) {
+	buf, err := json.Marshal(receivers)
+	if err != nil {
+		return nil, err
+	}
+	msg := fmt.Sprintf("moonbeam domain\n%s\n%d\n%s",
+		strings.ToLower(domain), expires, buf)
+	return []byte(msg), nil
+}
+
+// SignDomain signs the document with the keys. The first key is the current
+// domain key. Further keys are previous keys that endorse it while senders
+// move their pins to the current key. d.Expires must be set since senders
+// reject signed documents that have expired.
+func SignDomain(domain string, d *Domain, keys []*btcec.PrivateKey) error {
+	msg, err := DomainMessage(domain, d.Expires, d.Receivers)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(msg)
+
+	d.Signatures = nil
+	for _, k := range keys {
+		sig, err := k.Sign(hash[:])
+		if err != nil {
+			return err
+		}
+		d.Signatures = append(d.Signatures, DomainSignature{
+			PubKey:    k.PubKey().SerializeCompressed(),
+			Signature: sig.Serialize(),
+		})
+	}
+	return nil
+}
+
+// signedBy returns the public keys with valid signatures on the document in
+// the order they are listed.
+func signedBy(domain string, d *Domain) ([][]byte, error) {
+	msg, err := DomainMessage(domain, d.Expires, d.Receivers)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(msg)
+
+	var keys [][]byte
+	for _, s := range d.Signatures {
+		pubKey, err := btcec.ParsePubKey(s.PubKey, btcec.S256())
+		if err != nil {
+			continue
+		}
+		sig, err := btcec.ParseDERSignature(s.Signature, btcec.S256())
+		if err != nil {
+			continue
+		}
+		if sig.Verify(hash[:], pubKey) {
+			keys = append(keys, pubKey.SerializeCompressed())
+		}
+	}
+	return keys, nil
+}
+
+// KeyStore stores the domain keys pinned by the sender, and the latest
+// expiry time of the signed documents it accepted so that older documents
+// can't be replayed.
+type KeyStore interface {
+	PinnedKey(domain string) ([]byte, bool)
+	PinKey(domain string, pubKey []byte) error
+	PinnedExpires(domain string) int64
+	PinExpires(domain string, expires int64) error
+}
+
+type MemoryKeyStore struct {
+	mu      sync.Mutex
+	keys    map[string][]byte
+	expires map[string]int64
+}
+
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{
+		keys:    make(map[string][]byte),
+		expires: make(map[string]int64),
+	}
+}
+
+func (s *MemoryKeyStore) PinnedKey(domain string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[domain]
+	return k, ok
+}
+
+func (s *MemoryKeyStore) PinKey(domain string, pubKey []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[domain] = pubKey
+	return nil
+}
+
+func (s *MemoryKeyStore) PinnedExpires(domain string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.expires[domain]
+}
+
+func (s *MemoryKeyStore) PinExpires(domain string, expires int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expires[domain] = expires
+	return nil
+}
+
+func containsKey(keys [][]byte, k []byte) bool {
+	for _, e := range keys {
+		if bytes.Equal(e, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkExpires rejects a signed document that has expired or that expires
+// before one accepted earlier, which means it's an old document being
+// replayed. Otherwise the document's expiry is recorded.
+func (r *Resolver) checkExpires(domain string, d *Domain, now time.Time) error {
+	if now.Unix() >= d.Expires {
+		r.log(logging.Error, "moonbeam.json has expired", logging.Fields{
+			"domain":  domain,
+			"expires": d.Expires,
+		})
+		return ErrExpired
+	}
+	latest := r.Keys.PinnedExpires(domain)
+	if d.Expires < latest {
+		r.log(logging.Error, "moonbeam.json is older than one seen before", logging.Fields{
+			"domain":  domain,
+			"expires": d.Expires,
+			"latest":  latest,
+		})
+		return ErrReplayed
+	}
+	if d.Expires > latest {
+		return r.Keys.PinExpires(domain, d.Expires)
+	}
+	return nil
+}
+
+// verify checks the document's signatures against the pinned key. The first
+// key seen for a domain is pinned. A new key is only accepted if the pinned
+// key endorses it. Signed documents must not have expired and must not be
+// older than ones seen before.
+func (r *Resolver) verify(domain string, d *Domain, now time.Time) error {
+	if r.Keys == nil {
+		return nil
+	}
+	domain = strings.ToLower(domain)
+
+	keys, err := signedBy(domain, d)
+	if err != nil {
+		return err
+	}
+
+	pinned, ok := r.Keys.PinnedKey(domain)
+	if !ok {
+		if len(keys) == 0 {
+			if r.RequireSignature {
+				return ErrUnsigned
+			}
+			return nil
+		}
+		if err := r.checkExpires(domain, d, now); err != nil {
+			return err
+		}
+		r.log(logging.Info, "pinned domain key", logging.Fields{
+			"domain": domain,
+			"key":    hex.EncodeToString(keys[0]),
+		})
+		return r.Keys.PinKey(domain, keys[0])
+	}
+
+	if !containsKey(keys, pinned) {
+		if len(keys) == 0 {
+			r.log(logging.Error, "moonbeam.json is no longer signed",
+				logging.Fields{"domain": domain})
+			return ErrUnsigned
+		}
+		r.log(logging.Error, "domain key changed without endorsement", logging.Fields{
+			"domain":  domain,
+			"pinned":  hex.EncodeToString(pinned),
+			"offered": hex.EncodeToString(keys[0]),
+		})
+		return ErrKeyChanged
+	}
+
+	if err := r.checkExpires(domain, d, now); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(keys[0], pinned) {
+		r.log(logging.Warn, "domain key rotated", logging.Fields{
+			"domain": domain,
+			"old":    hex.EncodeToString(pinned),
+			"new":    hex.EncodeToString(keys[0]),
+		})
+		return r.Keys.PinKey(domain, keys[0])
+	}
+
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package filesystem
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile opens the file and blocks until it holds an exclusive lock on it.
+// Closing the file releases the lock.
+func lockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,9 @@
+package filesystem
+
+import "os"
+
+// lockFile only opens the file on Windows, so writes are serialized within
+// the process but the state file must not be shared between processes.
+func lockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+}
@@ -3,8 +3,10 @@ package filesystem
 import (
 	"encoding/json"
 	"errors"
+	"io/ioutil"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/luno/moonbeam/channels"
 	"github.com/luno/moonbeam/storage"
@@ -14,15 +16,33 @@ type data struct {
 	KeyPathCounter int
 	Channels       map[string]storage.Record
 	Payments       map[string][][]byte
+	EventCounter   int64
+	Events         []storage.Event
+	EventKeys      map[string]int64
+	Cursors        map[string]int64
+	Leases         map[string]lease
+	Invoices       map[string]storage.InvoiceRecord
+}
+
+type lease struct {
+	Owner   string
+	Expires time.Time
 }
 
 func newData() *data {
 	return &data{
-		Channels: make(map[string]storage.Record),
-		Payments: make(map[string][][]byte),
+		Channels:  make(map[string]storage.Record),
+		Payments:  make(map[string][][]byte),
+		EventKeys: make(map[string]int64),
+		Cursors:   make(map[string]int64),
+		Leases:    make(map[string]lease),
+		Invoices:  make(map[string]storage.InvoiceRecord),
 	}
 }
 
+// FilesystemStorage stores everything in a single JSON file. Writes hold an
+// exclusive lock on a separate lock file, so several processes can share the
+// same state file.
 type FilesystemStorage struct {
 	mu   sync.RWMutex
 	path string
@@ -34,6 +54,21 @@ func NewFilesystemStorage(path string) *FilesystemStorage {
 	}
 }
 
+// lock serializes writes within this process and with other processes
+// using the same state file.
+func (fs *FilesystemStorage) lock() (func(), error) {
+	fs.mu.Lock()
+	f, err := lockFile(fs.path + ".lock")
+	if err != nil {
+		fs.mu.Unlock()
+		return nil, err
+	}
+	return func() {
+		f.Close()
+		fs.mu.Unlock()
+	}, nil
+}
+
 func (fs *FilesystemStorage) load() (*data, error) {
 	f, err := os.Open(fs.path)
 	if os.IsNotExist(err) {
@@ -111,13 +146,55 @@ func (fs *FilesystemStorage) List() ([]storage.Record, error) {
 	return sl, nil
 }
 
-func (fs *FilesystemStorage) Create(rec storage.Record) error {
+func appendEvents(d *data, events []storage.Event) {
+	for _, e := range events {
+		if e.Key != "" {
+			if _, ok := d.EventKeys[e.Key]; ok {
+				continue
+			}
+		}
+		d.EventCounter++
+		e.Seq = d.EventCounter
+		d.Events = append(d.Events, e)
+		if e.Key != "" {
+			if d.EventKeys == nil {
+				d.EventKeys = make(map[string]int64)
+			}
+			d.EventKeys[e.Key] = e.Seq
+		}
+	}
+}
+
+// pruneEvents deletes the events that every cursor has passed so that the
+// state file doesn't keep growing. Events are kept if there are no cursors.
+// The keys of deleted events are kept so they aren't written again.
+func pruneEvents(d *data) {
+	if len(d.Cursors) == 0 {
+		return
+	}
+	low := d.EventCounter
+	for _, seq := range d.Cursors {
+		if seq < low {
+			low = seq
+		}
+	}
+	i := 0
+	for i < len(d.Events) && d.Events[i].Seq <= low {
+		i++
+	}
+	d.Events = append([]storage.Event(nil), d.Events[i:]...)
+}
+
+func (fs *FilesystemStorage) Create(rec storage.Record, events []storage.Event) error {
 	if rec.ID == "" {
 		return errors.New("invalid id")
 	}
 
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	unlock, err := fs.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
 	d, err := fs.load()
 	if err != nil {
@@ -129,6 +206,7 @@ func (fs *FilesystemStorage) Create(rec storage.Record) error {
 	}
 
 	d.Channels[rec.ID] = rec
+	appendEvents(d, events)
 
 	return fs.save(d)
 }
@@ -141,9 +219,12 @@ func checkSame(d *data, id string, prev channels.SharedState) bool {
 		s.PaymentsHash == prev.PaymentsHash
 }
 
-func (fs *FilesystemStorage) Update(id string, prev, new channels.SharedState, payment []byte) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+func (fs *FilesystemStorage) Update(id string, prev, new channels.SharedState, payment []byte, invoiceID string, events []storage.Event) error {
+	unlock, err := fs.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
 	d, err := fs.load()
 	if err != nil {
@@ -158,19 +239,80 @@ func (fs *FilesystemStorage) Update(id string, prev, new channels.SharedState, p
 		return storage.ErrConcurrentUpdate
 	}
 
+	if invoiceID != "" {
+		inv, ok := d.Invoices[invoiceID]
+		if !ok {
+			return storage.ErrInvoiceNotFound
+		}
+		if inv.PaidBy != "" {
+			return storage.ErrInvoicePaid
+		}
+		inv.PaidBy = id
+		inv.PaidAt = time.Now()
+		d.Invoices[invoiceID] = inv
+	}
+
 	rec := d.Channels[id]
 	rec.SharedState = new
 	d.Channels[id] = rec
 	if payment != nil {
 		d.Payments[id] = append(d.Payments[id], payment)
 	}
+	appendEvents(d, events)
+
+	return fs.save(d)
+}
+
+func (fs *FilesystemStorage) SetTokensNotBefore(id string, t time.Time) error {
+	unlock, err := fs.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	d, err := fs.load()
+	if err != nil {
+		return err
+	}
+
+	rec, ok := d.Channels[id]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	rec.TokensNotBefore = t
+	d.Channels[id] = rec
+
+	return fs.save(d)
+}
+
+func (fs *FilesystemStorage) SetFrozen(id string, frozen bool) error {
+	unlock, err := fs.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	d, err := fs.load()
+	if err != nil {
+		return err
+	}
+
+	rec, ok := d.Channels[id]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	rec.Frozen = frozen
+	d.Channels[id] = rec
 
 	return fs.save(d)
 }
 
 func (fs *FilesystemStorage) ReserveKeyPath() (int, error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	unlock, err := fs.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
 
 	d, err := fs.load()
 	if err != nil {
@@ -194,5 +336,198 @@ func (fs *FilesystemStorage) ListPayments(channelID string) ([][]byte, error) {
 	return d.Payments[channelID], nil
 }
 
+func (fs *FilesystemStorage) AppendEvents(events []storage.Event) error {
+	unlock, err := fs.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	d, err := fs.load()
+	if err != nil {
+		return err
+	}
+
+	appendEvents(d, events)
+
+	return fs.save(d)
+}
+
+func (fs *FilesystemStorage) ListEvents(after int64, limit int) ([]storage.Event, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	d, err := fs.load()
+	if err != nil {
+		return nil, err
+	}
+
+	var sl []storage.Event
+	for _, e := range d.Events {
+		if e.Seq <= after {
+			continue
+		}
+		if len(sl) >= limit {
+			break
+		}
+		sl = append(sl, e)
+	}
+
+	return sl, nil
+}
+
+func (fs *FilesystemStorage) GetCursor(name string) (int64, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	d, err := fs.load()
+	if err != nil {
+		return 0, err
+	}
+
+	return d.Cursors[name], nil
+}
+
+func (fs *FilesystemStorage) SetCursor(name string, seq int64) error {
+	unlock, err := fs.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	d, err := fs.load()
+	if err != nil {
+		return err
+	}
+
+	if d.Cursors == nil {
+		d.Cursors = make(map[string]int64)
+	}
+	d.Cursors[name] = seq
+	pruneEvents(d)
+
+	return fs.save(d)
+}
+
+func (fs *FilesystemStorage) AcquireLease(name, owner string, ttl time.Duration) (bool, error) {
+	unlock, err := fs.lock()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	d, err := fs.load()
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	if l, ok := d.Leases[name]; ok && l.Owner != owner && now.Before(l.Expires) {
+		return false, nil
+	}
+
+	if d.Leases == nil {
+		d.Leases = make(map[string]lease)
+	}
+	d.Leases[name] = lease{Owner: owner, Expires: now.Add(ttl)}
+
+	return true, fs.save(d)
+}
+
+func (fs *FilesystemStorage) ReleaseLease(name, owner string) error {
+	unlock, err := fs.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	d, err := fs.load()
+	if err != nil {
+		return err
+	}
+
+	if l, ok := d.Leases[name]; !ok || l.Owner != owner {
+		return nil
+	}
+	delete(d.Leases, name)
+
+	return fs.save(d)
+}
+
+func (fs *FilesystemStorage) CreateInvoice(rec storage.InvoiceRecord) error {
+	if rec.Invoice.ID == "" {
+		return errors.New("invalid id")
+	}
+
+	unlock, err := fs.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	d, err := fs.load()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := d.Invoices[rec.Invoice.ID]; ok {
+		return errors.New("invoice already exists")
+	}
+	if d.Invoices == nil {
+		d.Invoices = make(map[string]storage.InvoiceRecord)
+	}
+	d.Invoices[rec.Invoice.ID] = rec
+
+	return fs.save(d)
+}
+
+func (fs *FilesystemStorage) GetInvoice(id string) (*storage.InvoiceRecord, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	d, err := fs.load()
+	if err != nil {
+		return nil, err
+	}
+
+	rec, ok := d.Invoices[id]
+	if !ok {
+		return nil, storage.ErrInvoiceNotFound
+	}
+	return &rec, nil
+}
+
+func (fs *FilesystemStorage) ListInvoices() ([]storage.InvoiceRecord, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	d, err := fs.load()
+	if err != nil {
+		return nil, err
+	}
+
+	var sl []storage.InvoiceRecord
+	for _, rec := range d.Invoices {
+		sl = append(sl, rec)
+	}
+	return sl, nil
+}
+
+// Check reads the state file and writes a probe file next to it.
+func (fs *FilesystemStorage) Check() error {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	if _, err := fs.load(); err != nil {
+		return err
+	}
+
+	probe := fs.path + ".check"
+	if err := ioutil.WriteFile(probe, []byte("ok"), 0600); err != nil {
+		return err
+	}
+	return os.Remove(probe)
+}
+
 // Make sure FilesystemStorage implements Storage.
 var _ storage.Storage = &FilesystemStorage{}
@@ -0,0 +1,114 @@
+package filesystem
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/luno/moonbeam/storage"
+)
+
+func TestWritesWaitForLockFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moonbeam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	// Another process holding the lock file.
+	f, err := lockFile(path + ".lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := NewFilesystemStorage(path)
+	done := make(chan bool)
+	go func() {
+		ok, err := fs.AcquireLease("a", "a", time.Minute)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- ok
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("Lease acquired while the state file was locked")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	f.Close()
+	if ok := <-done; !ok {
+		t.Errorf("Expected lease to be acquired")
+	}
+
+	other := NewFilesystemStorage(path)
+	ok, err := other.AcquireLease("a", "b", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Errorf("Lease acquired by a second owner")
+	}
+}
+
+func TestEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moonbeam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := NewFilesystemStorage(filepath.Join(dir, "state.json"))
+
+	seqs := func() []int64 {
+		events, err := fs.ListEvents(0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sl []int64
+		for _, e := range events {
+			sl = append(sl, e.Seq)
+		}
+		return sl
+	}
+
+	events := []storage.Event{{Type: "a"}, {Type: "b", Key: "k"}, {Type: "c"}}
+	if err := fs.AppendEvents(events); err != nil {
+		t.Fatal(err)
+	}
+	// Events with a key are only written once.
+	if err := fs.AppendEvents([]storage.Event{{Type: "b", Key: "k"}, {Type: "d"}}); err != nil {
+		t.Fatal(err)
+	}
+	if sl := seqs(); len(sl) != 4 || sl[3] != 4 {
+		t.Fatalf("Unexpected events %v", sl)
+	}
+
+	// Events are deleted once every cursor has passed them.
+	if err := fs.SetCursor("y", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetCursor("x", 3); err != nil {
+		t.Fatal(err)
+	}
+	if sl := seqs(); len(sl) != 3 || sl[0] != 2 {
+		t.Errorf("Expected events after 1, got %v", sl)
+	}
+	if err := fs.SetCursor("y", 4); err != nil {
+		t.Fatal(err)
+	}
+	if sl := seqs(); len(sl) != 1 || sl[0] != 4 {
+		t.Errorf("Expected events after 3, got %v", sl)
+	}
+
+	// Keys of deleted events are remembered.
+	if err := fs.AppendEvents([]storage.Event{{Type: "b", Key: "k"}}); err != nil {
+		t.Fatal(err)
+	}
+	if sl := seqs(); len(sl) != 1 {
+		t.Errorf("Expected deleted event not to be written again, got %v", sl)
+	}
+}
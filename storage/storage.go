@@ -2,24 +2,98 @@ package storage
 
 import (
 	"errors"
+	"time"
 
 	"github.com/luno/moonbeam/channels"
+	"github.com/luno/moonbeam/models"
 )
 
 var ErrNotFound = errors.New("record not found")
 var ErrConcurrentUpdate = errors.New("concurrent update")
+var ErrInvoiceNotFound = errors.New("invoice not found")
+var ErrInvoicePaid = errors.New("invoice is already paid")
 
 type Record struct {
 	ID          string
 	KeyPath     int
 	SharedState channels.SharedState
+
+	// Auth tokens issued before TokensNotBefore are revoked.
+	TokensNotBefore time.Time
+
+	// Frozen channels don't accept payments.
+	Frozen bool
+}
+
+// InvoiceRecord is an invoice issued by the receiver.
+type InvoiceRecord struct {
+	Invoice models.Invoice
+	Created time.Time
+
+	// PaidBy is the ID of the channel that paid the invoice, empty if it
+	// hasn't been paid.
+	PaidBy string
+	PaidAt time.Time
+}
+
+// Event is an entry in the outbox of channel events. Seq is assigned by the
+// storage when the event is written and is strictly increasing.
+type Event struct {
+	Seq       int64
+	Type      string
+	ChannelID string
+	Data      []byte
+
+	// Key optionally identifies the event so that it is only written once.
+	Key string
 }
 
 type Storage interface {
 	Get(id string) (*Record, error)
 	List() ([]Record, error)
-	Create(rec Record) error
-	Update(id string, prev, new channels.SharedState, payment []byte) error
+
+	// Create stores a new record together with any events in the same
+	// transaction.
+	Create(rec Record, events []Event) error
+
+	// Update replaces the shared state of a record if it still matches prev.
+	// The payment, if any, and events are stored in the same transaction.
+	// If invoiceID is set, the invoice is marked as paid by the record in the
+	// same transaction, or ErrInvoicePaid is returned if it already was.
+	Update(id string, prev, new channels.SharedState, payment []byte, invoiceID string, events []Event) error
+
+	SetTokensNotBefore(id string, t time.Time) error
+	SetFrozen(id string, frozen bool) error
+
 	ReserveKeyPath() (int, error)
 	ListPayments(channelID string) ([][]byte, error)
+
+	// AppendEvents adds events to the outbox that aren't tied to a state
+	// change. Events with a Key that was written before are skipped.
+	AppendEvents(events []Event) error
+
+	// ListEvents returns up to limit events with Seq greater than after,
+	// ordered by Seq.
+	ListEvents(after int64, limit int) ([]Event, error)
+
+	// GetCursor returns the position of the named event consumer, or zero if
+	// it hasn't been set.
+	GetCursor(name string) (int64, error)
+
+	// SetCursor sets the position of the named event consumer. Events that
+	// every consumer has passed may be deleted.
+	SetCursor(name string, seq int64) error
+
+	// AcquireLease takes the named lease for owner until ttl has passed. It
+	// returns false if the lease is held by a different owner. Acquiring a
+	// lease already held by owner extends it.
+	AcquireLease(name, owner string, ttl time.Duration) (bool, error)
+	ReleaseLease(name, owner string) error
+
+	CreateInvoice(rec InvoiceRecord) error
+	GetInvoice(id string) (*InvoiceRecord, error)
+	ListInvoices() ([]InvoiceRecord, error)
+
+	// Check verifies that the storage can be read and written.
+	Check() error
 }